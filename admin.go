@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// adminTagsMaxIPs is how many IPs can be looked up with a single request.
+const adminTagsMaxIPs = 1000
+
+// CreateAdminTagsHandler serves the tags that spans from the given IPs get, so
+// that other tools can tag their telemetry the same way. The IPs are passed as
+// ip query parameters or as a JSON list in the body of a POST request. The
+// response maps every IP to its tags, which are empty for unknown IPs.
+//
+// Requests have to be authenticated with the admin token as a bearer token.
+func CreateAdminTagsHandler(provider metadataProvider, cfg Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !hasBearerToken(req, cfg.AdminToken) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="zipkates"`)
+			http.Error(w, "A valid bearer token is required", http.StatusUnauthorized)
+			return
+		}
+
+		var ips []string
+		switch req.Method {
+		case "GET":
+			ips = req.URL.Query()["ip"]
+		case "POST":
+			if err := json.NewDecoder(req.Body).Decode(&ips); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to parse IPs: %s", err), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "Only GET and POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		if len(ips) == 0 {
+			http.Error(w, "At least one IP is required", http.StatusBadRequest)
+			return
+		}
+		if len(ips) > adminTagsMaxIPs {
+			http.Error(w, fmt.Sprintf("At most %d IPs can be looked up at once", adminTagsMaxIPs), http.StatusBadRequest)
+			return
+		}
+		for _, ip := range ips {
+			if net.ParseIP(ip) == nil {
+				http.Error(w, fmt.Sprintf("Invalid IP %s", ip), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// The cluster header routes lookups like it does for spans
+		lookupProvider := provider
+		if router, ok := provider.(requestRouter); ok {
+			lookupProvider = router.ForRequest(req)
+		}
+		tags := make(map[string]map[string]string, len(ips))
+		for _, ip := range ips {
+			tags[ip] = getIPTagValues(lookupProvider, ip, cfg)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(tags); err != nil {
+			klog.Errorf("Failed to write tags response: %s", err)
+		}
+	})
+}
+
+// hasBearerToken returns whether the request has the token as its bearer
+// token. No request has an empty token.
+func hasBearerToken(req *http.Request, token string) bool {
+	const prefix = "Bearer "
+	authorization := req.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(authorization, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, prefix)), []byte(token)) == 1
+}
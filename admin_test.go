@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+)
+
+const testAdminToken = "s3cr3t"
+
+func adminTagsRequest(g *WithT, handler http.Handler, req *http.Request) (int, []byte) {
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	body, err := ioutil.ReadAll(rec.Result().Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	return rec.Code, body
+}
+
+func testAdminTagsHandler(g *WithT) http.Handler {
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("backend", testIp, map[string]string{"owner": "backend-team", "unmapped": "ignored"}))).To(Succeed())
+	g.Expect(indexer.Add(pod("unowned", "10.0.0.2", nil))).To(Succeed())
+	cfg := DefaultConfig
+	cfg.AdminToken = testAdminToken
+	return CreateAdminTagsHandler(CreateKubernetesProvider(indexer), cfg)
+}
+
+func TestAdminTagsAuthentication(t *testing.T) {
+	for name, authorization := range map[string]string{
+		"Without a token":    "",
+		"With a wrong token": "Bearer wrong",
+		"With basic auth":    "Basic " + testAdminToken,
+	} {
+		authorization := authorization
+		t.Run(name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			req := httptest.NewRequest("GET", "/admin/tags?ip="+testIp, nil)
+			if authorization != "" {
+				req.Header.Set("Authorization", authorization)
+			}
+			code, _ := adminTagsRequest(g, testAdminTagsHandler(g), req)
+
+			g.Expect(code).To(Equal(http.StatusUnauthorized))
+		})
+	}
+}
+
+func TestAdminTagsSingleIP(t *testing.T) {
+	g := NewWithT(t)
+
+	req := httptest.NewRequest("GET", "/admin/tags?ip="+testIp, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	code, body := adminTagsRequest(g, testAdminTagsHandler(g), req)
+
+	g.Expect(code).To(Equal(http.StatusOK))
+	g.Expect(string(body)).To(MatchJSON(`{"192.0.2.1": {"owner": "backend-team"}}`))
+}
+
+func TestAdminTagsSeveralIPs(t *testing.T) {
+	g := NewWithT(t)
+
+	req := httptest.NewRequest("POST", "/admin/tags", strings.NewReader(`["192.0.2.1", "10.0.0.2", "10.0.0.3"]`))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	code, body := adminTagsRequest(g, testAdminTagsHandler(g), req)
+
+	g.Expect(code).To(Equal(http.StatusOK))
+	g.Expect(string(body)).To(MatchJSON(`{
+		"192.0.2.1": {"owner": "backend-team"},
+		"10.0.0.2": {},
+		"10.0.0.3": {}
+	}`))
+}
+
+func TestAdminTagsMatchSpanTags(t *testing.T) {
+	g := NewWithT(t)
+	provider := testMultiClusterProvider(g, "X-Cluster")
+	cfg := DefaultConfig
+	cfg.AdminToken = testAdminToken
+
+	req := httptest.NewRequest("GET", "/admin/tags?ip="+testIp, nil)
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	code, body := adminTagsRequest(g, CreateAdminTagsHandler(provider, cfg), req)
+
+	spansReq := clusterSpansRequest(g)
+	CreateDirector(provider, cfg)(spansReq)
+	spans, err := ioutil.ReadAll(spansReq.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(code).To(Equal(http.StatusOK))
+	g.Expect(gjson.GetBytes(body, "192\\.0\\.2\\.1").Raw).To(MatchJSON(gjson.GetBytes(spans, "0.tags").Raw))
+}
+
+func TestAdminTagsInvalidRequests(t *testing.T) {
+	tooMany := `["` + strings.Repeat(testIp+`", "`, adminTagsMaxIPs) + testIp + `"]`
+	for name, req := range map[string]*http.Request{
+		"Without IPs":     httptest.NewRequest("GET", "/admin/tags", nil),
+		"Invalid IP":      httptest.NewRequest("GET", "/admin/tags?ip=backend", nil),
+		"Invalid body":    httptest.NewRequest("POST", "/admin/tags", strings.NewReader(`{"ip": "192.0.2.1"}`)),
+		"Too many IPs":    httptest.NewRequest("POST", "/admin/tags", strings.NewReader(tooMany)),
+		"Empty JSON list": httptest.NewRequest("POST", "/admin/tags", strings.NewReader(`[]`)),
+	} {
+		req := req
+		t.Run(name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			req.Header.Set("Authorization", "Bearer "+testAdminToken)
+			code, _ := adminTagsRequest(g, testAdminTagsHandler(g), req)
+
+			g.Expect(code).To(Equal(http.StatusBadRequest))
+		})
+	}
+
+	t.Run("Unsupported method", func(t *testing.T) {
+		g := NewWithT(t)
+
+		req := httptest.NewRequest("DELETE", "/admin/tags?ip="+testIp, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		code, _ := adminTagsRequest(g, testAdminTagsHandler(g), req)
+
+		g.Expect(code).To(Equal(http.StatusMethodNotAllowed))
+	})
+}
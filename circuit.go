@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// circuitOpenError is returned for requests that are rejected because the
+// circuit is open.
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("Circuit breaker is open, retry in %s", e.retryAfter)
+}
+
+// circuitBreaker stops sending requests upstream after
+// CircuitBreakerFailures consecutive failures. Requests fail right away while
+// the circuit is open. After CircuitBreakerOpenDuration the circuit is half
+// open and up to CircuitBreakerProbes requests are let through. The circuit
+// is closed again when all of them succeed and opened again when any of them
+// fails.
+type circuitBreaker struct {
+	next         http.RoundTripper
+	failures     int
+	openDuration time.Duration
+	probes       int
+	// now is a field so that tests can control the time
+	now func() time.Time
+
+	mu                  sync.Mutex
+	state               circuitState
+	consecutiveFailures int
+	openedAt            time.Time
+	probesInFlight      int
+	probeSuccesses      int
+
+	// Metrics, which are updated atomically
+	openedTotal   int64
+	rejectedTotal int64
+	failuresTotal int64
+}
+
+func CreateCircuitBreaker(cfg Config, next http.RoundTripper) *circuitBreaker {
+	return &circuitBreaker{
+		next:         next,
+		failures:     cfg.CircuitBreakerFailures,
+		openDuration: cfg.CircuitBreakerOpenDuration,
+		probes:       cfg.CircuitBreakerProbes,
+		now:          time.Now,
+	}
+}
+
+// RegisterMetrics adds the circuit breaker's metrics to the registry.
+func (b *circuitBreaker) RegisterMetrics(metrics *metricsRegistry) {
+	metrics.Register(
+		"zipkates_circuit_breaker_state",
+		"The state of the circuit breaker in front of Zipkin.",
+		metricTypeGauge,
+		func() []metricSample {
+			b.mu.Lock()
+			state := b.state
+			b.mu.Unlock()
+			var samples []metricSample
+			for _, s := range []circuitState{circuitClosed, circuitOpen, circuitHalfOpen} {
+				value := 0.0
+				if s == state {
+					value = 1
+				}
+				samples = append(samples, metricSample{labels: fmt.Sprintf("state=%q", s), value: value})
+			}
+			return samples
+		},
+	)
+	metrics.RegisterCounter(
+		"zipkates_circuit_breaker_opened_total",
+		"How many times the circuit breaker in front of Zipkin was opened.",
+		&b.openedTotal,
+	)
+	metrics.RegisterCounter(
+		"zipkates_circuit_breaker_rejected_requests_total",
+		"Requests to Zipkin that were rejected because the circuit breaker was open.",
+		&b.rejectedTotal,
+	)
+	metrics.RegisterCounter(
+		"zipkates_upstream_failures_total",
+		"Requests to Zipkin that failed with a connection error or a 5xx response.",
+		&b.failuresTotal,
+	)
+}
+
+func (b *circuitBreaker) RoundTrip(req *http.Request) (*http.Response, error) {
+	probe, err := b.allow()
+	if err != nil {
+		atomic.AddInt64(&b.rejectedTotal, 1)
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := b.next.RoundTrip(req)
+	b.record(probe, err == nil && resp.StatusCode < 500)
+	return resp, err
+}
+
+// allow returns whether the request can be sent and whether it's a probe.
+func (b *circuitBreaker) allow() (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.rejection(); err != nil {
+		return false, err
+	}
+	if b.state == circuitOpen {
+		b.setState(circuitHalfOpen)
+	}
+	if b.state == circuitHalfOpen {
+		b.probesInFlight++
+		return true, nil
+	}
+	return false, nil
+}
+
+// Check returns the error that a request would be rejected with right now,
+// without sending anything or taking up a probe.
+func (b *circuitBreaker) Check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rejection()
+}
+
+// rejection returns the error that requests are rejected with in the current
+// state. It has to be called with the lock held.
+func (b *circuitBreaker) rejection() error {
+	switch b.state {
+	case circuitOpen:
+		if openFor := b.now().Sub(b.openedAt); openFor < b.openDuration {
+			return &circuitOpenError{retryAfter: b.openDuration - openFor}
+		}
+	case circuitHalfOpen:
+		if b.probesInFlight+b.probeSuccesses >= b.probes {
+			return &circuitOpenError{retryAfter: time.Second}
+		}
+	}
+	return nil
+}
+
+func (b *circuitBreaker) record(probe, success bool) {
+	if !success {
+		atomic.AddInt64(&b.failuresTotal, 1)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		// The circuit could have been opened by another probe already
+		if b.state != circuitHalfOpen {
+			return
+		}
+		b.probesInFlight--
+		if !success {
+			b.open()
+			return
+		}
+		b.probeSuccesses++
+		if b.probeSuccesses >= b.probes {
+			b.setState(circuitClosed)
+		}
+		return
+	}
+	if b.state != circuitClosed {
+		return
+	}
+	if success {
+		b.consecutiveFailures = 0
+		return
+	}
+	b.consecutiveFailures++
+	if b.consecutiveFailures >= b.failures {
+		b.open()
+	}
+}
+
+// open opens the circuit. It has to be called with the lock held.
+func (b *circuitBreaker) open() {
+	b.openedAt = b.now()
+	atomic.AddInt64(&b.openedTotal, 1)
+	b.setState(circuitOpen)
+}
+
+// setState resets the counters of the new state. It has to be called with the
+// lock held.
+func (b *circuitBreaker) setState(state circuitState) {
+	if b.state != state {
+		klog.Warningf("Circuit breaker in front of Zipkin is now %s", state)
+	}
+	b.state = state
+	b.consecutiveFailures = 0
+	b.probesInFlight = 0
+	b.probeSuccesses = 0
+}
+
+// CreateLoadSheddingHandler rejects requests while the circuit is open before
+// passing them to next. The proxy's Director reads and rewrites span uploads,
+// which would be wasted on requests that the circuit breaker rejects anyway.
+func CreateLoadSheddingHandler(breaker *circuitBreaker, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := breaker.Check(); err != nil {
+			atomic.AddInt64(&breaker.rejectedTotal, 1)
+			proxyErrorHandler(w, req, err)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// proxyErrorHandler responds to requests that failed to be proxied. Requests
+// rejected by the circuit breaker get a 503 with a Retry-After header and
+// requests with too large bodies a 413. All other errors get a 502 like the
+// default handler of httputil.ReverseProxy.
+func proxyErrorHandler(w http.ResponseWriter, req *http.Request, err error) {
+	if openErr, ok := err.(*circuitOpenError); ok {
+		retryAfter := int(math.Ceil(openErr.retryAfter.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if isBodyTooLarge(err) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	klog.Errorf("Failed to proxy request to Zipkin: %s", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// fakeUpstream responds with the status, or fails when it's 0, and counts
+// the requests.
+type fakeUpstream struct {
+	status   int
+	requests int
+}
+
+func (u *fakeUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	u.requests++
+	if u.status == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{StatusCode: u.status, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+}
+
+func testCircuitBreaker() (*circuitBreaker, *fakeUpstream, *time.Time) {
+	cfg := DefaultConfig
+	cfg.CircuitBreakerFailures = 2
+	cfg.CircuitBreakerOpenDuration = 10 * time.Second
+	cfg.CircuitBreakerProbes = 2
+	upstream := &fakeUpstream{status: http.StatusAccepted}
+	breaker := CreateCircuitBreaker(cfg, upstream)
+	now := time.Unix(1556604172, 0)
+	breaker.now = func() time.Time { return now }
+	return breaker, upstream, &now
+}
+
+func roundTrip(breaker *circuitBreaker) error {
+	resp, err := breaker.RoundTrip(httptest.NewRequest("POST", "/api/v2/spans", nil))
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	g := NewWithT(t)
+
+	breaker, upstream, _ := testCircuitBreaker()
+	upstream.status = http.StatusServiceUnavailable
+	g.Expect(roundTrip(breaker)).To(Succeed())
+	upstream.status = 0
+	g.Expect(roundTrip(breaker)).NotTo(Succeed())
+	g.Expect(breaker.state).To(Equal(circuitOpen))
+
+	err := roundTrip(breaker)
+
+	g.Expect(err).To(Equal(&circuitOpenError{retryAfter: 10 * time.Second}))
+	g.Expect(upstream.requests).To(Equal(2))
+}
+
+func TestCircuitBreakerSuccessResetsFailures(t *testing.T) {
+	g := NewWithT(t)
+
+	breaker, upstream, _ := testCircuitBreaker()
+	for i := 0; i < 3; i++ {
+		upstream.status = http.StatusInternalServerError
+		g.Expect(roundTrip(breaker)).To(Succeed())
+		upstream.status = http.StatusBadRequest
+		g.Expect(roundTrip(breaker)).To(Succeed())
+	}
+
+	g.Expect(breaker.state).To(Equal(circuitClosed))
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	t.Run("Successful probes close the circuit", func(t *testing.T) {
+		g := NewWithT(t)
+
+		breaker, upstream, now := testCircuitBreaker()
+		breaker.open()
+		*now = now.Add(10 * time.Second)
+
+		g.Expect(roundTrip(breaker)).To(Succeed())
+		g.Expect(breaker.state).To(Equal(circuitHalfOpen))
+		g.Expect(roundTrip(breaker)).To(Succeed())
+		g.Expect(breaker.state).To(Equal(circuitClosed))
+		g.Expect(upstream.requests).To(Equal(2))
+	})
+
+	t.Run("A failed probe opens the circuit again", func(t *testing.T) {
+		g := NewWithT(t)
+
+		breaker, upstream, now := testCircuitBreaker()
+		breaker.open()
+		*now = now.Add(10 * time.Second)
+		upstream.status = http.StatusBadGateway
+
+		g.Expect(roundTrip(breaker)).To(Succeed())
+		g.Expect(breaker.state).To(Equal(circuitOpen))
+		g.Expect(roundTrip(breaker)).To(HaveOccurred())
+		g.Expect(upstream.requests).To(Equal(1))
+	})
+
+	t.Run("Only the probes are let through", func(t *testing.T) {
+		g := NewWithT(t)
+
+		breaker, _, now := testCircuitBreaker()
+		breaker.open()
+		*now = now.Add(10 * time.Second)
+		release := make(chan struct{})
+		started := make(chan struct{}, 2)
+		breaker.next = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			started <- struct{}{}
+			<-release
+			return &http.Response{StatusCode: http.StatusAccepted, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		})
+		done := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			go func() { done <- roundTrip(breaker) }()
+			<-started
+		}
+
+		g.Expect(roundTrip(breaker)).To(Equal(&circuitOpenError{retryAfter: time.Second}))
+		close(release)
+		g.Expect(<-done).To(Succeed())
+		g.Expect(<-done).To(Succeed())
+		g.Expect(breaker.state).To(Equal(circuitClosed))
+	})
+}
+
+func TestCircuitBreakerShedsLoad(t *testing.T) {
+	g := NewWithT(t)
+
+	breaker, _, now := testCircuitBreaker()
+	breaker.open()
+	*now = now.Add(2500 * time.Millisecond)
+	directed := 0
+	director := CreateDirector(CreateKubernetesProvider(CreateIndexer()), DefaultConfig)
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			directed++
+			director(req)
+		},
+		Transport:    breaker,
+		ErrorHandler: proxyErrorHandler,
+	}
+
+	recorder := httptest.NewRecorder()
+	CreateLoadSheddingHandler(breaker, proxy).ServeHTTP(recorder, spansRequest(g))
+
+	g.Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+	g.Expect(recorder.Header().Get("Retry-After")).To(Equal("8"))
+	// The body isn't read and rewritten for a request that is rejected
+	g.Expect(directed).To(BeZero())
+	g.Expect(breaker.rejectedTotal).To(Equal(int64(1)))
+}
+
+func TestCircuitBreakerCheckDoesNotTakeProbes(t *testing.T) {
+	g := NewWithT(t)
+
+	breaker, upstream, now := testCircuitBreaker()
+	breaker.open()
+	*now = now.Add(10 * time.Second)
+
+	g.Expect(breaker.Check()).To(Succeed())
+	g.Expect(breaker.Check()).To(Succeed())
+	g.Expect(breaker.Check()).To(Succeed())
+	g.Expect(roundTrip(breaker)).To(Succeed())
+	g.Expect(roundTrip(breaker)).To(Succeed())
+	g.Expect(upstream.requests).To(Equal(2))
+	g.Expect(breaker.state).To(Equal(circuitClosed))
+}
+
+func TestCircuitBreakerMetrics(t *testing.T) {
+	g := NewWithT(t)
+
+	breaker, upstream, _ := testCircuitBreaker()
+	metrics := CreateMetricsRegistry()
+	breaker.RegisterMetrics(metrics)
+	upstream.status = 0
+	g.Expect(roundTrip(breaker)).NotTo(Succeed())
+	g.Expect(roundTrip(breaker)).NotTo(Succeed())
+	g.Expect(roundTrip(breaker)).NotTo(Succeed())
+
+	recorder := httptest.NewRecorder()
+	metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/zipkates/metrics", nil))
+
+	body := recorder.Body.String()
+	g.Expect(body).To(ContainSubstring("# TYPE zipkates_circuit_breaker_state gauge\n"))
+	g.Expect(body).To(ContainSubstring(`zipkates_circuit_breaker_state{state="closed"} 0` + "\n"))
+	g.Expect(body).To(ContainSubstring(`zipkates_circuit_breaker_state{state="open"} 1` + "\n"))
+	g.Expect(body).To(ContainSubstring("zipkates_circuit_breaker_opened_total 1\n"))
+	g.Expect(body).To(ContainSubstring("zipkates_circuit_breaker_rejected_requests_total 1\n"))
+	g.Expect(body).To(ContainSubstring("zipkates_upstream_failures_total 2\n"))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+// clusterNameTag is the tag that the name of the pod's cluster is added as.
+const clusterNameTag = "k8s.cluster.name"
+
+// clusterAnnotation is the annotation that the name of the cluster that a pod
+// was found in is kept in. It's set by zipkates on its copies of pods and is
+// sent to other instances along with them.
+const clusterAnnotation = "zipkates.io/cluster"
+
+// podClusterName returns the name of the cluster that the pod was found in,
+// or an empty string when it's not known.
+func podClusterName(pod *v1.Pod) string {
+	return pod.Annotations[clusterAnnotation]
+}
+
+// setPodClusterName records the name of the cluster that the pod was found
+// in. Empty names are not recorded.
+func setPodClusterName(pod *v1.Pod, clusterName string) {
+	if clusterName == "" {
+		return
+	}
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[clusterAnnotation] = clusterName
+}
+
+// clusterLocator is implemented by providers that know which cluster an IP is
+// in without a pod with the IP, so that spans from unknown IPs still get the
+// cluster name.
+type clusterLocator interface {
+	ClusterForIP(ip string) string
+}
+
+// kubernetesCluster is one of the clusters that pods are watched in.
+type kubernetesCluster struct {
+	Name        string
+	Kubeconfig  string
+	KubeContext string
+	// CIDRs are the pod IP ranges of the cluster, which requests are routed
+	// to the cluster by.
+	CIDRs []*net.IPNet
+}
+
+// parseClusters parses a JSON list of clusters like
+// [{"name": "prod-eu", "kubeconfig": "/etc/zipkates/prod-eu", "context": "", "cidrs": ["10.0.0.0/14"]}].
+func parseClusters(value string) ([]kubernetesCluster, error) {
+	var rawClusters []struct {
+		Name       string   `json:"name"`
+		Kubeconfig string   `json:"kubeconfig"`
+		Context    string   `json:"context"`
+		CIDRs      []string `json:"cidrs"`
+	}
+	if err := json.Unmarshal([]byte(value), &rawClusters); err != nil {
+		return nil, err
+	}
+	clusters := make([]kubernetesCluster, 0, len(rawClusters))
+	names := map[string]bool{}
+	for _, rawCluster := range rawClusters {
+		if rawCluster.Name == "" {
+			return nil, fmt.Errorf("Every cluster needs a name")
+		}
+		if names[rawCluster.Name] {
+			return nil, fmt.Errorf("Cluster %s is defined more than once", rawCluster.Name)
+		}
+		names[rawCluster.Name] = true
+		cluster := kubernetesCluster{
+			Name:        rawCluster.Name,
+			Kubeconfig:  rawCluster.Kubeconfig,
+			KubeContext: rawCluster.Context,
+		}
+		for _, rawCIDR := range rawCluster.CIDRs {
+			_, cidr, err := net.ParseCIDR(rawCIDR)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid CIDR of cluster %s: %w", rawCluster.Name, err)
+			}
+			cluster.CIDRs = append(cluster.CIDRs, cidr)
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
+
+type clusterProvider struct {
+	kubernetesCluster
+	provider metadataProvider
+}
+
+func (c *clusterProvider) PodByIP(ip string) (*v1.Pod, error) {
+	return c.provider.PodByIP(ip)
+}
+
+func (c *clusterProvider) PodsByIdentity(identity podIdentity) ([]*v1.Pod, error) {
+	return c.provider.PodsByIdentity(identity)
+}
+
+// ClusterForIP returns the name of the cluster, as all IPs that are looked up
+// with the provider were routed to it.
+func (c *clusterProvider) ClusterForIP(ip string) string {
+	return c.Name
+}
+
+// multiClusterProvider looks up pods in several clusters. Requests are routed
+// to a cluster by the CIDR that contains their IP or by the header that names
+// it. Other requests are looked up in all clusters, in the configured order.
+type multiClusterProvider struct {
+	clusters []*clusterProvider
+	header   string
+}
+
+func CreateMultiClusterProvider(header string) *multiClusterProvider {
+	return &multiClusterProvider{header: header}
+}
+
+// AddCluster adds a cluster with the provider for its pods.
+func (m *multiClusterProvider) AddCluster(cluster kubernetesCluster, provider metadataProvider) {
+	m.clusters = append(m.clusters, &clusterProvider{kubernetesCluster: cluster, provider: provider})
+}
+
+// ForRequest returns the provider of the cluster that the request names in
+// the cluster header, or the multi-cluster provider itself when it doesn't.
+// The header is only trusted for requests from outside of the clusters'
+// CIDRs, as requests from inside are routed by their IP.
+func (m *multiClusterProvider) ForRequest(req *http.Request) metadataProvider {
+	if m.header == "" {
+		return m
+	}
+	name := req.Header.Get(m.header)
+	if name == "" {
+		return m
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil && m.clusterForIP(host) != nil {
+		if klog.V(1) {
+			klog.Infof("Ignoring the %s header of a request from %s, which is in a cluster's CIDRs", m.header, host)
+		}
+		return m
+	}
+	for _, c := range m.clusters {
+		if c.Name == name {
+			return c
+		}
+	}
+	klog.Warningf("Unknown cluster %s in the %s header, looking pods up in all clusters", name, m.header)
+	return m
+}
+
+// clusterForIP returns the cluster whose CIDRs contain the IP, or nil when
+// there is none.
+func (m *multiClusterProvider) clusterForIP(ip string) *clusterProvider {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	for _, c := range m.clusters {
+		for _, cidr := range c.CIDRs {
+			if cidr.Contains(parsed) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// ClusterForIP returns the name of the cluster whose CIDRs contain the IP.
+func (m *multiClusterProvider) ClusterForIP(ip string) string {
+	if c := m.clusterForIP(ip); c != nil {
+		return c.Name
+	}
+	return ""
+}
+
+func (m *multiClusterProvider) PodByIP(ip string) (*v1.Pod, error) {
+	if c := m.clusterForIP(ip); c != nil {
+		return c.provider.PodByIP(ip)
+	}
+	for _, c := range m.clusters {
+		if pod, err := c.provider.PodByIP(ip); err == nil {
+			return pod, nil
+		}
+	}
+	return nil, fmt.Errorf("Did not find any pod for IP %s in any cluster", ip)
+}
+
+func (m *multiClusterProvider) PodsByIdentity(identity podIdentity) ([]*v1.Pod, error) {
+	var pods []*v1.Pod
+	for _, c := range m.clusters {
+		clusterPods, err := c.provider.PodsByIdentity(identity)
+		if err != nil {
+			return nil, err
+		}
+		pods = append(pods, clusterPods...)
+	}
+	return pods, nil
+}
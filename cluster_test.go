@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestParseClusters(t *testing.T) {
+	t.Run("Valid", func(t *testing.T) {
+		g := NewWithT(t)
+
+		clusters, err := parseClusters(`[
+			{"name": "prod-eu", "kubeconfig": "/etc/zipkates/prod-eu", "cidrs": ["10.0.0.0/14"]},
+			{"name": "prod-us", "kubeconfig": "/etc/zipkates/prod", "context": "us"}
+		]`)
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(clusters).To(HaveLen(2))
+		g.Expect(clusters[0].Name).To(Equal("prod-eu"))
+		g.Expect(clusters[0].Kubeconfig).To(Equal("/etc/zipkates/prod-eu"))
+		g.Expect(clusters[0].CIDRs).To(HaveLen(1))
+		g.Expect(clusters[0].CIDRs[0].String()).To(Equal("10.0.0.0/14"))
+		g.Expect(clusters[1].KubeContext).To(Equal("us"))
+		g.Expect(clusters[1].CIDRs).To(BeEmpty())
+	})
+
+	t.Run("Without a name", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := parseClusters(`[{"kubeconfig": "/etc/zipkates/prod-eu"}]`)
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("Duplicate names", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := parseClusters(`[{"name": "prod"}, {"name": "prod"}]`)
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("Invalid CIDR", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := parseClusters(`[{"name": "prod", "cidrs": ["10.0.0.0/33"]}]`)
+
+		g.Expect(err).To(HaveOccurred())
+	})
+}
+
+// clusterIndexer returns an indexer with the pod stored the way the cluster's
+// reflector stores it.
+func clusterIndexer(g *WithT, clusterName, name, ip string) cache.Indexer {
+	cfg := DefaultConfig
+	cfg.ClusterName = clusterName
+	indexer := CreateIndexer()
+	store := CreatePodCacheStore(indexer, allNamespaces, cfg)
+	p := pod(name, ip, map[string]string{"owner": name})
+	p.Namespace = "default"
+	g.Expect(store.Add(p)).To(Succeed())
+	return indexer
+}
+
+func testMultiClusterProvider(g *WithT, header string) *multiClusterProvider {
+	clusters, err := parseClusters(`[
+		{"name": "eu", "cidrs": ["10.0.0.0/16"]},
+		{"name": "us", "cidrs": ["10.1.0.0/16"]}
+	]`)
+	g.Expect(err).NotTo(HaveOccurred())
+	provider := CreateMultiClusterProvider(header)
+	// The clusters use overlapping pod IPs, like clusters behind different
+	// VPNs can
+	provider.AddCluster(clusters[0], CreateKubernetesProvider(clusterIndexer(g, "eu", "eu-pod", testIp)))
+	provider.AddCluster(clusters[1], CreateKubernetesProvider(clusterIndexer(g, "us", "us-pod", "10.1.0.5")))
+	return provider
+}
+
+func TestMultiClusterPodByIP(t *testing.T) {
+	t.Run("By CIDR", func(t *testing.T) {
+		g := NewWithT(t)
+
+		pod, err := testMultiClusterProvider(g, "").PodByIP("10.1.0.5")
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(pod.Name).To(Equal("us-pod"))
+		g.Expect(podClusterName(pod)).To(Equal("us"))
+	})
+
+	t.Run("Outside of the CIDRs", func(t *testing.T) {
+		g := NewWithT(t)
+
+		pod, err := testMultiClusterProvider(g, "").PodByIP(testIp)
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(pod.Name).To(Equal("eu-pod"))
+		g.Expect(podClusterName(pod)).To(Equal("eu"))
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := testMultiClusterProvider(g, "").PodByIP("10.0.0.9")
+
+		g.Expect(err).To(HaveOccurred())
+	})
+}
+
+func TestMultiClusterPodsByIdentity(t *testing.T) {
+	g := NewWithT(t)
+
+	pods, err := testMultiClusterProvider(g, "").PodsByIdentity(podIdentity{namespace: "default", pod: "us-pod"})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pods).To(HaveLen(1))
+	g.Expect(podClusterName(pods[0])).To(Equal("us"))
+}
+
+func clusterSpansRequest(g *WithT) *http.Request {
+	return httptest.NewRequest(
+		"POST", "/api/v2/spans",
+		strings.NewReader(fmt.Sprintf("[%s]", span(g, map[string]string{}))),
+	)
+}
+
+func TestClusterNameTag(t *testing.T) {
+	t.Run("Single cluster", func(t *testing.T) {
+		g := NewWithT(t)
+
+		req := clusterSpansRequest(g)
+		CreateDirector(CreateKubernetesProvider(clusterIndexer(g, "eu", "eu-pod", testIp)), DefaultConfig)(req)
+
+		body, err := ioutil.ReadAll(req.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(gjson.GetBytes(body, "0.tags.k8s\\.cluster\\.name").String()).To(Equal("eu"))
+		g.Expect(gjson.GetBytes(body, "0.tags.owner").String()).To(Equal("eu-pod"))
+	})
+
+	t.Run("Without a cluster name", func(t *testing.T) {
+		g := NewWithT(t)
+
+		req := clusterSpansRequest(g)
+		CreateDirector(CreateKubernetesProvider(clusterIndexer(g, "", "eu-pod", testIp)), DefaultConfig)(req)
+
+		body, err := ioutil.ReadAll(req.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(gjson.GetBytes(body, "0.tags.k8s\\.cluster\\.name").Exists()).To(BeFalse())
+	})
+
+	t.Run("Routed by header", func(t *testing.T) {
+		g := NewWithT(t)
+		provider := testMultiClusterProvider(g, "X-Cluster")
+		// The pod in the other cluster has the same IP as the request
+		provider.clusters[1].provider = CreateKubernetesProvider(clusterIndexer(g, "us", "us-pod", testIp))
+
+		cfg := DefaultConfig
+		cfg.ClusterHeader = "X-Cluster"
+
+		req := clusterSpansRequest(g)
+		req.Header.Set("X-Cluster", "us")
+		CreateDirector(provider, cfg)(req)
+
+		body, err := ioutil.ReadAll(req.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(gjson.GetBytes(body, "0.tags.k8s\\.cluster\\.name").String()).To(Equal("us"))
+		g.Expect(gjson.GetBytes(body, "0.tags.owner").String()).To(Equal("us-pod"))
+		// The header isn't forwarded to Zipkin
+		g.Expect(req.Header.Get("X-Cluster")).To(BeEmpty())
+	})
+
+	t.Run("Header from inside a CIDR", func(t *testing.T) {
+		g := NewWithT(t)
+
+		req := clusterSpansRequest(g)
+		req.RemoteAddr = "10.1.0.5:43210"
+		req.Header.Set("X-Cluster", "eu")
+		CreateDirector(testMultiClusterProvider(g, "X-Cluster"), DefaultConfig)(req)
+
+		body, err := ioutil.ReadAll(req.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(gjson.GetBytes(body, "0.tags.k8s\\.cluster\\.name").String()).To(Equal("us"))
+		g.Expect(gjson.GetBytes(body, "0.tags.owner").String()).To(Equal("us-pod"))
+	})
+
+	t.Run("Unknown IP in a CIDR", func(t *testing.T) {
+		g := NewWithT(t)
+
+		req := clusterSpansRequest(g)
+		req.RemoteAddr = "10.1.0.9:43210"
+		CreateDirector(testMultiClusterProvider(g, ""), DefaultConfig)(req)
+
+		body, err := ioutil.ReadAll(req.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(gjson.GetBytes(body, "0.tags").Value()).To(Equal(map[string]interface{}{
+			"k8s.cluster.name": "us",
+		}))
+	})
+
+	t.Run("Unknown IP routed by header", func(t *testing.T) {
+		g := NewWithT(t)
+
+		req := clusterSpansRequest(g)
+		req.Header.Set("X-Cluster", "us")
+		CreateDirector(testMultiClusterProvider(g, "X-Cluster"), DefaultConfig)(req)
+
+		body, err := ioutil.ReadAll(req.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(gjson.GetBytes(body, "0.tags").Value()).To(Equal(map[string]interface{}{
+			"k8s.cluster.name": "us",
+		}))
+	})
+
+	t.Run("Unknown cluster in the header", func(t *testing.T) {
+		g := NewWithT(t)
+
+		req := clusterSpansRequest(g)
+		req.Header.Set("X-Cluster", "asia")
+		CreateDirector(testMultiClusterProvider(g, "X-Cluster"), DefaultConfig)(req)
+
+		body, err := ioutil.ReadAll(req.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(gjson.GetBytes(body, "0.tags.k8s\\.cluster\\.name").String()).To(Equal("eu"))
+	})
+}
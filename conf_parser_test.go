@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 	"testing"
+	"time"
 
 	. "github.com/onsi/gomega"
 )
@@ -115,7 +116,7 @@ func TestZipkinPort(t *testing.T) {
 		cfg, err := ParseConfigFromEnv()
 
 		g.Expect(err).NotTo(HaveOccurred())
-		g.Expect(cfg.ZipkinPort).To(Equal(9410))
+		g.Expect(cfg.ZipkinURL.String()).To(Equal("http://127.0.0.1:9410"))
 	})
 
 	t.Run("Empty string", func(t *testing.T) {
@@ -125,7 +126,7 @@ func TestZipkinPort(t *testing.T) {
 		cfg, err := ParseConfigFromEnv()
 
 		g.Expect(err).NotTo(HaveOccurred())
-		g.Expect(cfg.ZipkinPort).To(Equal(9410))
+		g.Expect(cfg.ZipkinURL.String()).To(Equal("http://127.0.0.1:9410"))
 	})
 
 	t.Run("A number", func(t *testing.T) {
@@ -135,7 +136,7 @@ func TestZipkinPort(t *testing.T) {
 		cfg, err := ParseConfigFromEnv()
 
 		g.Expect(err).NotTo(HaveOccurred())
-		g.Expect(cfg.ZipkinPort).To(Equal(8080))
+		g.Expect(cfg.ZipkinURL.String()).To(Equal("http://127.0.0.1:8080"))
 	})
 
 	t.Run("Not a number", func(t *testing.T) {
@@ -149,3 +150,1116 @@ func TestZipkinPort(t *testing.T) {
 
 	os.Unsetenv("ZIPKIN_PORT")
 }
+
+func TestZipkinURL(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("ZIPKIN_URL")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ZipkinURL.String()).To(Equal("http://127.0.0.1:9410"))
+	})
+
+	t.Run("HTTPS with a path prefix", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("ZIPKIN_URL", "https://zipkin.example.com/zipkin/")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ZipkinURL.String()).To(Equal("https://zipkin.example.com/zipkin"))
+	})
+
+	t.Run("Unix socket", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("ZIPKIN_URL", "unix:///var/run/zipkin.sock")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ZipkinURL.Scheme).To(Equal("unix"))
+		g.Expect(cfg.ZipkinURL.Path).To(Equal("/var/run/zipkin.sock"))
+	})
+
+	t.Run("Takes precedence over ZIPKIN_PORT", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("ZIPKIN_PORT", "8080")
+		os.Setenv("ZIPKIN_URL", "http://zipkin:9411")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ZipkinURL.String()).To(Equal("http://zipkin:9411"))
+		os.Unsetenv("ZIPKIN_PORT")
+	})
+
+	for _, invalid := range []string{
+		"zipkin:9411",
+		"ftp://zipkin",
+		"http:///api",
+		"unix://zipkin.sock",
+		"http://zipkin:9411?debug=true",
+	} {
+		t.Run("Invalid "+invalid, func(t *testing.T) {
+			g := NewWithT(t)
+
+			os.Setenv("ZIPKIN_URL", invalid)
+			_, err := ParseConfigFromEnv()
+
+			g.Expect(err).To(HaveOccurred())
+		})
+	}
+
+	os.Unsetenv("ZIPKIN_URL")
+}
+
+func TestZipkinMirrors(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("ZIPKIN_MIRRORS")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ZipkinMirrors).To(BeEmpty())
+	})
+
+	t.Run("A list of mirrors", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("ZIPKIN_MIRRORS", `[
+			{"url": "http://zipkin-new:9411"},
+			{"url": "https://zipkin-staging.example.com/zipkin", "percentage": 2.5}
+		]`)
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ZipkinMirrors).To(HaveLen(2))
+		g.Expect(cfg.ZipkinMirrors[0].URL.String()).To(Equal("http://zipkin-new:9411"))
+		g.Expect(cfg.ZipkinMirrors[0].Percentage).To(Equal(100.0))
+		g.Expect(cfg.ZipkinMirrors[1].URL.String()).To(Equal("https://zipkin-staging.example.com/zipkin"))
+		g.Expect(cfg.ZipkinMirrors[1].Percentage).To(Equal(2.5))
+	})
+
+	for _, invalid := range []string{
+		`{"url": "http://zipkin:9411"}`,
+		`[{"url": "zipkin:9411"}]`,
+		`[{"url": "http://zipkin:9411", "percentage": 101}]`,
+		`[{"url": "http://zipkin:9411", "percentage": -1}]`,
+	} {
+		t.Run("Invalid "+invalid, func(t *testing.T) {
+			g := NewWithT(t)
+
+			os.Setenv("ZIPKIN_MIRRORS", invalid)
+			_, err := ParseConfigFromEnv()
+
+			g.Expect(err).To(HaveOccurred())
+		})
+	}
+
+	os.Unsetenv("ZIPKIN_MIRRORS")
+}
+
+func TestMaxDecompressedBodySize(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("MAX_DECOMPRESSED_BODY_SIZE")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.MaxDecompressedBodySize).To(Equal(int64(32 * 1024 * 1024)))
+	})
+
+	t.Run("A number", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("MAX_DECOMPRESSED_BODY_SIZE", "1024")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.MaxDecompressedBodySize).To(Equal(int64(1024)))
+	})
+
+	t.Run("Not a number", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("MAX_DECOMPRESSED_BODY_SIZE", "1MB")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	os.Unsetenv("MAX_DECOMPRESSED_BODY_SIZE")
+}
+
+func TestRecompressBody(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("RECOMPRESS_BODY")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.RecompressBody).To(BeFalse())
+	})
+
+	t.Run("True", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("RECOMPRESS_BODY", "true")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.RecompressBody).To(BeTrue())
+	})
+
+	t.Run("Not a boolean", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("RECOMPRESS_BODY", "yes")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	os.Unsetenv("RECOMPRESS_BODY")
+}
+
+func TestJaegerAgentPort(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("JAEGER_AGENT_PORT")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.JaegerAgentPort).To(Equal(0))
+	})
+
+	t.Run("A number", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("JAEGER_AGENT_PORT", "6831")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.JaegerAgentPort).To(Equal(6831))
+	})
+
+	t.Run("Not a number", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("JAEGER_AGENT_PORT", "six eight three one")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	os.Unsetenv("JAEGER_AGENT_PORT")
+}
+
+func TestUpstreamProtocol(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("UPSTREAM_PROTOCOL")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.UpstreamProtocol).To(Equal("zipkin"))
+	})
+
+	t.Run("OTLP", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("UPSTREAM_PROTOCOL", "otlp")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.UpstreamProtocol).To(Equal("otlp"))
+	})
+
+	t.Run("Unknown protocol", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("UPSTREAM_PROTOCOL", "jaeger")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	os.Unsetenv("UPSTREAM_PROTOCOL")
+}
+
+func TestAsyncForwardingConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("ASYNC_FORWARDING")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.AsyncForwarding).To(BeFalse())
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("ASYNC_FORWARDING", "true")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.AsyncForwarding).To(BeTrue())
+	})
+
+	t.Run("With the OTLP upstream", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("ASYNC_FORWARDING", "true")
+		os.Setenv("UPSTREAM_PROTOCOL", "otlp")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Unsetenv("UPSTREAM_PROTOCOL")
+	})
+
+	t.Run("Not a boolean", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("ASYNC_FORWARDING", "yes")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	os.Unsetenv("ASYNC_FORWARDING")
+}
+
+func TestQueueConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.QueueMaxBytes).To(Equal(int64(64 * 1024 * 1024)))
+		g.Expect(cfg.BatchMaxBytes).To(Equal(int64(1024 * 1024)))
+		g.Expect(cfg.BatchInterval).To(Equal(time.Second))
+		g.Expect(cfg.MaxRetries).To(Equal(5))
+	})
+
+	t.Run("Defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("QUEUE_MAX_BYTES", "1000")
+		os.Setenv("BATCH_MAX_BYTES", "100")
+		os.Setenv("BATCH_INTERVAL", "250ms")
+		os.Setenv("MAX_RETRIES", "0")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.QueueMaxBytes).To(Equal(int64(1000)))
+		g.Expect(cfg.BatchMaxBytes).To(Equal(int64(100)))
+		g.Expect(cfg.BatchInterval).To(Equal(250 * time.Millisecond))
+		g.Expect(cfg.MaxRetries).To(Equal(0))
+	})
+
+	for _, env := range []string{"QUEUE_MAX_BYTES", "BATCH_MAX_BYTES", "BATCH_INTERVAL", "MAX_RETRIES"} {
+		t.Run("Invalid "+env, func(t *testing.T) {
+			g := NewWithT(t)
+
+			os.Setenv(env, "lots")
+			_, err := ParseConfigFromEnv()
+
+			g.Expect(err).To(HaveOccurred())
+			os.Unsetenv(env)
+		})
+	}
+
+	os.Unsetenv("QUEUE_MAX_BYTES")
+	os.Unsetenv("BATCH_MAX_BYTES")
+	os.Unsetenv("BATCH_INTERVAL")
+	os.Unsetenv("MAX_RETRIES")
+}
+
+func TestSpoolConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.SpoolDir).To(BeEmpty())
+		g.Expect(cfg.SpoolMaxBytes).To(Equal(int64(256 * 1024 * 1024)))
+		g.Expect(cfg.SpoolMaxAge).To(Equal(24 * time.Hour))
+		g.Expect(cfg.SpoolSegmentBytes).To(Equal(int64(8 * 1024 * 1024)))
+	})
+
+	t.Run("Defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("ASYNC_FORWARDING", "true")
+		os.Setenv("SPOOL_DIR", "/var/spool/zipkates")
+		os.Setenv("SPOOL_MAX_BYTES", "1000")
+		os.Setenv("SPOOL_MAX_AGE", "1h")
+		os.Setenv("SPOOL_SEGMENT_BYTES", "100")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.SpoolDir).To(Equal("/var/spool/zipkates"))
+		g.Expect(cfg.SpoolMaxBytes).To(Equal(int64(1000)))
+		g.Expect(cfg.SpoolMaxAge).To(Equal(time.Hour))
+		g.Expect(cfg.SpoolSegmentBytes).To(Equal(int64(100)))
+		os.Unsetenv("ASYNC_FORWARDING")
+	})
+
+	t.Run("Without asynchronous forwarding", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("SPOOL_DIR", "/var/spool/zipkates")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Unsetenv("SPOOL_DIR")
+	})
+
+	for _, env := range []string{"SPOOL_MAX_BYTES", "SPOOL_MAX_AGE", "SPOOL_SEGMENT_BYTES"} {
+		t.Run("Invalid "+env, func(t *testing.T) {
+			g := NewWithT(t)
+
+			os.Setenv(env, "lots")
+			_, err := ParseConfigFromEnv()
+
+			g.Expect(err).To(HaveOccurred())
+			os.Unsetenv(env)
+		})
+	}
+
+	os.Unsetenv("SPOOL_DIR")
+	os.Unsetenv("SPOOL_MAX_BYTES")
+	os.Unsetenv("SPOOL_MAX_AGE")
+	os.Unsetenv("SPOOL_SEGMENT_BYTES")
+}
+
+func TestCircuitBreakerConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.CircuitBreakerFailures).To(Equal(5))
+		g.Expect(cfg.CircuitBreakerOpenDuration).To(Equal(10 * time.Second))
+		g.Expect(cfg.CircuitBreakerProbes).To(Equal(1))
+	})
+
+	t.Run("Defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("CIRCUIT_BREAKER_FAILURES", "0")
+		os.Setenv("CIRCUIT_BREAKER_OPEN_DURATION", "1m")
+		os.Setenv("CIRCUIT_BREAKER_PROBES", "3")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.CircuitBreakerFailures).To(Equal(0))
+		g.Expect(cfg.CircuitBreakerOpenDuration).To(Equal(time.Minute))
+		g.Expect(cfg.CircuitBreakerProbes).To(Equal(3))
+	})
+
+	for _, invalid := range []struct{ env, value string }{
+		{"CIRCUIT_BREAKER_FAILURES", "many"},
+		{"CIRCUIT_BREAKER_OPEN_DURATION", "10"},
+		{"CIRCUIT_BREAKER_PROBES", "0"},
+	} {
+		t.Run("Invalid "+invalid.env, func(t *testing.T) {
+			g := NewWithT(t)
+
+			os.Setenv(invalid.env, invalid.value)
+			_, err := ParseConfigFromEnv()
+
+			g.Expect(err).To(HaveOccurred())
+			os.Unsetenv(invalid.env)
+		})
+	}
+
+	os.Unsetenv("CIRCUIT_BREAKER_FAILURES")
+	os.Unsetenv("CIRCUIT_BREAKER_OPEN_DURATION")
+	os.Unsetenv("CIRCUIT_BREAKER_PROBES")
+}
+
+func TestRequestLimitConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.MaxBodySize).To(Equal(int64(32 * 1024 * 1024)))
+		g.Expect(cfg.PassThroughBodySize).To(Equal(int64(0)))
+		g.Expect(cfg.MaxConcurrentRequests).To(Equal(64))
+	})
+
+	t.Run("Defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("MAX_BODY_SIZE", "1000")
+		os.Setenv("PASS_THROUGH_BODY_SIZE", "100")
+		os.Setenv("MAX_CONCURRENT_REQUESTS", "8")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.MaxBodySize).To(Equal(int64(1000)))
+		g.Expect(cfg.PassThroughBodySize).To(Equal(int64(100)))
+		g.Expect(cfg.MaxConcurrentRequests).To(Equal(8))
+	})
+
+	for _, env := range []string{"MAX_BODY_SIZE", "PASS_THROUGH_BODY_SIZE", "MAX_CONCURRENT_REQUESTS"} {
+		t.Run("Invalid "+env, func(t *testing.T) {
+			g := NewWithT(t)
+
+			os.Setenv(env, "lots")
+			_, err := ParseConfigFromEnv()
+
+			g.Expect(err).To(HaveOccurred())
+			os.Unsetenv(env)
+		})
+	}
+
+	os.Unsetenv("MAX_BODY_SIZE")
+	os.Unsetenv("PASS_THROUGH_BODY_SIZE")
+	os.Unsetenv("MAX_CONCURRENT_REQUESTS")
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.TLSCertFile).To(Equal(""))
+		g.Expect(cfg.TLSKeyFile).To(Equal(""))
+		g.Expect(cfg.TLSClientCAFile).To(Equal(""))
+		g.Expect(cfg.TLSClientAuth).To(Equal("require"))
+		g.Expect(cfg.TLSTrustDomain).To(Equal("cluster.local"))
+	})
+
+	t.Run("Defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("TLS_CERT_FILE", "/etc/tls/tls.crt")
+		os.Setenv("TLS_KEY_FILE", "/etc/tls/tls.key")
+		os.Setenv("TLS_CLIENT_CA_FILE", "/etc/tls/ca.crt")
+		os.Setenv("TLS_CLIENT_AUTH", "verify-if-given")
+		os.Setenv("TLS_TRUST_DOMAIN", "prod.example.com")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.TLSCertFile).To(Equal("/etc/tls/tls.crt"))
+		g.Expect(cfg.TLSKeyFile).To(Equal("/etc/tls/tls.key"))
+		g.Expect(cfg.TLSClientCAFile).To(Equal("/etc/tls/ca.crt"))
+		g.Expect(cfg.TLSClientAuth).To(Equal("verify-if-given"))
+		g.Expect(cfg.TLSTrustDomain).To(Equal("prod.example.com"))
+	})
+
+	t.Run("Invalid TLS_TRUST_DOMAIN", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("TLS_TRUST_DOMAIN", "spiffe://prod.example.com")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Setenv("TLS_TRUST_DOMAIN", "prod.example.com")
+	})
+
+	t.Run("Invalid TLS_CLIENT_AUTH", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("TLS_CLIENT_AUTH", "sometimes")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Setenv("TLS_CLIENT_AUTH", "require")
+	})
+
+	t.Run("Certificate without key", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("TLS_KEY_FILE")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("Client CA without certificate", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("TLS_CERT_FILE")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	os.Unsetenv("TLS_CERT_FILE")
+	os.Unsetenv("TLS_KEY_FILE")
+	os.Unsetenv("TLS_CLIENT_CA_FILE")
+	os.Unsetenv("TLS_CLIENT_AUTH")
+	os.Unsetenv("TLS_TRUST_DOMAIN")
+}
+
+func TestShutdownConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ShutdownGracePeriod).To(Equal(25 * time.Second))
+		g.Expect(cfg.ShutdownDelay).To(Equal(5 * time.Second))
+	})
+
+	t.Run("Defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("SHUTDOWN_GRACE_PERIOD", "1m")
+		os.Setenv("SHUTDOWN_DELAY", "0s")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ShutdownGracePeriod).To(Equal(time.Minute))
+		g.Expect(cfg.ShutdownDelay).To(Equal(time.Duration(0)))
+	})
+
+	t.Run("Delay not shorter than the grace period", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("SHUTDOWN_DELAY", "1m")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	for _, env := range []string{"SHUTDOWN_GRACE_PERIOD", "SHUTDOWN_DELAY"} {
+		t.Run("Invalid "+env, func(t *testing.T) {
+			g := NewWithT(t)
+
+			os.Setenv(env, "soon")
+			_, err := ParseConfigFromEnv()
+
+			g.Expect(err).To(HaveOccurred())
+			os.Unsetenv(env)
+		})
+	}
+
+	os.Unsetenv("SHUTDOWN_GRACE_PERIOD")
+	os.Unsetenv("SHUTDOWN_DELAY")
+}
+
+func TestReadinessConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ReadinessCheckZipkin).To(BeFalse())
+		g.Expect(cfg.PodCacheMaxStaleness).To(Equal(time.Duration(0)))
+	})
+
+	t.Run("Defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("READINESS_CHECK_ZIPKIN", "true")
+		os.Setenv("POD_CACHE_MAX_STALENESS", "30m")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ReadinessCheckZipkin).To(BeTrue())
+		g.Expect(cfg.PodCacheMaxStaleness).To(Equal(30 * time.Minute))
+	})
+
+	t.Run("Zipkin check with OTLP", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("UPSTREAM_PROTOCOL", "otlp")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Unsetenv("UPSTREAM_PROTOCOL")
+	})
+
+	for _, env := range []string{"READINESS_CHECK_ZIPKIN", "POD_CACHE_MAX_STALENESS"} {
+		t.Run("Invalid "+env, func(t *testing.T) {
+			g := NewWithT(t)
+
+			os.Setenv(env, "maybe")
+			_, err := ParseConfigFromEnv()
+
+			g.Expect(err).To(HaveOccurred())
+			os.Unsetenv(env)
+		})
+	}
+
+	os.Unsetenv("READINESS_CHECK_ZIPKIN")
+	os.Unsetenv("POD_CACHE_MAX_STALENESS")
+}
+
+func TestPodWatchConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.WatchNamespaces).To(BeEmpty())
+		g.Expect(cfg.ExcludeNamespaces).To(BeEmpty())
+		g.Expect(cfg.PodLabelSelector).To(Equal(""))
+		g.Expect(cfg.PodFieldSelector).To(Equal(""))
+	})
+
+	t.Run("Defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("WATCH_NAMESPACES", `["default", "prod"]`)
+		os.Setenv("EXCLUDE_NAMESPACES", `["kube-system"]`)
+		os.Setenv("POD_LABEL_SELECTOR", "owner,tier!=cache")
+		os.Setenv("POD_FIELD_SELECTOR", "status.phase=Running")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.WatchNamespaces).To(Equal([]string{"default", "prod"}))
+		g.Expect(cfg.ExcludeNamespaces).To(Equal([]string{"kube-system"}))
+		g.Expect(cfg.PodLabelSelector).To(Equal("owner,tier!=cache"))
+		g.Expect(cfg.PodFieldSelector).To(Equal("status.phase=Running"))
+	})
+
+	t.Run("All namespaces excluded", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("EXCLUDE_NAMESPACES", `["default", "prod"]`)
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	for _, invalid := range []struct{ env, value string }{
+		{"WATCH_NAMESPACES", "default"},
+		{"EXCLUDE_NAMESPACES", `{"kube-system": true}`},
+		{"POD_LABEL_SELECTOR", "owner in team"},
+		{"POD_FIELD_SELECTOR", "status.phase"},
+	} {
+		t.Run("Invalid "+invalid.env, func(t *testing.T) {
+			g := NewWithT(t)
+
+			os.Unsetenv("EXCLUDE_NAMESPACES")
+			os.Setenv(invalid.env, invalid.value)
+			_, err := ParseConfigFromEnv()
+
+			g.Expect(err).To(HaveOccurred())
+			os.Unsetenv(invalid.env)
+		})
+	}
+
+	os.Unsetenv("WATCH_NAMESPACES")
+	os.Unsetenv("EXCLUDE_NAMESPACES")
+	os.Unsetenv("POD_LABEL_SELECTOR")
+	os.Unsetenv("POD_FIELD_SELECTOR")
+}
+
+func TestAgentModeConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.AgentMode).To(BeFalse())
+		g.Expect(cfg.NodeName).To(Equal(""))
+	})
+
+	t.Run("Defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("AGENT_MODE", "true")
+		os.Setenv("NODE_NAME", "node-1")
+		os.Setenv("ZIPKIN_URL", "http://zipkin.tracing:9411")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.AgentMode).To(BeTrue())
+		g.Expect(cfg.NodeName).To(Equal("node-1"))
+		g.Expect(cfg.ZipkinURL.String()).To(Equal("http://zipkin.tracing:9411"))
+	})
+
+	t.Run("Without ZIPKIN_URL", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("ZIPKIN_URL")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("With OTLP", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("UPSTREAM_PROTOCOL", "otlp")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		os.Unsetenv("UPSTREAM_PROTOCOL")
+	})
+
+	t.Run("Without NODE_NAME", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("ZIPKIN_URL", "http://zipkin.tracing:9411")
+		os.Unsetenv("NODE_NAME")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("Invalid AGENT_MODE", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("AGENT_MODE", "daemonset")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	os.Unsetenv("AGENT_MODE")
+	os.Unsetenv("NODE_NAME")
+	os.Unsetenv("ZIPKIN_URL")
+}
+
+func TestKubeconfigConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("KUBECONFIG")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.Kubeconfig).To(Equal(""))
+		g.Expect(cfg.KubeContext).To(Equal(""))
+	})
+
+	t.Run("Defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("KUBECONFIG", "/home/dev/.kube/config")
+		os.Setenv("KUBE_CONTEXT", "dev")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.Kubeconfig).To(Equal("/home/dev/.kube/config"))
+		g.Expect(cfg.KubeContext).To(Equal("dev"))
+	})
+
+	os.Unsetenv("KUBECONFIG")
+	os.Unsetenv("KUBE_CONTEXT")
+}
+
+func TestMetadataProviderConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.MetadataProvider).To(Equal("kubernetes"))
+		g.Expect(cfg.MetadataFile).To(Equal(""))
+	})
+
+	t.Run("File", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("METADATA_PROVIDER", "file")
+		os.Setenv("METADATA_FILE", "/etc/zipkates/metadata.yaml")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.MetadataProvider).To(Equal("file"))
+		g.Expect(cfg.MetadataFile).To(Equal("/etc/zipkates/metadata.yaml"))
+	})
+
+	t.Run("File without METADATA_FILE", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("METADATA_FILE")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("METADATA_FILE with Kubernetes", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("METADATA_PROVIDER")
+		os.Setenv("METADATA_FILE", "/etc/zipkates/metadata.yaml")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Unsetenv("METADATA_FILE")
+	})
+
+	t.Run("Invalid METADATA_PROVIDER", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("METADATA_PROVIDER", "consul")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	os.Unsetenv("METADATA_PROVIDER")
+	os.Unsetenv("METADATA_FILE")
+}
+
+func TestClusterConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ClusterName).To(Equal(""))
+		g.Expect(cfg.Clusters).To(BeEmpty())
+		g.Expect(cfg.ClusterHeader).To(Equal(""))
+	})
+
+	t.Run("CLUSTER_NAME", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("CLUSTER_NAME", "prod-eu")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.ClusterName).To(Equal("prod-eu"))
+	})
+
+	t.Run("CLUSTERS with CLUSTER_NAME", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("CLUSTERS", `[{"name": "prod-eu"}]`)
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Unsetenv("CLUSTER_NAME")
+	})
+
+	t.Run("CLUSTERS and CLUSTER_HEADER", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("CLUSTERS", `[{"name": "prod-eu", "kubeconfig": "/etc/zipkates/prod-eu"}, {"name": "prod-us", "cidrs": ["10.4.0.0/14"]}]`)
+		os.Setenv("CLUSTER_HEADER", "X-Cluster")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.Clusters).To(HaveLen(2))
+		g.Expect(cfg.Clusters[0].Name).To(Equal("prod-eu"))
+		g.Expect(cfg.Clusters[0].Kubeconfig).To(Equal("/etc/zipkates/prod-eu"))
+		g.Expect(cfg.Clusters[1].CIDRs[0].String()).To(Equal("10.4.0.0/14"))
+		g.Expect(cfg.ClusterHeader).To(Equal("X-Cluster"))
+	})
+
+	t.Run("Invalid CLUSTERS", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("CLUSTERS", `[{"name": "prod-eu", "cidrs": ["not a cidr"]}]`)
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("CLUSTERS with the file provider", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("CLUSTERS", `[{"name": "prod-eu"}]`)
+		os.Setenv("METADATA_PROVIDER", "file")
+		os.Setenv("METADATA_FILE", "/etc/zipkates/metadata.yaml")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Unsetenv("METADATA_PROVIDER")
+		os.Unsetenv("METADATA_FILE")
+	})
+
+	t.Run("CLUSTER_HEADER without CLUSTERS", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("CLUSTERS")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	os.Unsetenv("CLUSTER_NAME")
+	os.Unsetenv("CLUSTERS")
+	os.Unsetenv("CLUSTER_HEADER")
+}
+
+func TestMetadataServerConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.MetadataServerPort).To(Equal(0))
+		g.Expect(cfg.MetadataServerURL).To(Equal(""))
+	})
+
+	t.Run("METADATA_SERVER_PORT", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("METADATA_SERVER_PORT", "9412")
+		os.Setenv("METADATA_SERVER_TOKEN", "s3cr3t")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.MetadataServerPort).To(Equal(9412))
+		g.Expect(cfg.MetadataServerToken).To(Equal("s3cr3t"))
+	})
+
+	t.Run("METADATA_SERVER_PORT without METADATA_SERVER_TOKEN", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("METADATA_SERVER_TOKEN")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("METADATA_SERVER_CA_FILE without the server provider", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("METADATA_SERVER_TOKEN", "s3cr3t")
+		os.Setenv("METADATA_SERVER_CA_FILE", "/etc/zipkates/ca.crt")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Unsetenv("METADATA_SERVER_CA_FILE")
+	})
+
+	t.Run("Invalid METADATA_SERVER_PORT", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("METADATA_SERVER_PORT", "http")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Unsetenv("METADATA_SERVER_PORT")
+	})
+
+	t.Run("Server", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("METADATA_PROVIDER", "server")
+		os.Setenv("METADATA_SERVER_URL", "https://zipkates-metadata:9412/")
+		os.Setenv("METADATA_SERVER_CA_FILE", "/etc/zipkates/ca.crt")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.MetadataProvider).To(Equal("server"))
+		g.Expect(cfg.MetadataServerURL).To(Equal("https://zipkates-metadata:9412"))
+		g.Expect(cfg.MetadataServerCAFile).To(Equal("/etc/zipkates/ca.crt"))
+		os.Unsetenv("METADATA_SERVER_CA_FILE")
+	})
+
+	t.Run("Server without METADATA_SERVER_TOKEN", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("METADATA_SERVER_TOKEN")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Setenv("METADATA_SERVER_TOKEN", "s3cr3t")
+	})
+
+	t.Run("Server with METADATA_SERVER_PORT", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("METADATA_SERVER_PORT", "9412")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Unsetenv("METADATA_SERVER_PORT")
+	})
+
+	t.Run("Server with AGENT_MODE", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("AGENT_MODE", "true")
+		os.Setenv("NODE_NAME", "node-1")
+		os.Setenv("ZIPKIN_URL", "http://zipkin:9411")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+		os.Unsetenv("AGENT_MODE")
+		os.Unsetenv("NODE_NAME")
+		os.Unsetenv("ZIPKIN_URL")
+	})
+
+	t.Run("Invalid METADATA_SERVER_URL", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("METADATA_SERVER_URL", "zipkates-metadata:9412")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("Server without METADATA_SERVER_URL", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("METADATA_SERVER_URL")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("METADATA_SERVER_URL with Kubernetes", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Unsetenv("METADATA_PROVIDER")
+		os.Setenv("METADATA_SERVER_URL", "http://zipkates-metadata:9412")
+		_, err := ParseConfigFromEnv()
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	os.Unsetenv("METADATA_PROVIDER")
+	os.Unsetenv("METADATA_SERVER_URL")
+	os.Unsetenv("METADATA_SERVER_PORT")
+	os.Unsetenv("METADATA_SERVER_TOKEN")
+}
+
+func TestAdminTokenConfig(t *testing.T) {
+	t.Run("Not defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.AdminToken).To(Equal(""))
+	})
+
+	t.Run("Defined", func(t *testing.T) {
+		g := NewWithT(t)
+
+		os.Setenv("ADMIN_TOKEN", "s3cr3t")
+		cfg, err := ParseConfigFromEnv()
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(cfg.AdminToken).To(Equal("s3cr3t"))
+	})
+
+	os.Unsetenv("ADMIN_TOKEN")
+}
@@ -25,7 +25,7 @@ func TestProxyTargetURL(t *testing.T) {
 
 	path := "/api/v2/trace/5af7183fb1d4cf5f"
 	req := httptest.NewRequest("GET", path, nil)
-	CreateDirector(CreateIndexer(), DefaultConfig)(req)
+	CreateDirector(CreateKubernetesProvider(CreateIndexer()), DefaultConfig)(req)
 
 	g.Expect(req.URL.String()).To(Equal("http://127.0.0.1:9410" + path))
 }
@@ -36,8 +36,8 @@ func TestDifferentZipkinPort(t *testing.T) {
 	path := "/api/v2/trace/5af7183fb1d4cf5f"
 	req := httptest.NewRequest("GET", path, nil)
 	cfg := DefaultConfig
-	cfg.ZipkinPort = 8080
-	CreateDirector(CreateIndexer(), cfg)(req)
+	cfg.ZipkinURL = zipkinPortURL(8080)
+	CreateDirector(CreateKubernetesProvider(CreateIndexer()), cfg)(req)
 
 	g.Expect(req.URL.String()).To(Equal("http://127.0.0.1:8080" + path))
 }
@@ -56,7 +56,7 @@ func TestOwnerTagAddition(t *testing.T) {
 			"http.path":   "/api",
 		}))),
 	)
-	CreateDirector(indexer, DefaultConfig)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -78,7 +78,7 @@ func TestKeepOriginalOwnerTag(t *testing.T) {
 			"owner":       fromSpan,
 		}))),
 	)
-	CreateDirector(indexer, DefaultConfig)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -96,7 +96,7 @@ func TestEmptyTags(t *testing.T) {
 		"POST", "/api/v2/spans",
 		strings.NewReader(fmt.Sprintf("[%s]", span(g, map[string]string{}))),
 	)
-	CreateDirector(indexer, DefaultConfig)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -114,7 +114,7 @@ func TestMissingTags(t *testing.T) {
 		"POST", "/api/v2/spans",
 		strings.NewReader(fmt.Sprintf("[%s]", span(g, nil))),
 	)
-	CreateDirector(indexer, DefaultConfig)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -125,7 +125,7 @@ func TestZeroSpans(t *testing.T) {
 	g := NewWithT(t)
 
 	req := httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader("[]"))
-	CreateDirector(CreateIndexer(), DefaultConfig)(req)
+	CreateDirector(CreateKubernetesProvider(CreateIndexer()), DefaultConfig)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -151,7 +151,7 @@ func TestMultipleSpans(t *testing.T) {
 			"http.path":   "/api",
 		}))),
 	)
-	CreateDirector(indexer, DefaultConfig)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -170,7 +170,7 @@ func TestDifferentPodIP(t *testing.T) {
 		"http.path":   "/api",
 	}))
 	req := httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader(originalBody))
-	CreateDirector(indexer, DefaultConfig)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -188,7 +188,7 @@ func TestPodWithoutOwnerLabel(t *testing.T) {
 		"http.path":   "/api",
 	}))
 	req := httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader(originalBody))
-	CreateDirector(indexer, DefaultConfig)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -206,7 +206,7 @@ func TestSpansNotAnArray(t *testing.T) {
 		"http.path":   "/api",
 	})
 	req := httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader(originalBody))
-	CreateDirector(indexer, DefaultConfig)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -223,8 +223,8 @@ func TestDifferentPath(t *testing.T) {
 		"http.method": "GET",
 		"http.path":   "/api",
 	}))
-	req := httptest.NewRequest("POST", "/api/v1/spans", strings.NewReader(originalBody))
-	CreateDirector(indexer, DefaultConfig)(req)
+	req := httptest.NewRequest("POST", "/api/v2/dependencies", strings.NewReader(originalBody))
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -249,7 +249,7 @@ func TestDifferentTagAddition(t *testing.T) {
 	)
 	cfg := DefaultConfig
 	cfg.LabelTagMapping = map[string]string{labelName: tagName}
-	CreateDirector(indexer, cfg)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), cfg)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -277,7 +277,7 @@ func TestMultipleTagAddition(t *testing.T) {
 		"label_a": "tag_a",
 		"label_b": "tag_b",
 	}
-	CreateDirector(indexer, cfg)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), cfg)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -307,7 +307,7 @@ func TestPartialMultipleTagAddition(t *testing.T) {
 		"label_a": "tag_a",
 		"label_b": "tag_b",
 	}
-	CreateDirector(indexer, cfg)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), cfg)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
@@ -328,13 +328,72 @@ func TestEmptyMapping(t *testing.T) {
 	req := httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader(originalBody))
 	cfg := DefaultConfig
 	cfg.LabelTagMapping = map[string]string{}
-	CreateDirector(indexer, cfg)(req)
+	CreateDirector(CreateKubernetesProvider(indexer), cfg)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(body)).To(Equal(originalBody))
+}
+
+func TestV1BinaryAnnotationAddition(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	req := httptest.NewRequest(
+		"POST", "/api/v1/spans",
+		strings.NewReader(fmt.Sprintf("[%s]", v1Span(g, map[string]string{
+			"http.method": "GET",
+			"http.path":   "/api",
+		}))),
+	)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(gjson.GetBytes(body, `0.binaryAnnotations.#(key=="owner").value`).String()).To(Equal(owner))
+	g.Expect(gjson.GetBytes(body, `0.binaryAnnotations.#(key=="owner").endpoint.serviceName`).String()).
+		To(Equal("backend"))
+	g.Expect(gjson.GetBytes(body, "0.timestamp").Raw).To(Equal("1556604172355737"))
+}
+
+func TestV1KeepOriginalBinaryAnnotation(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	originalBody := fmt.Sprintf("[%s]", v1Span(g, map[string]string{"owner": "from_span"}))
+	req := httptest.NewRequest("POST", "/api/v1/spans", strings.NewReader(originalBody))
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
 
 	body, err := ioutil.ReadAll(req.Body)
 	g.Expect(err).NotTo(HaveOccurred())
 	g.Expect(string(body)).To(Equal(originalBody))
 }
 
+func TestV1MissingBinaryAnnotations(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	req := httptest.NewRequest(
+		"POST", "/api/v1/spans",
+		strings.NewReader(fmt.Sprintf("[%s]", v1Span(g, nil))),
+	)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(gjson.GetBytes(body, "0.binaryAnnotations.#").Int()).To(Equal(int64(1)))
+	g.Expect(gjson.GetBytes(body, "0.binaryAnnotations.0.key").String()).To(Equal("owner"))
+	g.Expect(gjson.GetBytes(body, "0.binaryAnnotations.0.value").String()).To(Equal(owner))
+}
+
 func pod(name, ip string, labels map[string]string) *v1.Pod {
 	return &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
@@ -371,3 +430,37 @@ func span(g *WithT, tags map[string]string) string {
 	g.Expect(err).NotTo(HaveOccurred())
 	return string(result)
 }
+
+func v1Span(g *WithT, binaryAnnotations map[string]string) string {
+	endpoint := map[string]interface{}{
+		"serviceName": "backend",
+		"ipv4":        "192.168.99.1",
+		"port":        3306,
+	}
+	span := map[string]interface{}{
+		"id":        "352bff9a74ca9ad2",
+		"traceId":   "5af7183fb1d4cf5f",
+		"parentId":  "6b221d5bc9e6496c",
+		"name":      "get /api",
+		"timestamp": 1556604172355737,
+		"duration":  1431,
+		"annotations": []map[string]interface{}{
+			{"timestamp": 1556604172355737, "value": "sr", "endpoint": endpoint},
+			{"timestamp": 1556604172357168, "value": "ss", "endpoint": endpoint},
+		},
+	}
+	if binaryAnnotations != nil {
+		annotations := []map[string]interface{}{}
+		for key, value := range binaryAnnotations {
+			annotations = append(annotations, map[string]interface{}{
+				"key":      key,
+				"value":    value,
+				"endpoint": endpoint,
+			})
+		}
+		span["binaryAnnotations"] = annotations
+	}
+	result, err := json.Marshal(span)
+	g.Expect(err).NotTo(HaveOccurred())
+	return string(result)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	encodingIdentity = "identity"
+	encodingGzip     = "gzip"
+	// Note that the deflate Content-Encoding is the zlib format, not raw
+	// deflate. See RFC 7230 section 4.2.2.
+	encodingDeflate = "deflate"
+)
+
+// decodeBody decompresses the request body according to its Content-Encoding.
+// Decompression stops with an error once more than maxSize bytes have been
+// produced, which guards against zip bombs.
+func decodeBody(body []byte, encoding string, maxSize int64) ([]byte, error) {
+	var reader io.ReadCloser
+	var err error
+	switch encoding {
+	case "", encodingIdentity:
+		return body, nil
+	case encodingGzip:
+		reader, err = gzip.NewReader(bytes.NewReader(body))
+	case encodingDeflate:
+		reader, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return nil, fmt.Errorf("Unsupported Content-Encoding %s", encoding)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	decoded, err := ioutil.ReadAll(io.LimitReader(reader, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > maxSize {
+		return nil, fmt.Errorf("Decompressed body is larger than %d bytes", maxSize)
+	}
+	return decoded, nil
+}
+
+// encodeBody compresses the body according to the Content-Encoding.
+func encodeBody(body []byte, encoding string) ([]byte, error) {
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "", encodingIdentity:
+		return body, nil
+	case encodingGzip:
+		writer = gzip.NewWriter(&buf)
+	case encodingDeflate:
+		writer = zlib.NewWriter(&buf)
+	default:
+		return nil, fmt.Errorf("Unsupported Content-Encoding %s", encoding)
+	}
+	if _, err := writer.Write(body); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+)
+
+func TestGzipTagAddition(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	req := httptest.NewRequest(
+		"POST", "/api/v2/spans",
+		bytes.NewReader(gzipBytes(g, fmt.Sprintf("[%s]", span(g, nil)))),
+	)
+	req.Header.Set("Content-Encoding", "gzip")
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(req.Header.Get("Content-Encoding")).To(BeEmpty())
+	g.Expect(gjson.GetBytes(body, "0.tags.owner").String()).To(Equal(owner))
+	g.Expect(req.ContentLength).To(Equal(int64(len(body))))
+}
+
+func TestGzipRecompression(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	req := httptest.NewRequest(
+		"POST", "/api/v2/spans",
+		bytes.NewReader(gzipBytes(g, fmt.Sprintf("[%s]", span(g, nil)))),
+	)
+	req.Header.Set("Content-Encoding", "gzip")
+	cfg := DefaultConfig
+	cfg.RecompressBody = true
+	CreateDirector(CreateKubernetesProvider(indexer), cfg)(req)
+
+	g.Expect(req.Header.Get("Content-Encoding")).To(Equal("gzip"))
+	reader, err := gzip.NewReader(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	body, err := ioutil.ReadAll(reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(gjson.GetBytes(body, "0.tags.owner").String()).To(Equal(owner))
+}
+
+func TestDeflateRecompression(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	var compressed bytes.Buffer
+	writer := zlib.NewWriter(&compressed)
+	_, err := writer.Write([]byte(fmt.Sprintf("[%s]", span(g, nil))))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(writer.Close()).To(Succeed())
+
+	req := httptest.NewRequest("POST", "/api/v2/spans", &compressed)
+	req.Header.Set("Content-Encoding", "deflate")
+	cfg := DefaultConfig
+	cfg.RecompressBody = true
+	CreateDirector(CreateKubernetesProvider(indexer), cfg)(req)
+
+	g.Expect(req.Header.Get("Content-Encoding")).To(Equal("deflate"))
+	reader, err := zlib.NewReader(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	body, err := ioutil.ReadAll(reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(gjson.GetBytes(body, "0.tags.owner").String()).To(Equal(owner))
+}
+
+func TestDecompressedBodyTooLarge(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	originalBody := gzipBytes(g, fmt.Sprintf("[%s]", span(g, nil)))
+	req := httptest.NewRequest("POST", "/api/v2/spans", bytes.NewReader(originalBody))
+	req.Header.Set("Content-Encoding", "gzip")
+	cfg := DefaultConfig
+	cfg.MaxDecompressedBodySize = 16
+	CreateDirector(CreateKubernetesProvider(indexer), cfg)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(req.Header.Get("Content-Encoding")).To(Equal("gzip"))
+	g.Expect(body).To(Equal(originalBody))
+}
+
+func TestUnsupportedContentEncoding(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	originalBody := []byte("compressed")
+	req := httptest.NewRequest("POST", "/api/v2/spans", bytes.NewReader(originalBody))
+	req.Header.Set("Content-Encoding", "br")
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(body).To(Equal(originalBody))
+}
+
+func gzipBytes(g *WithT, data string) []byte {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, err := writer.Write([]byte(data))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(writer.Close()).To(Succeed())
+	return compressed.Bytes()
+}
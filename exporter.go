@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// Upstream protocols that spans can be exported with.
+const (
+	upstreamProtocolZipkin = "zipkin"
+	upstreamProtocolOTLP   = "otlp"
+)
+
+// spanExporter sends spans that were converted from other formats upstream.
+// tagValues are resolved from the labels of the pod that sent the spans and
+// it's up to the exporter how they are attached to the spans.
+type spanExporter interface {
+	ExportSpans(spans []zipkinSpan, tagValues map[string]string) error
+}
+
+// zipkinExporter adds the tag values as span tags and sends the spans to
+// Zipkin's /api/v2/spans endpoint.
+type zipkinExporter struct {
+	client *http.Client
+	cfg    Config
+}
+
+func CreateZipkinExporter(client *http.Client, cfg Config) spanExporter {
+	return &zipkinExporter{client: client, cfg: cfg}
+}
+
+func (e *zipkinExporter) ExportSpans(spans []zipkinSpan, tagValues map[string]string) error {
+	body, err := encodeZipkinJSON(spans, tagValues)
+	if err != nil {
+		return err
+	}
+	url := zipkinTarget(e.cfg, "/api/v2/spans").String()
+	return postSpans(e.client, url, contentTypeJSON, body)
+}
+
+// queuedZipkinExporter adds the tag values as span tags and adds the spans to
+// the queue, which sends them to Zipkin's /api/v2/spans endpoint.
+type queuedZipkinExporter struct {
+	queue *spanQueue
+}
+
+func CreateQueuedZipkinExporter(queue *spanQueue) spanExporter {
+	return &queuedZipkinExporter{queue: queue}
+}
+
+func (e *queuedZipkinExporter) ExportSpans(spans []zipkinSpan, tagValues map[string]string) error {
+	body, err := encodeZipkinJSON(spans, tagValues)
+	if err != nil {
+		return err
+	}
+	return e.queue.Enqueue("/api/v2/spans", contentTypeJSON, body)
+}
+
+// encodeZipkinJSON encodes the spans as Zipkin v2 JSON with the tag values
+// added as span tags.
+func encodeZipkinJSON(spans []zipkinSpan, tagValues map[string]string) ([]byte, error) {
+	body, err := json.Marshal(spans)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal spans: %w", err)
+	}
+	if len(tagValues) > 0 {
+		if body, _, err = addTagsV2JSON(body, tagValues); err != nil {
+			return nil, err
+		}
+	}
+	return body, nil
+}
+
+// otlpForwarder is implemented by exporters that send spans upstream as OTLP.
+// OTLP requests are forwarded to them as they arrive instead of being
+// converted to Zipkin spans and back, which would drop everything Zipkin spans
+// can't hold, like links, scopes and non-string attributes.
+type otlpForwarder interface {
+	ForwardOTLP(body []byte, contentType string, tagValues map[string]string) error
+}
+
+// otlpExporter sends spans to an OTLP/HTTP traces endpoint. Spans from other
+// formats are converted to OTLP first. The tag values are added as resource
+// attributes, as they describe the pod that produced the spans rather than
+// individual spans.
+type otlpExporter struct {
+	client   *http.Client
+	endpoint string
+}
+
+func CreateOTLPExporter(client *http.Client, endpoint string) spanExporter {
+	return &otlpExporter{client: client, endpoint: endpoint}
+}
+
+func (e *otlpExporter) ExportSpans(spans []zipkinSpan, tagValues map[string]string) error {
+	body := encodeOTLPProto(zipkinToOTLP(spans, tagValues))
+	return postSpans(e.client, e.endpoint, contentTypeProtobuf, body)
+}
+
+// ForwardOTLP sends the OTLP request with the same encoding it was received
+// with. Only the tag values are added to it.
+func (e *otlpExporter) ForwardOTLP(body []byte, contentType string, tagValues map[string]string) error {
+	if len(tagValues) > 0 {
+		var err error
+		if contentType == contentTypeJSON {
+			body, err = addOTLPResourceAttributesJSON(body, tagValues)
+		} else {
+			body, err = addOTLPResourceAttributesProto(body, tagValues)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return postSpans(e.client, e.endpoint, contentType, body)
+}
+
+// upstreamStatusError is returned when the upstream responds with a non-2xx
+// status.
+type upstreamStatusError struct {
+	url        string
+	status     string
+	statusCode int
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("%s responded with %s", e.url, e.status)
+}
+
+// postSpans sends encoded spans upstream and fails on non-2xx responses.
+func postSpans(client *http.Client, url, contentType string, body []byte) error {
+	resp, err := client.Post(url, contentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body to allow reusing the connection
+	_, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return &upstreamStatusError{url: url, status: resp.Status, statusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+var zipkinKindToOTLP = map[string]otlpSpanKind{
+	zipkinKindServer:   otlpSpanKindServer,
+	zipkinKindClient:   otlpSpanKindClient,
+	zipkinKindProducer: otlpSpanKindProducer,
+	zipkinKindConsumer: otlpSpanKindConsumer,
+}
+
+// zipkinToOTLP converts Zipkin v2 spans to OTLP. Spans are grouped into
+// resources by their local service name and the tag values are added to every
+// resource. It's the reverse of otlpToZipkin.
+func zipkinToOTLP(spans []zipkinSpan, tagValues map[string]string) otlpExportTraceServiceRequest {
+	spansByService := map[string][]otlpSpan{}
+	for _, span := range spans {
+		otlpSpan, err := zipkinSpanToOTLP(span)
+		if err != nil {
+			klog.Warningf("Skipping span that can't be converted to OTLP: %s", err)
+			continue
+		}
+		serviceName := ""
+		if span.LocalEndpoint != nil {
+			serviceName = span.LocalEndpoint.ServiceName
+		}
+		spansByService[serviceName] = append(spansByService[serviceName], otlpSpan)
+	}
+
+	serviceNames := make([]string, 0, len(spansByService))
+	for serviceName := range spansByService {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	sort.Strings(serviceNames)
+
+	request := otlpExportTraceServiceRequest{}
+	for _, serviceName := range serviceNames {
+		attributes := []otlpKeyValue{}
+		if serviceName != "" {
+			attributes = append(attributes, otlpStringAttribute(otlpServiceName, serviceName))
+		}
+		for _, tagName := range sortedKeys(tagValues) {
+			attributes = append(attributes, otlpStringAttribute(tagName, tagValues[tagName]))
+		}
+		request.ResourceSpans = append(request.ResourceSpans, otlpResourceSpans{
+			Resource:   otlpResource{Attributes: attributes},
+			ScopeSpans: []otlpScopeSpans{{Spans: spansByService[serviceName]}},
+		})
+	}
+	return request
+}
+
+func zipkinSpanToOTLP(span zipkinSpan) (otlpSpan, error) {
+	traceID, err := decodeZipkinID(span.TraceID, 16)
+	if err != nil {
+		return otlpSpan{}, fmt.Errorf("Invalid trace ID: %w", err)
+	}
+	spanID, err := decodeZipkinID(span.ID, 8)
+	if err != nil {
+		return otlpSpan{}, fmt.Errorf("Invalid span ID: %w", err)
+	}
+	result := otlpSpan{
+		TraceID:           traceID,
+		SpanID:            spanID,
+		Name:              span.Name,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: otlpUint64(span.Timestamp * 1000),
+		EndTimeUnixNano:   otlpUint64((span.Timestamp + span.Duration) * 1000),
+	}
+	if kind, ok := zipkinKindToOTLP[span.Kind]; ok {
+		result.Kind = kind
+	}
+	if span.ParentID != "" {
+		if result.ParentSpanID, err = decodeZipkinID(span.ParentID, 8); err != nil {
+			return otlpSpan{}, fmt.Errorf("Invalid parent ID: %w", err)
+		}
+	}
+
+	for _, key := range sortedKeys(span.Tags) {
+		value := span.Tags[key]
+		switch key {
+		case zipkinErrorTag:
+			result.Status = otlpStatus{Code: otlpStatusCodeError, Message: value}
+			continue
+		case otlpStatusTag:
+			if value == "OK" && result.Status.Code == otlpStatusCodeUnset {
+				result.Status.Code = otlpStatusCodeOk
+			}
+			continue
+		}
+		result.Attributes = append(result.Attributes, otlpStringAttribute(key, value))
+	}
+	if endpoint := span.RemoteEndpoint; endpoint != nil {
+		if endpoint.ServiceName != "" {
+			result.Attributes = append(result.Attributes, otlpStringAttribute(otlpPeerService, endpoint.ServiceName))
+		}
+		if endpoint.IPv4 != "" {
+			result.Attributes = append(result.Attributes, otlpStringAttribute(otlpNetPeerIP, endpoint.IPv4))
+		} else if endpoint.IPv6 != "" {
+			result.Attributes = append(result.Attributes, otlpStringAttribute(otlpNetPeerIP, endpoint.IPv6))
+		}
+		if endpoint.Port != 0 {
+			result.Attributes = append(result.Attributes, otlpStringAttribute(otlpNetPeerPort, strconv.Itoa(endpoint.Port)))
+		}
+	}
+	for _, annotation := range span.Annotations {
+		result.Events = append(result.Events, otlpEvent{
+			TimeUnixNano: otlpUint64(annotation.Timestamp * 1000),
+			Name:         annotation.Value,
+		})
+	}
+	return result, nil
+}
+
+// decodeZipkinID decodes a hex encoded Zipkin ID and left pads it with zeros
+// to the given length. 64-bit trace IDs are padded to 128 bits this way.
+func decodeZipkinID(id string, length int) ([]byte, error) {
+	decoded, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) == 0 || len(decoded) > length {
+		return nil, fmt.Errorf("Expected at most %d bytes, got %d", length, len(decoded))
+	}
+	return append(make([]byte, length-len(decoded)), decoded...), nil
+}
+
+func otlpStringAttribute(key, value string) otlpKeyValue {
+	return otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// addOTLPResourceAttributesProto adds the tag values as string attributes to
+// the resource of every ResourceSpans in the encoded ExportTraceServiceRequest.
+// Attributes that are already set on a resource are kept as is. Like in
+// addTagsV2Proto, the request is not fully decoded. Protobuf parsers merge
+// repeated occurrences of a message field, so the missing attributes are
+// appended to each ResourceSpans as another Resource, which keeps all other
+// fields byte for byte as they were.
+func addOTLPResourceAttributesProto(body []byte, tagValues map[string]string) ([]byte, error) {
+	newBody := make([]byte, 0, len(body))
+	err := forEachProtoField(body, func(field protoField) error {
+		if field.number != otlpRequestResourceSpans || field.wireType != protoBytes {
+			newBody = append(newBody, field.raw...)
+			return nil
+		}
+		keys := map[string]bool{}
+		err := forEachProtoField(field.value, func(resourceSpansField protoField) error {
+			if resourceSpansField.number != otlpResourceSpansResource || resourceSpansField.wireType != protoBytes {
+				return nil
+			}
+			return forEachProtoField(resourceSpansField.value, func(resourceField protoField) error {
+				if resourceField.number != otlpResourceAttributes || resourceField.wireType != protoBytes {
+					return nil
+				}
+				return forEachProtoField(resourceField.value, func(keyValueField protoField) error {
+					if keyValueField.number == otlpKeyValueKey && keyValueField.wireType == protoBytes {
+						keys[string(keyValueField.value)] = true
+					}
+					return nil
+				})
+			})
+		})
+		if err != nil {
+			return err
+		}
+		var resource []byte
+		for _, tagName := range sortedKeys(tagValues) {
+			if keys[tagName] {
+				if klog.V(1) {
+					klog.Infof("Attribute %s is already set for the resource, skipping", tagName)
+				}
+				continue
+			}
+			resource = appendProtoBytes(resource, otlpResourceAttributes, encodeOTLPKeyValue(otlpStringAttribute(tagName, tagValues[tagName])))
+		}
+		if resource == nil {
+			newBody = append(newBody, field.raw...)
+			return nil
+		}
+		resourceSpans := append(append([]byte{}, field.value...), appendProtoBytes(nil, otlpResourceSpansResource, resource)...)
+		newBody = appendProtoBytes(newBody, otlpRequestResourceSpans, resourceSpans)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse OTLP protobuf: %w", err)
+	}
+	return newBody, nil
+}
+
+// addOTLPResourceAttributesJSON adds the tag values as string attributes to
+// the resource of every ResourceSpans in the OTLP/HTTP JSON request.
+// Attributes that are already set on a resource are kept as is. Numbers are
+// kept as they were sent, but the order of keys isn't.
+func addOTLPResourceAttributesJSON(body []byte, tagValues map[string]string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var request map[string]interface{}
+	if err := decoder.Decode(&request); err != nil {
+		return nil, fmt.Errorf("Failed to parse OTLP JSON: %w", err)
+	}
+	resourceSpansList, _ := request["resourceSpans"].([]interface{})
+	for _, value := range resourceSpansList {
+		resourceSpans, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		resource, ok := resourceSpans["resource"].(map[string]interface{})
+		if !ok {
+			resource = map[string]interface{}{}
+			resourceSpans["resource"] = resource
+		}
+		attributes, _ := resource["attributes"].([]interface{})
+		keys := map[string]bool{}
+		for _, attribute := range attributes {
+			if keyValue, ok := attribute.(map[string]interface{}); ok {
+				if key, ok := keyValue["key"].(string); ok {
+					keys[key] = true
+				}
+			}
+		}
+		for _, tagName := range sortedKeys(tagValues) {
+			if keys[tagName] {
+				if klog.V(1) {
+					klog.Infof("Attribute %s is already set for the resource, skipping", tagName)
+				}
+				continue
+			}
+			attributes = append(attributes, map[string]interface{}{
+				"key":   tagName,
+				"value": map[string]interface{}{"stringValue": tagValues[tagName]},
+			})
+		}
+		resource["attributes"] = attributes
+	}
+	return json.Marshal(request)
+}
+
+// encodeOTLPProto encodes an ExportTraceServiceRequest. Only string attribute
+// values are supported, as those are the only ones zipkinToOTLP produces.
+func encodeOTLPProto(request otlpExportTraceServiceRequest) []byte {
+	var body []byte
+	for _, resourceSpans := range request.ResourceSpans {
+		var resource []byte
+		for _, attribute := range resourceSpans.Resource.Attributes {
+			resource = appendProtoBytes(resource, otlpResourceAttributes, encodeOTLPKeyValue(attribute))
+		}
+		var resourceSpansMsg []byte
+		resourceSpansMsg = appendProtoBytes(resourceSpansMsg, otlpResourceSpansResource, resource)
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			var scopeSpansMsg []byte
+			for _, span := range scopeSpans.Spans {
+				scopeSpansMsg = appendProtoBytes(scopeSpansMsg, otlpScopeSpansSpans, encodeOTLPSpan(span))
+			}
+			resourceSpansMsg = appendProtoBytes(resourceSpansMsg, otlpResourceSpansScopeSpans, scopeSpansMsg)
+		}
+		body = appendProtoBytes(body, otlpRequestResourceSpans, resourceSpansMsg)
+	}
+	return body
+}
+
+func encodeOTLPSpan(span otlpSpan) []byte {
+	var msg []byte
+	msg = appendProtoBytes(msg, otlpSpanTraceID, span.TraceID)
+	msg = appendProtoBytes(msg, otlpSpanSpanID, span.SpanID)
+	if len(span.ParentSpanID) > 0 {
+		msg = appendProtoBytes(msg, otlpSpanParentSpanID, span.ParentSpanID)
+	}
+	msg = appendProtoBytes(msg, otlpSpanName, []byte(span.Name))
+	msg = appendProtoVarintField(msg, otlpSpanKindField, uint64(span.Kind))
+	msg = appendProtoFixed64(msg, otlpSpanStartTime, uint64(span.StartTimeUnixNano))
+	msg = appendProtoFixed64(msg, otlpSpanEndTime, uint64(span.EndTimeUnixNano))
+	for _, attribute := range span.Attributes {
+		msg = appendProtoBytes(msg, otlpSpanAttributes, encodeOTLPKeyValue(attribute))
+	}
+	for _, event := range span.Events {
+		var eventMsg []byte
+		eventMsg = appendProtoFixed64(eventMsg, otlpEventTime, uint64(event.TimeUnixNano))
+		eventMsg = appendProtoBytes(eventMsg, otlpEventName, []byte(event.Name))
+		msg = appendProtoBytes(msg, otlpSpanEvents, eventMsg)
+	}
+	if span.Status.Code != otlpStatusCodeUnset {
+		var status []byte
+		if span.Status.Message != "" {
+			status = appendProtoBytes(status, otlpStatusMessage, []byte(span.Status.Message))
+		}
+		status = appendProtoVarintField(status, otlpStatusCodeField, uint64(span.Status.Code))
+		msg = appendProtoBytes(msg, otlpSpanStatus, status)
+	}
+	return msg
+}
+
+func encodeOTLPKeyValue(kv otlpKeyValue) []byte {
+	var value []byte
+	value = appendProtoBytes(value, otlpAnyValueString, []byte(kv.Value.String()))
+	var msg []byte
+	msg = appendProtoBytes(msg, otlpKeyValueKey, []byte(kv.Key))
+	return appendProtoBytes(msg, otlpKeyValueValue, value)
+}
+
+// CreateZipkinSpansHandler returns a handler for Zipkin's /api/v2/spans
+// endpoint that decodes the spans and passes them to the exporter. It's used
+// instead of proxying requests to Zipkin when spans are exported with another
+// protocol. Zipkin v1 spans are rejected with 400 Bad Request, as they can't
+// be converted.
+func CreateZipkinSpansHandler(provider metadataProvider, cfg Config, exporter spanExporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" && req.URL.Path == "/api/v1/spans" {
+			klog.Warningf("Rejecting Zipkin v1 spans, which can't be exported with UPSTREAM_PROTOCOL %s", cfg.UpstreamProtocol)
+			http.Error(w, fmt.Sprintf("Zipkin v1 spans can't be exported with UPSTREAM_PROTOCOL %s, send them to /api/v2/spans instead", cfg.UpstreamProtocol), http.StatusBadRequest)
+			return
+		}
+		if req.Method != "POST" || req.URL.Path != "/api/v2/spans" {
+			http.Error(w, "Only POST requests to /api/v2/spans are supported", http.StatusNotFound)
+			return
+		}
+		contentType := contentTypeJSON
+		if header := req.Header.Get("Content-Type"); header != "" {
+			contentType, _, _ = mime.ParseMediaType(header)
+		}
+		if contentType != contentTypeJSON && contentType != contentTypeProtobuf {
+			http.Error(w, "Content-Type has to be application/json or application/x-protobuf", http.StatusUnsupportedMediaType)
+			return
+		}
+		release, ok := acquireRequestSlot(req)
+		if !ok {
+			return
+		}
+		defer release()
+		bodyBytes, ok := readRequestBody(w, req, cfg)
+		if !ok {
+			return
+		}
+		contentEncoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+		bodyBytes, err := decodeBody(bodyBytes, contentEncoding, cfg.MaxDecompressedBodySize)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decompress request body: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		var spans []zipkinSpan
+		if contentType == contentTypeJSON {
+			err = json.Unmarshal(bodyBytes, &spans)
+		} else {
+			spans, err = decodeZipkinProtoSpans(bodyBytes)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to parse spans: %s", err), http.StatusBadRequest)
+			return
+		}
+		release()
+		if err := exporter.ExportSpans(spans, getRequestTagValues(provider, req, cfg)); err != nil {
+			klog.Errorf("Failed to export spans: %s", err)
+			http.Error(w, "Failed to export spans", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
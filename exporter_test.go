@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+)
+
+func TestOTLPExport(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	backend, received := fakeOTLPBackend(http.StatusOK)
+	defer backend.Close()
+
+	req := httptest.NewRequest(
+		"POST", "/api/v2/spans",
+		strings.NewReader(fmt.Sprintf("[%s]", span(g, map[string]string{
+			"http.method": "GET",
+			"error":       "Internal error",
+		}))),
+	)
+	recorder := httptest.NewRecorder()
+	exporter := CreateOTLPExporter(backend.Client(), backend.URL+"/v1/traces")
+	CreateZipkinSpansHandler(CreateKubernetesProvider(indexer), DefaultConfig, exporter)(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusAccepted))
+	var body []byte
+	g.Expect(received).To(Receive(&body))
+	request, err := decodeOTLPProto(body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(request.ResourceSpans).To(HaveLen(1))
+	g.Expect(otlpAttributes(request.ResourceSpans[0].Resource.Attributes)).To(Equal(map[string]string{
+		"service.name": "backend",
+		"owner":        owner,
+	}))
+	g.Expect(request.ResourceSpans[0].ScopeSpans).To(HaveLen(1))
+	g.Expect(request.ResourceSpans[0].ScopeSpans[0].Spans).To(HaveLen(1))
+	span := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	g.Expect([]byte(span.TraceID)).To(Equal([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0x5a, 0xf7, 0x18, 0x3f, 0xb1, 0xd4, 0xcf, 0x5f}))
+	g.Expect([]byte(span.SpanID)).To(Equal([]byte{0x35, 0x2b, 0xff, 0x9a, 0x74, 0xca, 0x9a, 0xd2}))
+	g.Expect([]byte(span.ParentSpanID)).To(Equal([]byte{0x6b, 0x22, 0x1d, 0x5b, 0xc9, 0xe6, 0x49, 0x6c}))
+	g.Expect(span.Name).To(Equal("get /api"))
+	g.Expect(span.Kind).To(Equal(otlpSpanKindServer))
+	g.Expect(span.StartTimeUnixNano).To(Equal(otlpUint64(1556604172355737000)))
+	g.Expect(span.EndTimeUnixNano).To(Equal(otlpUint64(1556604172357168000)))
+	g.Expect(span.Status).To(Equal(otlpStatus{Code: otlpStatusCodeError, Message: "Internal error"}))
+	g.Expect(otlpAttributes(span.Attributes)).To(Equal(map[string]string{
+		"http.method":   "GET",
+		"net.peer.ip":   "172.19.0.2",
+		"net.peer.port": "58648",
+	}))
+}
+
+func TestOTLPExportProtoSpans(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	backend, received := fakeOTLPBackend(http.StatusOK)
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/api/v2/spans", bytes.NewReader(protoListOfSpans(protoSpan(map[string]string{
+		"http.path": "/api",
+	}))))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	recorder := httptest.NewRecorder()
+	exporter := CreateOTLPExporter(backend.Client(), backend.URL+"/v1/traces")
+	CreateZipkinSpansHandler(CreateKubernetesProvider(indexer), DefaultConfig, exporter)(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusAccepted))
+	var body []byte
+	g.Expect(received).To(Receive(&body))
+	request, err := decodeOTLPProto(body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(otlpAttributes(request.ResourceSpans[0].Resource.Attributes)).To(Equal(map[string]string{
+		"owner": "from_label",
+	}))
+	span := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	g.Expect(span.Name).To(Equal("get /api"))
+	g.Expect(span.Kind).To(Equal(otlpSpanKindInternal))
+	g.Expect(span.StartTimeUnixNano).To(Equal(otlpUint64(1556604172355737000)))
+	g.Expect(otlpAttributes(span.Attributes)).To(Equal(map[string]string{"http.path": "/api"}))
+}
+
+func TestOTLPExportFailure(t *testing.T) {
+	g := NewWithT(t)
+
+	backend, _ := fakeOTLPBackend(http.StatusServiceUnavailable)
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader(fmt.Sprintf("[%s]", span(g, nil))))
+	recorder := httptest.NewRecorder()
+	exporter := CreateOTLPExporter(backend.Client(), backend.URL+"/v1/traces")
+	CreateZipkinSpansHandler(CreateKubernetesProvider(CreateIndexer()), DefaultConfig, exporter)(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+}
+
+func TestZipkinSpansHandlerV1Spans(t *testing.T) {
+	g := NewWithT(t)
+
+	backend, received := fakeOTLPBackend(http.StatusOK)
+	defer backend.Close()
+
+	cfg := DefaultConfig
+	cfg.UpstreamProtocol = upstreamProtocolOTLP
+	req := httptest.NewRequest("POST", "/api/v1/spans", strings.NewReader(`[]`))
+	recorder := httptest.NewRecorder()
+	exporter := CreateOTLPExporter(backend.Client(), backend.URL+"/v1/traces")
+	CreateZipkinSpansHandler(CreateKubernetesProvider(CreateIndexer()), cfg, exporter)(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	g.Expect(recorder.Body.String()).To(ContainSubstring("Zipkin v1 spans can't be exported with UPSTREAM_PROTOCOL otlp"))
+	g.Expect(received).NotTo(Receive())
+}
+
+func TestZipkinSpansHandlerOtherPath(t *testing.T) {
+	g := NewWithT(t)
+
+	backend, received := fakeOTLPBackend(http.StatusOK)
+	defer backend.Close()
+
+	req := httptest.NewRequest("GET", "/api/v2/trace/5af7183fb1d4cf5f", nil)
+	recorder := httptest.NewRecorder()
+	exporter := CreateOTLPExporter(backend.Client(), backend.URL+"/v1/traces")
+	CreateZipkinSpansHandler(CreateKubernetesProvider(CreateIndexer()), DefaultConfig, exporter)(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusNotFound))
+	g.Expect(received).NotTo(Receive())
+}
+
+func TestOTLPForwardProto(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label", "team": "tracing"}))).To(Succeed())
+
+	backend, received := fakeOTLPBackend(http.StatusOK)
+	defer backend.Close()
+
+	// Links aren't decoded, so they have to be forwarded as they are
+	var link []byte
+	link = appendProtoBytes(link, otlpSpanTraceID, bytes.Repeat([]byte{0xef}, 16))
+	link = appendProtoBytes(link, otlpSpanSpanID, bytes.Repeat([]byte{0x12}, 8))
+	var span []byte
+	span = appendProtoBytes(span, otlpSpanTraceID, bytes.Repeat([]byte{0xab}, 16))
+	span = appendProtoBytes(span, otlpSpanSpanID, bytes.Repeat([]byte{0xcd}, 8))
+	span = appendProtoBytes(span, otlpSpanName, []byte("get /api"))
+	span = appendProtoBytes(span, 13, link)
+	var scopeSpans []byte
+	scopeSpans = appendProtoBytes(scopeSpans, otlpScopeSpansSpans, span)
+	var resource []byte
+	resource = appendProtoBytes(resource, otlpResourceAttributes, otlpStringKeyValue("service.name", "backend"))
+	resource = appendProtoBytes(resource, otlpResourceAttributes, otlpStringKeyValue("team", "from_resource"))
+	var resourceSpans []byte
+	resourceSpans = appendProtoBytes(resourceSpans, otlpResourceSpansResource, resource)
+	resourceSpans = appendProtoBytes(resourceSpans, otlpResourceSpansScopeSpans, scopeSpans)
+	var request []byte
+	request = appendProtoBytes(request, otlpRequestResourceSpans, resourceSpans)
+
+	req := httptest.NewRequest("POST", "/v1/traces", bytes.NewReader(request))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	recorder := httptest.NewRecorder()
+	cfg := DefaultConfig
+	cfg.LabelTagMapping = map[string]string{"owner": "owner", "team": "team"}
+	exporter := CreateOTLPExporter(backend.Client(), backend.URL+"/v1/traces")
+	CreateOTLPHandler(CreateKubernetesProvider(indexer), cfg, exporter)(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	var body []byte
+	g.Expect(received).To(Receive(&body))
+	g.Expect(bytes.Contains(body, resourceSpans)).To(BeTrue())
+	forwarded, err := decodeOTLPProto(body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(forwarded.ResourceSpans).To(HaveLen(1))
+	g.Expect(otlpAttributes(forwarded.ResourceSpans[0].Resource.Attributes)).To(Equal(map[string]string{
+		"service.name": "backend",
+		"team":         "from_resource",
+		"owner":        "from_label",
+	}))
+	g.Expect(forwarded.ResourceSpans[0].ScopeSpans[0].Spans[0].Name).To(Equal("get /api"))
+}
+
+func TestOTLPForwardJSON(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	backend, received := fakeOTLPBackend(http.StatusOK)
+	defer backend.Close()
+
+	req := httptest.NewRequest("POST", "/v1/traces", strings.NewReader(otlpJSONRequest))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	exporter := CreateOTLPExporter(backend.Client(), backend.URL+"/v1/traces")
+	CreateOTLPHandler(CreateKubernetesProvider(indexer), DefaultConfig, exporter)(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	var body []byte
+	g.Expect(received).To(Receive(&body))
+	g.Expect(gjson.GetBytes(body, "resourceSpans.0.resource.attributes.#.key").Value()).To(Equal([]interface{}{
+		"service.name", "host.name", "owner",
+	}))
+	g.Expect(gjson.GetBytes(body, "resourceSpans.0.resource.attributes.2.value.stringValue").String()).To(Equal("from_label"))
+	g.Expect(gjson.GetBytes(body, "resourceSpans.0.scopeSpans.0.scope.name").String()).To(Equal("test-scope"))
+	span := gjson.GetBytes(body, "resourceSpans.0.scopeSpans.0.spans.0")
+	g.Expect(span.Get("startTimeUnixNano").String()).To(Equal("1556604172355737000"))
+	g.Expect(span.Get("status.code").Raw).To(Equal("2"))
+	// Attributes aren't converted to Zipkin tags
+	g.Expect(span.Get("attributes.1.value.intValue").String()).To(Equal("500"))
+}
+
+// fakeOTLPBackend starts a server that sends the bodies of all protobuf and
+// JSON requests sent to /v1/traces to the returned channel.
+func fakeOTLPBackend(status int) (*httptest.Server, chan []byte) {
+	received := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		contentType := req.Header.Get("Content-Type")
+		if req.URL.Path == "/v1/traces" && (contentType == "application/x-protobuf" || contentType == "application/json") {
+			body, _ := ioutil.ReadAll(req.Body)
+			received <- body
+		}
+		w.WriteHeader(status)
+	}))
+	return server, received
+}
+
+func otlpAttributes(attributes []otlpKeyValue) map[string]string {
+	result := map[string]string{}
+	for _, attribute := range attributes {
+		result[attribute.Key] = attribute.Value.String()
+	}
+	return result
+}
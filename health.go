@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// healthCheckTimeout is how long a single readiness check may take.
+const healthCheckTimeout = 2 * time.Second
+
+var errPodCacheNotSynced = errors.New("pods have not been listed yet")
+
+// healthCheck is a named readiness check.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// podCacheHealthCheck fails until the pods in all watched namespaces have
+// been listed and, when maxStaleness is not 0, when none of the watches has
+// received an event for longer than maxStaleness. With a clusterName, the
+// check is named after the cluster, so that every cluster has its own.
+func podCacheHealthCheck(clusterName string, stores []*podCacheStore, maxStaleness time.Duration) healthCheck {
+	name := "pod-cache"
+	if clusterName != "" {
+		name = "pod-cache-" + clusterName
+	}
+	return healthCheck{name: name, check: func(context.Context) error {
+		var lastEvent time.Time
+		for _, s := range stores {
+			if !s.Synced() {
+				if s.namespace == allNamespaces {
+					return errPodCacheNotSynced
+				}
+				return fmt.Errorf("pods in namespace %s have not been listed yet", s.namespace)
+			}
+			if s.LastEvent().After(lastEvent) {
+				lastEvent = s.LastEvent()
+			}
+		}
+		if maxStaleness == 0 || len(stores) == 0 {
+			return nil
+		}
+		sinceLastEvent := stores[0].now().Sub(lastEvent)
+		if sinceLastEvent > maxStaleness {
+			return fmt.Errorf("no pod events or resyncs for %s", sinceLastEvent.Round(time.Second))
+		}
+		return nil
+	}}
+}
+
+// zipkinHealthCheck fails when Zipkin's /health endpoint doesn't respond with
+// a 2xx status.
+func zipkinHealthCheck(client *http.Client, cfg Config) healthCheck {
+	url := zipkinTarget(cfg, "/health").String()
+	return healthCheck{name: "zipkin", check: func(ctx context.Context) error {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("%s responded with %s", url, resp.Status)
+		}
+		return nil
+	}}
+}
+
+// metadataServerHealthCheck fails until all pods have been received from the
+// metadata server. Later disconnects are retried while the cache keeps being
+// used, so they don't fail it.
+func metadataServerHealthCheck(p *serverProvider) healthCheck {
+	return healthCheck{name: "metadata-server", check: func(context.Context) error {
+		if !p.Synced() {
+			return errors.New("pods have not been received from the metadata server yet")
+		}
+		return nil
+	}}
+}
+
+// shutdownHealthCheck fails once the shutdown has started.
+func shutdownHealthCheck(l *lifecycle) healthCheck {
+	return healthCheck{name: "shutdown", check: func(context.Context) error {
+		if l.ShuttingDown() {
+			return errors.New("shutting down")
+		}
+		return nil
+	}}
+}
+
+// CreateReadyzHandler runs all checks and responds with 200 when all of them
+// pass and with 503 otherwise. The result of every check is listed in the
+// body when one of them fails or the verbose query parameter is set.
+func CreateReadyzHandler(checks ...healthCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := context.WithTimeout(req.Context(), healthCheckTimeout)
+		defer cancel()
+
+		var body bytes.Buffer
+		failed := false
+		for _, c := range checks {
+			if err := c.check(ctx); err != nil {
+				failed = true
+				fmt.Fprintf(&body, "[-]%s failed: %s\n", c.name, err)
+				if klog.V(1) {
+					klog.Infof("Readiness check %s failed: %s", c.name, err)
+				}
+			} else {
+				fmt.Fprintf(&body, "[+]%s ok\n", c.name)
+			}
+		}
+
+		status := http.StatusOK
+		if failed {
+			status = http.StatusServiceUnavailable
+			body.WriteString("readyz check failed\n")
+		} else if _, verbose := req.URL.Query()["verbose"]; verbose {
+			body.WriteString("readyz check passed\n")
+		} else {
+			body.Reset()
+			body.WriteString("ok")
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		if _, err := w.Write(body.Bytes()); err != nil {
+			klog.Error(err)
+		}
+	}
+}
+
+// livezHandlerFunc responds with 200 as long as the server is serving
+// requests. It doesn't depend on Zipkin or Kubernetes, so that the container
+// isn't restarted when they are unavailable.
+func livezHandlerFunc(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(200)
+	_, err := w.Write([]byte("ok"))
+	if err != nil {
+		klog.Error(err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func readyz(checks ...healthCheck) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	CreateReadyzHandler(checks...)(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	return recorder
+}
+
+func TestPodCacheReadiness(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	podCache := CreatePodCacheStore(indexer, allNamespaces, DefaultConfig)
+	now := time.Now()
+	podCache.now = func() time.Time { return now }
+	check := podCacheHealthCheck("", []*podCacheStore{podCache}, time.Minute)
+
+	recorder := readyz(check)
+	g.Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+	g.Expect(recorder.Body.String()).To(Equal("[-]pod-cache failed: pods have not been listed yet\nreadyz check failed\n"))
+
+	g.Expect(podCache.Replace([]interface{}{pod("test-pod", testIp, nil)}, "1")).To(Succeed())
+	recorder = readyz(check)
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	g.Expect(recorder.Body.String()).To(Equal("ok"))
+	g.Expect(indexer.ByIndex(ipIndex, testIp)).To(HaveLen(1))
+
+	now = now.Add(2 * time.Minute)
+	recorder = readyz(check)
+	g.Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+	g.Expect(recorder.Body.String()).To(ContainSubstring("no pod events or resyncs for 2m0s"))
+
+	g.Expect(podCache.Delete(pod("test-pod", testIp, nil))).To(Succeed())
+	g.Expect(readyz(check).Code).To(Equal(http.StatusOK))
+	g.Expect(indexer.ByIndex(ipIndex, testIp)).To(BeEmpty())
+
+	// The reflector resyncs while it's watching, even when no pods change
+	now = now.Add(2 * time.Minute)
+	g.Expect(readyz(check).Code).To(Equal(http.StatusServiceUnavailable))
+	g.Expect(podCache.Resync()).To(Succeed())
+	g.Expect(readyz(check).Code).To(Equal(http.StatusOK))
+
+	// Staleness is not checked without a maximum
+	now = now.Add(time.Hour)
+	g.Expect(readyz(podCacheHealthCheck("", []*podCacheStore{podCache}, 0)).Code).To(Equal(http.StatusOK))
+}
+
+func TestNamespacedPodCacheReadiness(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	defaultCache := CreatePodCacheStore(indexer, "default", DefaultConfig)
+	prodCache := CreatePodCacheStore(indexer, "prod", DefaultConfig)
+	check := podCacheHealthCheck("", []*podCacheStore{defaultCache, prodCache}, 0)
+
+	g.Expect(defaultCache.Replace([]interface{}{}, "1")).To(Succeed())
+	recorder := readyz(check)
+	g.Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+	g.Expect(recorder.Body.String()).To(ContainSubstring("pods in namespace prod have not been listed yet"))
+
+	g.Expect(prodCache.Replace([]interface{}{}, "1")).To(Succeed())
+	g.Expect(readyz(check).Code).To(Equal(http.StatusOK))
+}
+
+func TestClusterPodCacheReadiness(t *testing.T) {
+	g := NewWithT(t)
+
+	prodCache := CreatePodCacheStore(CreateIndexer(), allNamespaces, DefaultConfig)
+	stagingCache := CreatePodCacheStore(CreateIndexer(), allNamespaces, DefaultConfig)
+	g.Expect(prodCache.Replace([]interface{}{}, "1")).To(Succeed())
+
+	recorder := readyz(
+		podCacheHealthCheck("prod", []*podCacheStore{prodCache}, 0),
+		podCacheHealthCheck("staging", []*podCacheStore{stagingCache}, 0),
+	)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+	g.Expect(recorder.Body.String()).To(Equal("[+]pod-cache-prod ok\n[-]pod-cache-staging failed: pods have not been listed yet\nreadyz check failed\n"))
+}
+
+func TestZipkinReadiness(t *testing.T) {
+	g := NewWithT(t)
+
+	status := http.StatusOK
+	zipkin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		g.Expect(req.URL.Path).To(Equal("/zipkin/health"))
+		w.WriteHeader(status)
+	}))
+	defer zipkin.Close()
+	zipkinURL, err := parseZipkinURL(zipkin.URL + "/zipkin")
+	g.Expect(err).NotTo(HaveOccurred())
+	cfg := DefaultConfig
+	cfg.ZipkinURL = zipkinURL
+	check := zipkinHealthCheck(zipkin.Client(), cfg)
+
+	g.Expect(readyz(check).Code).To(Equal(http.StatusOK))
+
+	status = http.StatusServiceUnavailable
+	recorder := readyz(check)
+	g.Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+	g.Expect(recorder.Body.String()).To(ContainSubstring("[-]zipkin failed: " + zipkin.URL + "/zipkin/health responded with 503"))
+}
+
+func TestReadyzVerbose(t *testing.T) {
+	g := NewWithT(t)
+
+	podCache := CreatePodCacheStore(CreateIndexer(), allNamespaces, DefaultConfig)
+	g.Expect(podCache.Replace([]interface{}{}, "1")).To(Succeed())
+	lc := CreateLifecycle(DefaultConfig)
+	handler := CreateReadyzHandler(shutdownHealthCheck(lc), podCacheHealthCheck("", []*podCacheStore{podCache}, 0))
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("GET", "/readyz?verbose", nil))
+
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	g.Expect(recorder.Body.String()).To(Equal("[+]shutdown ok\n[+]pod-cache ok\nreadyz check passed\n"))
+}
+
+func TestLivez(t *testing.T) {
+	g := NewWithT(t)
+
+	recorder := httptest.NewRecorder()
+	livezHandlerFunc(recorder, httptest.NewRequest("GET", "/livez", nil))
+
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	g.Expect(recorder.Body.String()).To(Equal("ok"))
+}
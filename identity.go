@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/klog"
+)
+
+const serviceAccountIndex = "serviceaccount"
+
+func podServiceAccountKeyFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return []string{}, fmt.Errorf("%v is not a v1.Pod", obj)
+	}
+	serviceAccount := pod.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	return []string{pod.Namespace + "/" + serviceAccount}, nil
+}
+
+// podIdentity is the workload identity from a client certificate. Either the
+// pod or the service account is set.
+type podIdentity struct {
+	namespace      string
+	pod            string
+	serviceAccount string
+}
+
+// parseIdentityURI parses SPIFFE IDs of the trust domain with a path like the
+// one of SPIFFE IDs issued in Kubernetes, spiffe://<trust
+// domain>/ns/<namespace>/sa/<service account>, or one that names the pod,
+// spiffe://<trust domain>/ns/<namespace>/pod/<pod>. URIs of other schemes or
+// trust domains don't identify a pod, as any CA can issue them.
+func parseIdentityURI(uri *url.URL, trustDomain string) (podIdentity, bool) {
+	if uri.Scheme != "spiffe" || !strings.EqualFold(uri.Host, trustDomain) {
+		return podIdentity{}, false
+	}
+	parts := strings.Split(strings.TrimPrefix(uri.Path, "/"), "/")
+	if len(parts) != 4 || parts[0] != "ns" || parts[1] == "" || parts[3] == "" {
+		return podIdentity{}, false
+	}
+	switch parts[2] {
+	case "sa":
+		return podIdentity{namespace: parts[1], serviceAccount: parts[3]}, true
+	case "pod":
+		return podIdentity{namespace: parts[1], pod: parts[3]}, true
+	}
+	return podIdentity{}, false
+}
+
+// getCertificateIdentity returns the identity from the URI SANs of the
+// client certificate.
+func getCertificateIdentity(cert *x509.Certificate, trustDomain string) (podIdentity, bool) {
+	for _, uri := range cert.URIs {
+		if identity, ok := parseIdentityURI(uri, trustDomain); ok {
+			return identity, true
+		}
+		if klog.V(1) {
+			klog.Infof("Ignoring URI SAN %s, which doesn't identify a pod in trust domain %s", uri, trustDomain)
+		}
+	}
+	return podIdentity{}, false
+}
+
+// getIdentityTagValues returns the tag values for the pods with the
+// identity. If a service account is used by multiple pods, only the tags that
+// have the same value for all of them are returned.
+func getIdentityTagValues(provider metadataProvider, identity podIdentity, cfg Config) (map[string]string, error) {
+	pods, err := provider.PodsByIdentity(identity)
+	if err != nil {
+		return nil, err
+	}
+	if len(pods) == 0 {
+		return nil, fmt.Errorf("Did not find any pods for %+v", identity)
+	}
+	var tagValues map[string]string
+	for _, pod := range pods {
+		podTagValues := getTagValues(pod, cfg.LabelTagMapping)
+		if tagValues == nil {
+			tagValues = podTagValues
+			continue
+		}
+		for tag, value := range tagValues {
+			if podTagValues[tag] != value {
+				delete(tagValues, tag)
+			}
+		}
+	}
+	return tagValues, nil
+}
+
+// getClientCertificateTagValues returns the tag values for the identity in
+// the verified client certificate of the request. It returns false when the
+// request doesn't have one or no pods with the identity are found.
+func getClientCertificateTagValues(provider metadataProvider, req *http.Request, cfg Config) (map[string]string, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+		return nil, false
+	}
+	identity, ok := getCertificateIdentity(req.TLS.VerifiedChains[0][0], cfg.TLSTrustDomain)
+	if !ok {
+		return nil, false
+	}
+	tagValues, err := getIdentityTagValues(provider, identity, cfg)
+	if err != nil {
+		if klog.V(1) {
+			klog.Infof("Failed to find pods by client certificate: %s", err)
+		}
+		return nil, false
+	}
+	return tagValues, true
+}
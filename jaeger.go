@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// The types below mirror the Jaeger Thrift data model in
+// https://github.com/jaegertracing/jaeger-idl/blob/master/thrift/jaeger.thrift
+// They only include the fields that are converted to Zipkin spans.
+
+type jaegerBatch struct {
+	Process jaegerProcess
+	Spans   []jaegerSpan
+}
+
+type jaegerProcess struct {
+	ServiceName string
+	Tags        []jaegerTag
+}
+
+type jaegerSpan struct {
+	TraceIDLow    int64
+	TraceIDHigh   int64
+	SpanID        int64
+	ParentSpanID  int64
+	OperationName string
+	References    []jaegerSpanRef
+	Flags         int32
+	StartTime     int64
+	Duration      int64
+	Tags          []jaegerTag
+	Logs          []jaegerLog
+}
+
+type jaegerSpanRef struct {
+	RefType     int32
+	TraceIDLow  int64
+	TraceIDHigh int64
+	SpanID      int64
+}
+
+type jaegerLog struct {
+	Timestamp int64
+	Fields    []jaegerTag
+}
+
+type jaegerTag struct {
+	Key     string
+	VType   int32
+	VStr    string
+	VDouble float64
+	VBool   bool
+	VLong   int64
+	VBinary []byte
+}
+
+// Jaeger TagType values
+const (
+	jaegerTagString = 0
+	jaegerTagDouble = 1
+	jaegerTagBool   = 2
+	jaegerTagLong   = 3
+	jaegerTagBinary = 4
+)
+
+const (
+	jaegerRefChildOf = 0
+	jaegerFlagDebug  = 2
+)
+
+// String formats the value the way it's stored in a Zipkin tag.
+func (t jaegerTag) String() string {
+	switch t.VType {
+	case jaegerTagDouble:
+		return strconv.FormatFloat(t.VDouble, 'g', -1, 64)
+	case jaegerTagBool:
+		return strconv.FormatBool(t.VBool)
+	case jaegerTagLong:
+		return strconv.FormatInt(t.VLong, 10)
+	case jaegerTagBinary:
+		return base64.StdEncoding.EncodeToString(t.VBinary)
+	}
+	return t.VStr
+}
+
+func decodeJaegerBatch(r thriftProtocolReader) (jaegerBatch, error) {
+	var batch jaegerBatch
+	err := readThriftStruct(r, func(typ byte, id int16) error {
+		switch {
+		case id == 1 && typ == thriftStruct:
+			return readThriftStruct(r, func(typ byte, id int16) error {
+				switch {
+				case id == 1 && typ == thriftString:
+					serviceName, err := readThriftString(r)
+					batch.Process.ServiceName = serviceName
+					return err
+				case id == 2 && typ == thriftList:
+					tags, err := decodeJaegerTags(r)
+					batch.Process.Tags = tags
+					return err
+				}
+				return r.skip(typ)
+			})
+		case id == 2 && typ == thriftList:
+			return readThriftList(r, thriftStruct, func() error {
+				span, err := decodeJaegerSpan(r)
+				batch.Spans = append(batch.Spans, span)
+				return err
+			})
+		}
+		return r.skip(typ)
+	})
+	if err != nil {
+		return jaegerBatch{}, fmt.Errorf("Failed to parse Jaeger batch: %w", err)
+	}
+	return batch, nil
+}
+
+func decodeJaegerSpan(r thriftProtocolReader) (jaegerSpan, error) {
+	var span jaegerSpan
+	err := readThriftStruct(r, func(typ byte, id int16) error {
+		var err error
+		switch {
+		case id == 1 && typ == thriftI64:
+			span.TraceIDLow, err = r.readI64()
+		case id == 2 && typ == thriftI64:
+			span.TraceIDHigh, err = r.readI64()
+		case id == 3 && typ == thriftI64:
+			span.SpanID, err = r.readI64()
+		case id == 4 && typ == thriftI64:
+			span.ParentSpanID, err = r.readI64()
+		case id == 5 && typ == thriftString:
+			span.OperationName, err = readThriftString(r)
+		case id == 6 && typ == thriftList:
+			err = readThriftList(r, thriftStruct, func() error {
+				ref, err := decodeJaegerSpanRef(r)
+				span.References = append(span.References, ref)
+				return err
+			})
+		case id == 7 && typ == thriftI32:
+			span.Flags, err = r.readI32()
+		case id == 8 && typ == thriftI64:
+			span.StartTime, err = r.readI64()
+		case id == 9 && typ == thriftI64:
+			span.Duration, err = r.readI64()
+		case id == 10 && typ == thriftList:
+			span.Tags, err = decodeJaegerTags(r)
+		case id == 11 && typ == thriftList:
+			err = readThriftList(r, thriftStruct, func() error {
+				log, err := decodeJaegerLog(r)
+				span.Logs = append(span.Logs, log)
+				return err
+			})
+		default:
+			err = r.skip(typ)
+		}
+		return err
+	})
+	return span, err
+}
+
+func decodeJaegerSpanRef(r thriftProtocolReader) (jaegerSpanRef, error) {
+	var ref jaegerSpanRef
+	err := readThriftStruct(r, func(typ byte, id int16) error {
+		var err error
+		switch {
+		case id == 1 && typ == thriftI32:
+			ref.RefType, err = r.readI32()
+		case id == 2 && typ == thriftI64:
+			ref.TraceIDLow, err = r.readI64()
+		case id == 3 && typ == thriftI64:
+			ref.TraceIDHigh, err = r.readI64()
+		case id == 4 && typ == thriftI64:
+			ref.SpanID, err = r.readI64()
+		default:
+			err = r.skip(typ)
+		}
+		return err
+	})
+	return ref, err
+}
+
+func decodeJaegerLog(r thriftProtocolReader) (jaegerLog, error) {
+	var log jaegerLog
+	err := readThriftStruct(r, func(typ byte, id int16) error {
+		var err error
+		switch {
+		case id == 1 && typ == thriftI64:
+			log.Timestamp, err = r.readI64()
+		case id == 2 && typ == thriftList:
+			log.Fields, err = decodeJaegerTags(r)
+		default:
+			err = r.skip(typ)
+		}
+		return err
+	})
+	return log, err
+}
+
+func decodeJaegerTags(r thriftProtocolReader) ([]jaegerTag, error) {
+	var tags []jaegerTag
+	err := readThriftList(r, thriftStruct, func() error {
+		var tag jaegerTag
+		err := readThriftStruct(r, func(typ byte, id int16) error {
+			var err error
+			switch {
+			case id == 1 && typ == thriftString:
+				tag.Key, err = readThriftString(r)
+			case id == 2 && typ == thriftI32:
+				tag.VType, err = r.readI32()
+			case id == 3 && typ == thriftString:
+				tag.VStr, err = readThriftString(r)
+			case id == 4 && typ == thriftDouble:
+				tag.VDouble, err = r.readDouble()
+			case id == 5 && typ == thriftBool:
+				tag.VBool, err = r.readBool()
+			case id == 6 && typ == thriftI64:
+				tag.VLong, err = r.readI64()
+			case id == 7 && typ == thriftString:
+				var value []byte
+				value, err = r.readBinary()
+				tag.VBinary = append([]byte{}, value...)
+			default:
+				err = r.skip(typ)
+			}
+			return err
+		})
+		tags = append(tags, tag)
+		return err
+	})
+	return tags, err
+}
+
+// decodeJaegerAgentMessage decodes the emitBatch call that Jaeger clients send
+// to the agent over UDP.
+func decodeJaegerAgentMessage(packet []byte) (jaegerBatch, error) {
+	r := &thriftCompactReader{buf: packet}
+	name, typ, err := r.readMessageBegin()
+	if err != nil {
+		return jaegerBatch{}, fmt.Errorf("Failed to parse Jaeger agent message: %w", err)
+	}
+	if name != "emitBatch" || (typ != thriftMessageCall && typ != thriftMessageOneway) {
+		return jaegerBatch{}, fmt.Errorf("Unsupported Jaeger agent method %s", name)
+	}
+	var batch jaegerBatch
+	found := false
+	err = readThriftStruct(r, func(typ byte, id int16) error {
+		if id == 1 && typ == thriftStruct {
+			var err error
+			batch, err = decodeJaegerBatch(r)
+			found = true
+			return err
+		}
+		return r.skip(typ)
+	})
+	if err != nil {
+		return jaegerBatch{}, fmt.Errorf("Failed to parse Jaeger agent message: %w", err)
+	}
+	if !found {
+		return jaegerBatch{}, fmt.Errorf("Jaeger agent message doesn't contain a batch")
+	}
+	return batch, nil
+}
+
+// Tags that Jaeger clients use for information that Zipkin keeps in the span
+// kind and endpoints.
+const (
+	jaegerSpanKindTag    = "span.kind"
+	jaegerPeerServiceTag = "peer.service"
+	jaegerPeerIPv4Tag    = "peer.ipv4"
+	jaegerPeerIPv6Tag    = "peer.ipv6"
+	jaegerPeerPortTag    = "peer.port"
+	jaegerProcessIPTag   = "ip"
+)
+
+var jaegerSpanKinds = map[string]string{
+	"client":   zipkinKindClient,
+	"server":   zipkinKindServer,
+	"producer": zipkinKindProducer,
+	"consumer": zipkinKindConsumer,
+}
+
+// jaegerToZipkin converts Jaeger spans to Zipkin v2 spans. Process tags
+// become tags of every span, like they do in the Jaeger UI.
+func jaegerToZipkin(batch jaegerBatch) []zipkinSpan {
+	localEndpoint := zipkinEndpoint{ServiceName: batch.Process.ServiceName}
+	processTags := map[string]string{}
+	for _, tag := range batch.Process.Tags {
+		if tag.Key == jaegerProcessIPTag {
+			localEndpoint.setIP(jaegerTagIP(tag))
+		}
+		processTags[tag.Key] = tag.String()
+	}
+
+	spans := make([]zipkinSpan, 0, len(batch.Spans))
+	for _, span := range batch.Spans {
+		result := zipkinSpan{
+			TraceID:   jaegerTraceID(span.TraceIDHigh, span.TraceIDLow),
+			ID:        jaegerID(span.SpanID),
+			Name:      span.OperationName,
+			Timestamp: uint64(span.StartTime),
+			Duration:  uint64(span.Duration),
+			Debug:     span.Flags&jaegerFlagDebug != 0,
+		}
+		parentID := span.ParentSpanID
+		for _, ref := range span.References {
+			if parentID == 0 && ref.RefType == jaegerRefChildOf {
+				parentID = ref.SpanID
+			}
+		}
+		if parentID != 0 {
+			result.ParentID = jaegerID(parentID)
+		}
+		if localEndpoint != (zipkinEndpoint{}) {
+			endpoint := localEndpoint
+			result.LocalEndpoint = &endpoint
+		}
+
+		tags := map[string]string{}
+		for key, value := range processTags {
+			tags[key] = value
+		}
+		remoteEndpoint := zipkinEndpoint{}
+		for _, tag := range span.Tags {
+			switch tag.Key {
+			case jaegerSpanKindTag:
+				if kind, ok := jaegerSpanKinds[tag.String()]; ok {
+					result.Kind = kind
+					continue
+				}
+			case jaegerPeerServiceTag:
+				remoteEndpoint.ServiceName = tag.String()
+			case jaegerPeerIPv4Tag, jaegerPeerIPv6Tag:
+				remoteEndpoint.setIP(jaegerTagIP(tag))
+			case jaegerPeerPortTag:
+				port, _ := strconv.Atoi(tag.String())
+				remoteEndpoint.Port = port
+			}
+			tags[tag.Key] = tag.String()
+		}
+		if remoteEndpoint != (zipkinEndpoint{}) {
+			result.RemoteEndpoint = &remoteEndpoint
+		}
+		if len(tags) > 0 {
+			result.Tags = tags
+		}
+
+		for _, log := range span.Logs {
+			result.Annotations = append(result.Annotations, zipkinAnnotation{
+				Timestamp: uint64(log.Timestamp),
+				Value:     jaegerLogValue(log),
+			})
+		}
+		spans = append(spans, result)
+	}
+	return spans
+}
+
+func jaegerID(id int64) string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+func jaegerTraceID(high, low int64) string {
+	if high == 0 {
+		return jaegerID(low)
+	}
+	return jaegerID(high) + jaegerID(low)
+}
+
+// jaegerTagIP parses an IP address tag. Jaeger clients send IPv4 addresses
+// either as strings or as 32-bit integers.
+func jaegerTagIP(tag jaegerTag) net.IP {
+	if tag.VType == jaegerTagLong {
+		ip := uint32(tag.VLong)
+		return net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip))
+	}
+	return net.ParseIP(tag.String())
+}
+
+// jaegerLogValue formats the log as a Zipkin annotation value. Logs with only
+// an event field use its value, otherwise all fields are encoded as JSON.
+func jaegerLogValue(log jaegerLog) string {
+	if len(log.Fields) == 1 && log.Fields[0].Key == "event" {
+		return log.Fields[0].String()
+	}
+	fields := make(map[string]string, len(log.Fields))
+	for _, field := range log.Fields {
+		fields[field.Key] = field.String()
+	}
+	value, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Sprint(fields)
+	}
+	return string(value)
+}
+
+// CreateJaegerHandler returns a handler for the /api/traces endpoint of the
+// Jaeger collector, which accepts TBinaryProtocol encoded batches. The spans
+// are converted to Zipkin v2 spans and passed to the exporter.
+func CreateJaegerHandler(provider metadataProvider, cfg Config, exporter spanExporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "Only POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		contentType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil || (contentType != contentTypeThrift && contentType != "application/vnd.apache.thrift.binary") {
+			http.Error(w, "Content-Type has to be application/x-thrift", http.StatusUnsupportedMediaType)
+			return
+		}
+		release, ok := acquireRequestSlot(req)
+		if !ok {
+			return
+		}
+		defer release()
+		bodyBytes, ok := readRequestBody(w, req, cfg)
+		if !ok {
+			return
+		}
+		contentEncoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+		bodyBytes, err = decodeBody(bodyBytes, contentEncoding, cfg.MaxDecompressedBodySize)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decompress request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		batch, err := decodeJaegerBatch(&thriftBinaryReader{buf: bodyBytes})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		release()
+		if err := exporter.ExportSpans(jaegerToZipkin(batch), getRequestTagValues(provider, req, cfg)); err != nil {
+			klog.Errorf("Failed to export Jaeger spans: %s", err)
+			http.Error(w, "Failed to export spans", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// jaegerMaxPacketSize is the largest UDP packet the Jaeger agent accepts.
+const jaegerMaxPacketSize = 65000
+
+// jaegerAgentWorkers limits how many packets are converted and forwarded at
+// the same time. Packets that arrive while all workers are busy are dropped,
+// which is what the Jaeger agent does as well.
+const jaegerAgentWorkers = 16
+
+// ServeJaegerAgent receives compact Thrift encoded batches on the connection
+// like the Jaeger agent does on port 6831 and passes them to the exporter. It
+// only returns when reading from the connection fails.
+func ServeJaegerAgent(conn net.PacketConn, provider metadataProvider, cfg Config, exporter spanExporter) error {
+	workers := make(chan struct{}, jaegerAgentWorkers)
+	buf := make([]byte, jaegerMaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		packet := append([]byte{}, buf[:n]...)
+		select {
+		case workers <- struct{}{}:
+		default:
+			klog.Warningf("Dropping Jaeger agent packet from %s, all workers are busy", addr)
+			continue
+		}
+		go func() {
+			defer func() { <-workers }()
+			batch, err := decodeJaegerAgentMessage(packet)
+			if err != nil {
+				klog.Errorf("Failed to decode Jaeger agent packet from %s: %s", addr, err)
+				return
+			}
+			var tagValues map[string]string
+			if udpAddr, ok := addr.(*net.UDPAddr); ok {
+				tagValues = getIPTagValues(provider, udpAddr.IP.String(), cfg)
+			}
+			if err := exporter.ExportSpans(jaegerToZipkin(batch), tagValues); err != nil {
+				klog.Errorf("Failed to export Jaeger spans: %s", err)
+			}
+		}()
+	}
+}
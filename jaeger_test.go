@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+)
+
+func TestJaegerHTTPConversion(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	zipkin, received := fakeZipkin(http.StatusAccepted)
+	defer zipkin.Close()
+
+	req := httptest.NewRequest("POST", "/api/traces", bytes.NewReader(jaegerBinaryBatch()))
+	req.Header.Set("Content-Type", "application/x-thrift")
+	recorder := httptest.NewRecorder()
+	CreateJaegerHandler(CreateKubernetesProvider(indexer), fakeZipkinConfig(g, zipkin), fakeZipkinExporter(g, zipkin))(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusAccepted))
+	var body []byte
+	g.Expect(received).To(Receive(&body))
+	g.Expect(gjson.GetBytes(body, "#").Int()).To(Equal(int64(1)))
+	g.Expect(gjson.GetBytes(body, "0.traceId").String()).To(Equal("5af7183fb1d4cf5f"))
+	g.Expect(gjson.GetBytes(body, "0.id").String()).To(Equal("352bff9a74ca9ad2"))
+	g.Expect(gjson.GetBytes(body, "0.parentId").String()).To(Equal("6b221d5bc9e6496c"))
+	g.Expect(gjson.GetBytes(body, "0.name").String()).To(Equal("get /api"))
+	g.Expect(gjson.GetBytes(body, "0.kind").String()).To(Equal("SERVER"))
+	g.Expect(gjson.GetBytes(body, "0.timestamp").Raw).To(Equal("1556604172355737"))
+	g.Expect(gjson.GetBytes(body, "0.duration").Raw).To(Equal("1431"))
+	g.Expect(gjson.GetBytes(body, "0.localEndpoint.serviceName").String()).To(Equal("backend"))
+	g.Expect(gjson.GetBytes(body, "0.localEndpoint.ipv4").String()).To(Equal("192.168.99.1"))
+	g.Expect(gjson.GetBytes(body, "0.tags").Value()).To(Equal(map[string]interface{}{
+		"ip":               "3232260865",
+		"http.method":      "GET",
+		"http.status_code": "200",
+		"owner":            owner,
+	}))
+}
+
+func TestJaegerHTTPInvalidBody(t *testing.T) {
+	g := NewWithT(t)
+
+	zipkin, received := fakeZipkin(http.StatusAccepted)
+	defer zipkin.Close()
+
+	batch := jaegerBinaryBatch()
+	req := httptest.NewRequest("POST", "/api/traces", bytes.NewReader(batch[:len(batch)-10]))
+	req.Header.Set("Content-Type", "application/x-thrift")
+	recorder := httptest.NewRecorder()
+	CreateJaegerHandler(CreateKubernetesProvider(CreateIndexer()), fakeZipkinConfig(g, zipkin), fakeZipkinExporter(g, zipkin))(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	g.Expect(received).NotTo(Receive())
+}
+
+func TestJaegerAgentConversion(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", "127.0.0.1", map[string]string{"owner": owner}))).To(Succeed())
+
+	zipkin, received := fakeZipkin(http.StatusAccepted)
+	defer zipkin.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer conn.Close()
+	go ServeJaegerAgent(conn, CreateKubernetesProvider(indexer), fakeZipkinConfig(g, zipkin), fakeZipkinExporter(g, zipkin))
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	g.Expect(err).NotTo(HaveOccurred())
+	defer client.Close()
+	_, err = client.Write(jaegerCompactEmitBatch())
+	g.Expect(err).NotTo(HaveOccurred())
+
+	var body []byte
+	g.Eventually(received, 5*time.Second).Should(Receive(&body))
+	g.Expect(gjson.GetBytes(body, "0.traceId").String()).To(Equal("00000000000000015af7183fb1d4cf5f"))
+	g.Expect(gjson.GetBytes(body, "0.id").String()).To(Equal("352bff9a74ca9ad2"))
+	g.Expect(gjson.GetBytes(body, "0.kind").String()).To(Equal("CLIENT"))
+	g.Expect(gjson.GetBytes(body, "0.debug").Bool()).To(BeTrue())
+	g.Expect(gjson.GetBytes(body, "0.localEndpoint.serviceName").String()).To(Equal("backend"))
+	g.Expect(gjson.GetBytes(body, "0.annotations.0.value").String()).To(Equal("retry"))
+	g.Expect(gjson.GetBytes(body, "0.tags.error").String()).To(Equal("true"))
+	g.Expect(gjson.GetBytes(body, "0.tags.owner").String()).To(Equal(owner))
+}
+
+func jaegerBinaryTag(buf []byte, key string, vType int32, value []byte) []byte {
+	buf = appendThriftString(buf, 1, key)
+	buf = appendThriftI32(buf, 2, vType)
+	switch vType {
+	case jaegerTagString:
+		buf = appendThriftString(buf, 3, string(value))
+	case jaegerTagLong:
+		buf = appendThriftFieldHeader(buf, thriftI64, 6)
+		buf = append(buf, value...)
+	}
+	return append(buf, thriftStop)
+}
+
+func jaegerBinaryBatch() []byte {
+	ip := make([]byte, 8)
+	binary.BigEndian.PutUint64(ip, 0xc0a86301)
+
+	var batch []byte
+	batch = appendThriftFieldHeader(batch, thriftStruct, 1)
+	batch = appendThriftString(batch, 1, "backend")
+	batch = appendThriftFieldHeader(batch, thriftList, 2)
+	batch = appendThriftListHeader(batch, thriftStruct, 1)
+	batch = jaegerBinaryTag(batch, "ip", jaegerTagLong, ip)
+	batch = append(batch, thriftStop)
+
+	batch = appendThriftFieldHeader(batch, thriftList, 2)
+	batch = appendThriftListHeader(batch, thriftStruct, 1)
+	batch = appendThriftI64(batch, 1, 0x5af7183fb1d4cf5f)
+	batch = appendThriftI64(batch, 2, 0)
+	batch = appendThriftI64(batch, 3, 0x352bff9a74ca9ad2)
+	batch = appendThriftI64(batch, 4, 0x6b221d5bc9e6496c)
+	batch = appendThriftString(batch, 5, "get /api")
+	batch = appendThriftI32(batch, 7, 1)
+	batch = appendThriftI64(batch, 8, 1556604172355737)
+	batch = appendThriftI64(batch, 9, 1431)
+	batch = appendThriftFieldHeader(batch, thriftList, 10)
+	batch = appendThriftListHeader(batch, thriftStruct, 3)
+	batch = jaegerBinaryTag(batch, "span.kind", jaegerTagString, []byte("server"))
+	batch = jaegerBinaryTag(batch, "http.method", jaegerTagString, []byte("GET"))
+	statusCode := make([]byte, 8)
+	binary.BigEndian.PutUint64(statusCode, 200)
+	batch = jaegerBinaryTag(batch, "http.status_code", jaegerTagLong, statusCode)
+	batch = append(batch, thriftStop)
+
+	return append(batch, thriftStop)
+}
+
+// compactWriter is a minimal TCompactProtocol encoder for building test
+// packets.
+type compactWriter struct {
+	buf     []byte
+	lastIDs []int16
+	lastID  int16
+}
+
+func (w *compactWriter) varint(v uint64) {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], v)
+	w.buf = append(w.buf, scratch[:n]...)
+}
+
+func (w *compactWriter) zigzag(v int64) {
+	w.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (w *compactWriter) field(compactType byte, id int16) {
+	if delta := id - w.lastID; delta > 0 && delta <= 15 {
+		w.buf = append(w.buf, byte(delta)<<4|compactType)
+	} else {
+		w.buf = append(w.buf, compactType)
+		w.zigzag(int64(id))
+	}
+	w.lastID = id
+}
+
+func (w *compactWriter) i32(id int16, v int32) {
+	w.field(thriftCompactI32, id)
+	w.zigzag(int64(v))
+}
+
+func (w *compactWriter) i64(id int16, v int64) {
+	w.field(thriftCompactI64, id)
+	w.zigzag(v)
+}
+
+func (w *compactWriter) bool(id int16, v bool) {
+	if v {
+		w.field(thriftCompactBoolTrue, id)
+	} else {
+		w.field(thriftCompactBoolFalse, id)
+	}
+}
+
+func (w *compactWriter) str(id int16, v string) {
+	w.field(thriftCompactBinary, id)
+	w.varint(uint64(len(v)))
+	w.buf = append(w.buf, v...)
+}
+
+func (w *compactWriter) list(id int16, elemType byte, size int) {
+	w.field(thriftCompactList, id)
+	w.buf = append(w.buf, byte(size)<<4|elemType)
+}
+
+// structBegin starts a struct. The field header has to be written before
+// unless the struct is a list element.
+func (w *compactWriter) structBegin() {
+	w.lastIDs = append(w.lastIDs, w.lastID)
+	w.lastID = 0
+}
+
+func (w *compactWriter) structEnd() {
+	w.buf = append(w.buf, thriftStop)
+	w.lastID = w.lastIDs[len(w.lastIDs)-1]
+	w.lastIDs = w.lastIDs[:len(w.lastIDs)-1]
+}
+
+func jaegerCompactEmitBatch() []byte {
+	w := &compactWriter{}
+	w.buf = append(w.buf, thriftCompactProtocolID, thriftMessageOneway<<5|thriftCompactVersion)
+	w.varint(1)
+	w.varint(uint64(len("emitBatch")))
+	w.buf = append(w.buf, "emitBatch"...)
+
+	w.structBegin() // emitBatch_args
+	w.field(thriftCompactStruct, 1)
+	w.structBegin() // Batch
+	w.field(thriftCompactStruct, 1)
+	w.structBegin() // Process
+	w.str(1, "backend")
+	w.structEnd()
+	w.list(2, thriftCompactStruct, 1)
+	w.structBegin() // Span
+	w.i64(1, 0x5af7183fb1d4cf5f)
+	w.i64(2, 1)
+	w.i64(3, 0x352bff9a74ca9ad2)
+	w.i64(4, 0)
+	w.str(5, "get /api")
+	w.i32(7, jaegerFlagDebug)
+	w.i64(8, 1556604172355737)
+	w.i64(9, 1431)
+	w.list(10, thriftCompactStruct, 2)
+	w.structBegin()
+	w.str(1, "span.kind")
+	w.i32(2, jaegerTagString)
+	w.str(3, "client")
+	w.structEnd()
+	w.structBegin()
+	w.str(1, "error")
+	w.i32(2, jaegerTagBool)
+	w.bool(5, true)
+	w.structEnd()
+	w.list(11, thriftCompactStruct, 1)
+	w.structBegin() // Log
+	w.i64(1, 1556604172356000)
+	w.list(2, thriftCompactStruct, 1)
+	w.structBegin()
+	w.str(1, "event")
+	w.i32(2, jaegerTagString)
+	w.str(3, "retry")
+	w.structEnd()
+	w.structEnd()
+	w.structEnd()
+	w.structEnd()
+	w.structEnd()
+	return w.buf
+}
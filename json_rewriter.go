@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"k8s.io/klog"
+)
+
+var errJSONTruncated = errors.New("Unexpected end of JSON input")
+
+// addTagsV2JSON adds the tag values to Zipkin v2 JSON spans. Tags that are
+// already set on a span are kept as is.
+//
+// The body is not decoded. Instead it's scanned token by token and the
+// missing tags are inserted at the end of each span's tags object, or a new
+// tags object is inserted at the end of the span. Every other byte is copied
+// over as is, which keeps the key order, the whitespace and the precision of
+// numbers intact.
+func addTagsV2JSON(body []byte, tagValues map[string]string) ([]byte, bool, error) {
+	rewriter := &jsonTagRewriter{body: body, tags: encodeJSONTags(tagValues)}
+	if err := rewriter.rewrite(); err != nil {
+		return nil, false, fmt.Errorf("Failed to parse spans: %w", err)
+	}
+	if rewriter.out == nil {
+		return body, false, nil
+	}
+	rewriter.out = append(rewriter.out, body[rewriter.copied:]...)
+	return rewriter.out, true, nil
+}
+
+// jsonTag is a tag with its name, and its value and the whole "name":"value"
+// member already encoded as JSON.
+type jsonTag struct {
+	name   string
+	value  []byte
+	member []byte
+}
+
+func encodeJSONTags(tagValues map[string]string) []jsonTag {
+	names := make([]string, 0, len(tagValues))
+	for name := range tagValues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tags := make([]jsonTag, 0, len(names))
+	for _, name := range names {
+		// Marshaling strings can't fail
+		encodedName, _ := json.Marshal(name)
+		encodedValue, _ := json.Marshal(tagValues[name])
+		member := append(append(encodedName, ':'), encodedValue...)
+		tags = append(tags, jsonTag{name: name, value: encodedValue, member: member})
+	}
+	return tags
+}
+
+// jsonTagRewriter holds the state of a single addTagsV2JSON call. out stays
+// nil until the first insertion, and body[copied:] is what still has to be
+// copied to out.
+type jsonTagRewriter struct {
+	body   []byte
+	pos    int
+	tags   []jsonTag
+	out    []byte
+	copied int
+}
+
+// insert copies the body up to the current position and then the data.
+func (r *jsonTagRewriter) insert(data ...[]byte) {
+	if r.out == nil {
+		r.out = make([]byte, 0, len(r.body)+len(r.body)/4)
+	}
+	r.out = append(r.out, r.body[r.copied:r.pos]...)
+	for _, d := range data {
+		r.out = append(r.out, d...)
+	}
+	r.copied = r.pos
+}
+
+func (r *jsonTagRewriter) rewrite() error {
+	r.skipWhitespace()
+	if err := r.expect('['); err != nil {
+		return err
+	}
+	r.skipWhitespace()
+	if r.peek() == ']' {
+		r.pos++
+	} else {
+		for {
+			r.skipWhitespace()
+			if err := r.rewriteSpan(); err != nil {
+				return err
+			}
+			r.skipWhitespace()
+			if r.peek() == ',' {
+				r.pos++
+				continue
+			}
+			if err := r.expect(']'); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	r.skipWhitespace()
+	if r.pos != len(r.body) {
+		return fmt.Errorf("Unexpected data after the spans at offset %d", r.pos)
+	}
+	return nil
+}
+
+func (r *jsonTagRewriter) rewriteSpan() error {
+	if err := r.expect('{'); err != nil {
+		return err
+	}
+	hasMembers := false
+	hasTags := false
+	err := r.forEachMember(func(key string) error {
+		hasMembers = true
+		if key != "tags" || hasTags {
+			return r.skipValue(0)
+		}
+		hasTags = true
+		if r.peek() != '{' {
+			// The original behaviour was to leave spans with invalid tags
+			// untouched, so skip them here as well.
+			klog.Errorf("Couldn't parse the tags at offset %d", r.pos)
+			return r.skipValue(0)
+		}
+		return r.rewriteTags()
+	})
+	if err != nil {
+		return err
+	}
+	if hasTags || len(r.tags) == 0 {
+		r.pos++
+		return nil
+	}
+	// Insert the tags object before the closing brace of the span
+	data := [][]byte{}
+	if hasMembers {
+		data = append(data, []byte(","))
+	}
+	data = append(data, []byte(`"tags":{`))
+	for i, tag := range r.tags {
+		if i > 0 {
+			data = append(data, []byte(","))
+		}
+		data = append(data, tag.member)
+	}
+	data = append(data, []byte("}"))
+	r.insert(data...)
+	r.pos++
+	return nil
+}
+
+func (r *jsonTagRewriter) rewriteTags() error {
+	r.pos++
+	hasMembers := false
+	existing := map[string]bool{}
+	err := r.forEachMember(func(key string) error {
+		hasMembers = true
+		// An empty string counts as a tag that is not set, so it's replaced
+		// in place
+		if r.peek() == '"' && r.pos+1 < len(r.body) && r.body[r.pos+1] == '"' {
+			if tag := r.findTag(key); tag != nil && !existing[key] {
+				existing[key] = true
+				r.insert(tag.value)
+				r.copied = r.pos + 2
+			}
+			r.pos += 2
+			return nil
+		}
+		existing[key] = true
+		return r.skipValue(0)
+	})
+	if err != nil {
+		return err
+	}
+	data := [][]byte{}
+	for _, tag := range r.tags {
+		if existing[tag.name] {
+			if klog.V(1) {
+				klog.Infof("Tag %s is already set for the span, skipping", tag.name)
+			}
+			continue
+		}
+		if hasMembers || len(data) > 0 {
+			data = append(data, []byte(","))
+		}
+		data = append(data, tag.member)
+	}
+	if len(data) > 0 {
+		r.insert(data...)
+	}
+	r.pos++
+	return nil
+}
+
+func (r *jsonTagRewriter) findTag(name string) *jsonTag {
+	for i := range r.tags {
+		if r.tags[i].name == name {
+			return &r.tags[i]
+		}
+	}
+	return nil
+}
+
+// forEachMember calls fn with the key of every member of the object whose
+// opening brace was already consumed. fn is called with the position at the
+// start of the value and has to consume the value. It returns with the
+// position at the closing brace.
+func (r *jsonTagRewriter) forEachMember(fn func(key string) error) error {
+	r.skipWhitespace()
+	if r.peek() == '}' {
+		return nil
+	}
+	for {
+		r.skipWhitespace()
+		key, err := r.readString()
+		if err != nil {
+			return err
+		}
+		r.skipWhitespace()
+		if err := r.expect(':'); err != nil {
+			return err
+		}
+		r.skipWhitespace()
+		if err := fn(key); err != nil {
+			return err
+		}
+		r.skipWhitespace()
+		switch r.peek() {
+		case ',':
+			r.pos++
+		case '}':
+			return nil
+		default:
+			return r.unexpected()
+		}
+	}
+}
+
+func (r *jsonTagRewriter) peek() byte {
+	if r.pos >= len(r.body) {
+		return 0
+	}
+	return r.body[r.pos]
+}
+
+func (r *jsonTagRewriter) expect(c byte) error {
+	if r.peek() != c {
+		return r.unexpected()
+	}
+	r.pos++
+	return nil
+}
+
+func (r *jsonTagRewriter) unexpected() error {
+	if r.pos >= len(r.body) {
+		return errJSONTruncated
+	}
+	return fmt.Errorf("Unexpected character %q at offset %d", r.body[r.pos], r.pos)
+}
+
+func (r *jsonTagRewriter) skipWhitespace() {
+	for r.pos < len(r.body) {
+		switch r.body[r.pos] {
+		case ' ', '\t', '\n', '\r':
+			r.pos++
+		default:
+			return
+		}
+	}
+}
+
+// readString reads a string and returns its decoded value.
+func (r *jsonTagRewriter) readString() (string, error) {
+	start := r.pos
+	escaped, err := r.skipString()
+	if err != nil {
+		return "", err
+	}
+	raw := r.body[start:r.pos]
+	if !escaped {
+		return string(raw[1 : len(raw)-1]), nil
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// skipString skips a string and returns whether it contains escape sequences.
+func (r *jsonTagRewriter) skipString() (bool, error) {
+	if err := r.expect('"'); err != nil {
+		return false, err
+	}
+	escaped := false
+	for r.pos < len(r.body) {
+		switch r.body[r.pos] {
+		case '"':
+			r.pos++
+			return escaped, nil
+		case '\\':
+			escaped = true
+			r.pos += 2
+		default:
+			r.pos++
+		}
+	}
+	return false, errJSONTruncated
+}
+
+// jsonMaxDepth limits how deeply nested values can be, so that malicious
+// requests can't exhaust the stack.
+const jsonMaxDepth = 1000
+
+func (r *jsonTagRewriter) skipValue(depth int) error {
+	if depth > jsonMaxDepth {
+		return fmt.Errorf("JSON is nested more than %d levels deep", jsonMaxDepth)
+	}
+	switch c := r.peek(); {
+	case c == '"':
+		_, err := r.skipString()
+		return err
+	case c == '{':
+		r.pos++
+		if err := r.forEachMember(func(string) error { return r.skipValue(depth + 1) }); err != nil {
+			return err
+		}
+		r.pos++
+		return nil
+	case c == '[':
+		r.pos++
+		r.skipWhitespace()
+		if r.peek() == ']' {
+			r.pos++
+			return nil
+		}
+		for {
+			r.skipWhitespace()
+			if err := r.skipValue(depth + 1); err != nil {
+				return err
+			}
+			r.skipWhitespace()
+			switch r.peek() {
+			case ',':
+				r.pos++
+			case ']':
+				r.pos++
+				return nil
+			default:
+				return r.unexpected()
+			}
+		}
+	case c == '-' || (c >= '0' && c <= '9'):
+		return r.skipLiteral("-+.eE0123456789")
+	case c == 't' || c == 'f' || c == 'n':
+		start := r.pos
+		if err := r.skipLiteral("truefalsn"); err != nil {
+			return err
+		}
+		switch string(r.body[start:r.pos]) {
+		case "true", "false", "null":
+			return nil
+		}
+		return fmt.Errorf("Invalid literal %q at offset %d", r.body[start:r.pos], start)
+	}
+	return r.unexpected()
+}
+
+// skipLiteral skips a number or a literal by consuming the allowed
+// characters. Numbers are only loosely validated, as they are copied over as
+// is anyway.
+func (r *jsonTagRewriter) skipLiteral(allowed string) error {
+	start := r.pos
+	for r.pos < len(r.body) && bytes.IndexByte([]byte(allowed), r.body[r.pos]) >= 0 {
+		r.pos++
+	}
+	if r.pos == start {
+		return r.unexpected()
+	}
+	return nil
+}
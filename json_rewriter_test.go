@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+)
+
+func TestJSONRewriterPreservesFormatting(t *testing.T) {
+	g := NewWithT(t)
+
+	body := `[ {"traceId": "5af7183fb1d4cf5f", "timestamp": 1556604172355737,
+	  "duration": 12345678901234567890, "tags": { "http.path": "/api" } } ]`
+	rewritten, modified, err := addTagsV2JSON([]byte(body), map[string]string{"owner": "team"})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(modified).To(BeTrue())
+	g.Expect(string(rewritten)).To(Equal(`[ {"traceId": "5af7183fb1d4cf5f", "timestamp": 1556604172355737,
+	  "duration": 12345678901234567890, "tags": { "http.path": "/api" ,"owner":"team"} } ]`))
+}
+
+func TestJSONRewriterInsertsTags(t *testing.T) {
+	t.Run("span without tags", func(t *testing.T) {
+		g := NewWithT(t)
+
+		rewritten, modified, err := addTagsV2JSON(
+			[]byte(`[{"id":"1"}]`),
+			map[string]string{"owner": "team", "app": "web"},
+		)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(modified).To(BeTrue())
+		g.Expect(string(rewritten)).To(Equal(`[{"id":"1","tags":{"app":"web","owner":"team"}}]`))
+	})
+
+	t.Run("empty span", func(t *testing.T) {
+		g := NewWithT(t)
+
+		rewritten, _, err := addTagsV2JSON([]byte(`[{}]`), map[string]string{"owner": "team"})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(rewritten)).To(Equal(`[{"tags":{"owner":"team"}}]`))
+	})
+
+	t.Run("empty tags", func(t *testing.T) {
+		g := NewWithT(t)
+
+		rewritten, _, err := addTagsV2JSON([]byte(`[{"tags":{}}]`), map[string]string{"owner": "team"})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(rewritten)).To(Equal(`[{"tags":{"owner":"team"}}]`))
+	})
+
+	t.Run("escaped values", func(t *testing.T) {
+		g := NewWithT(t)
+
+		rewritten, _, err := addTagsV2JSON([]byte(`[{}]`), map[string]string{"owner": `"quoted" <team>`})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(gjson.GetBytes(rewritten, "0.tags.owner").String()).To(Equal(`"quoted" <team>`))
+	})
+}
+
+func TestJSONRewriterExistingTags(t *testing.T) {
+	t.Run("set tag is kept", func(t *testing.T) {
+		g := NewWithT(t)
+
+		body := `[{"tags":{"owner":"from_span"}}]`
+		rewritten, modified, err := addTagsV2JSON([]byte(body), map[string]string{"owner": "team"})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(modified).To(BeFalse())
+		g.Expect(string(rewritten)).To(Equal(body))
+	})
+
+	t.Run("escaped key is matched", func(t *testing.T) {
+		g := NewWithT(t)
+
+		body := `[{"tags":{"\u006fwner":"from_span"}}]`
+		rewritten, modified, err := addTagsV2JSON([]byte(body), map[string]string{"owner": "team"})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(modified).To(BeFalse())
+		g.Expect(string(rewritten)).To(Equal(body))
+	})
+
+	t.Run("empty tag is added", func(t *testing.T) {
+		g := NewWithT(t)
+
+		rewritten, _, err := addTagsV2JSON(
+			[]byte(`[{"tags":{"owner":"", "app":""}}]`),
+			map[string]string{"owner": "team"},
+		)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(rewritten)).To(Equal(`[{"tags":{"owner":"team", "app":""}}]`))
+	})
+
+	t.Run("null tags are skipped", func(t *testing.T) {
+		g := NewWithT(t)
+
+		body := `[{"tags":null},{"id":"2"}]`
+		rewritten, modified, err := addTagsV2JSON([]byte(body), map[string]string{"owner": "team"})
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(modified).To(BeTrue())
+		g.Expect(string(rewritten)).To(Equal(`[{"tags":null},{"id":"2","tags":{"owner":"team"}}]`))
+	})
+}
+
+func TestJSONRewriterMalformedInput(t *testing.T) {
+	for _, body := range []string{
+		``,
+		`{}`,
+		`[`,
+		`[{"tags":{}}`,
+		`[{"tags":{"owner"}}]`,
+		`[{"id":tru}]`,
+		`[{"id":"1"}] x`,
+		`["span"]`,
+		`[{"id":"1",}]`,
+		`[{"id":"1` + "\\",
+	} {
+		t.Run(body, func(t *testing.T) {
+			g := NewWithT(t)
+
+			_, _, err := addTagsV2JSON([]byte(body), map[string]string{"owner": "team"})
+			g.Expect(err).To(HaveOccurred())
+		})
+	}
+}
+
+func BenchmarkAddTagsV2JSON(b *testing.B) {
+	tagValues := map[string]string{"owner": "team", "app": "web"}
+	span := `{"traceId":"5af7183fb1d4cf5f","id":"352bff9a74ca9ad2","name":"get /api",` +
+		`"timestamp":1556604172355737,"duration":1431,"kind":"SERVER",` +
+		`"localEndpoint":{"serviceName":"backend","ipv4":"192.168.99.1","port":3306},` +
+		`"tags":{"http.method":"GET","http.path":"/api"}}`
+
+	for _, count := range []int{1, 100, 10000} {
+		spans := make([]string, count)
+		for i := range spans {
+			spans[i] = span
+		}
+		body := []byte("[" + strings.Join(spans, ",") + "]")
+
+		b.Run(fmt.Sprintf("%d spans", count), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			for i := 0; i < b.N; i++ {
+				if _, _, err := addTagsV2JSON(body, tagValues); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog"
+)
+
+// defaultKubeconfig is used outside of a cluster when no kubeconfig is
+// configured. It's a variable so that tests can change it.
+var defaultKubeconfig = clientcmd.RecommendedHomeFile
+
+// CreateRestConfig returns the config to connect to the API server with. The
+// in-cluster config is used unless a kubeconfig or a context is configured.
+// Outside of a cluster, ~/.kube/config is used instead.
+func CreateRestConfig(cfg Config) (*rest.Config, error) {
+	if cfg.Kubeconfig == "" && cfg.KubeContext == "" {
+		config, err := rest.InClusterConfig()
+		if err != rest.ErrNotInCluster {
+			return config, err
+		}
+		klog.Infof("Not running in a cluster, using %s", defaultKubeconfig)
+	}
+	return loadKubeconfig(cfg.Kubeconfig, cfg.KubeContext)
+}
+
+// loadKubeconfig loads the config of the context, or of the current context
+// when it's empty. kubeconfig can be a list of files like KUBECONFIG, which
+// are merged. A single file has to exist.
+func loadKubeconfig(kubeconfig, context string) (*rest.Config, error) {
+	rules := &clientcmd.ClientConfigLoadingRules{}
+	paths := filepath.SplitList(kubeconfig)
+	switch len(paths) {
+	case 0:
+		rules.ExplicitPath = defaultKubeconfig
+	case 1:
+		rules.ExplicitPath = paths[0]
+	default:
+		rules.Precedence = paths
+	}
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
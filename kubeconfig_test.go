@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+current-context: dev
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com
+- name: prod
+  cluster:
+    server: https://prod.example.com
+users:
+- name: developer
+  user:
+    token: secret
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: developer
+- name: prod
+  context:
+    cluster: prod
+    user: developer
+`
+
+func writeKubeconfig(g *WithT, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	g.Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(Succeed())
+	return path
+}
+
+func TestLoadKubeconfig(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "zipkates-kubeconfig")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	kubeconfig := writeKubeconfig(g, dir, "config", testKubeconfig)
+
+	t.Run("Current context", func(t *testing.T) {
+		g := NewWithT(t)
+
+		config, err := loadKubeconfig(kubeconfig, "")
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(config.Host).To(Equal("https://dev.example.com"))
+		g.Expect(config.BearerToken).To(Equal("secret"))
+	})
+
+	t.Run("Selected context", func(t *testing.T) {
+		g := NewWithT(t)
+
+		config, err := loadKubeconfig(kubeconfig, "prod")
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(config.Host).To(Equal("https://prod.example.com"))
+	})
+
+	t.Run("Unknown context", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := loadKubeconfig(kubeconfig, "staging")
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := loadKubeconfig(filepath.Join(dir, "missing"), "")
+
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("A list of files", func(t *testing.T) {
+		g := NewWithT(t)
+
+		override := writeKubeconfig(g, dir, "override", "apiVersion: v1\nkind: Config\ncurrent-context: prod\n")
+		config, err := loadKubeconfig(override+string(filepath.ListSeparator)+kubeconfig, "")
+
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(config.Host).To(Equal("https://prod.example.com"))
+	})
+}
+
+func TestCreateRestConfigOutsideCluster(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "zipkates-kubeconfig")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	originalDefault := defaultKubeconfig
+	defer func() { defaultKubeconfig = originalDefault }()
+	defaultKubeconfig = writeKubeconfig(g, dir, "config", testKubeconfig)
+	serviceHost, inCluster := os.LookupEnv("KUBERNETES_SERVICE_HOST")
+	os.Unsetenv("KUBERNETES_SERVICE_HOST")
+	if inCluster {
+		defer os.Setenv("KUBERNETES_SERVICE_HOST", serviceHost)
+	}
+
+	config, err := CreateRestConfig(DefaultConfig)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config.Host).To(Equal("https://dev.example.com"))
+
+	cfg := DefaultConfig
+	cfg.KubeContext = "prod"
+	config, err = CreateRestConfig(cfg)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(config.Host).To(Equal("https://prod.example.com"))
+}
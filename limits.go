@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"k8s.io/klog"
+)
+
+// isBodyTooLarge returns whether the error is from reading a body wrapped in
+// http.MaxBytesReader past its limit.
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "http: request body too large")
+}
+
+// readRequestBody reads the whole body of a request of up to
+// cfg.MaxBodySize bytes. If reading fails, it responds with 413 Request Entity
+// Too Large for bodies that are too large, or with 400 Bad Request otherwise,
+// and returns false.
+func readRequestBody(w http.ResponseWriter, req *http.Request, cfg Config) ([]byte, bool) {
+	if req.ContentLength > cfg.MaxBodySize {
+		http.Error(w, fmt.Sprintf("Request body is larger than %d bytes", cfg.MaxBodySize), http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, cfg.MaxBodySize))
+	if isBodyTooLarge(err) {
+		http.Error(w, fmt.Sprintf("Request body is larger than %d bytes", cfg.MaxBodySize), http.StatusRequestEntityTooLarge)
+		return nil, false
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read request body: %s", err), http.StatusBadRequest)
+		return nil, false
+	}
+	return body, true
+}
+
+// prependBody returns a body that returns the bytes that were already read
+// from the body before the rest of it.
+func prependBody(read []byte, body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(read), body), body}
+}
+
+type requestSlotsKey struct{}
+
+// CreateRequestLimitHandler rejects POST requests with bodies larger than
+// cfg.MaxBodySize and limits how many of their bodies are processed at the
+// same time. The slots are taken with acquireRequestSlot while a body is
+// read, decompressed and rewritten, so that only up to
+// cfg.MaxConcurrentRequests bodies are held in memory at the same time, while
+// requests that are proxied or exported don't hold a slot.
+func CreateRequestLimitHandler(cfg Config, next http.Handler) http.HandlerFunc {
+	var slots chan struct{}
+	if cfg.MaxConcurrentRequests > 0 {
+		slots = make(chan struct{}, cfg.MaxConcurrentRequests)
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if req.ContentLength > cfg.MaxBodySize {
+			http.Error(w, fmt.Sprintf("Request body is larger than %d bytes", cfg.MaxBodySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, cfg.MaxBodySize)
+		if slots != nil {
+			req = req.WithContext(context.WithValue(req.Context(), requestSlotsKey{}, slots))
+		}
+		next.ServeHTTP(w, req)
+	}
+}
+
+// acquireRequestSlot waits for a free slot of CreateRequestLimitHandler
+// before the body of the request is read. The returned function releases the
+// slot and can be called more than once. It returns false when the request is
+// canceled while waiting.
+func acquireRequestSlot(req *http.Request) (func(), bool) {
+	slots, _ := req.Context().Value(requestSlotsKey{}).(chan struct{})
+	if slots == nil {
+		return func() {}, true
+	}
+	select {
+	case slots <- struct{}{}:
+		var once sync.Once
+		return func() { once.Do(func() { <-slots }) }, true
+	case <-req.Context().Done():
+		if klog.V(1) {
+			klog.Infof("Request was canceled while waiting for a free slot")
+		}
+		return nil, false
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+)
+
+// chunkedBody hides the length of the body, like a body sent with chunked
+// transfer encoding.
+type chunkedBody struct {
+	body *strings.Reader
+}
+
+func (b chunkedBody) Read(p []byte) (int, error) {
+	return b.body.Read(p)
+}
+
+func limitedProxy(g *WithT, zipkin *httptest.Server, cfg Config) http.Handler {
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+	zipkinURL, err := parseZipkinURL(zipkin.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+	cfg.ZipkinURL = zipkinURL
+	return CreateRequestLimitHandler(cfg, &httputil.ReverseProxy{
+		Director:     CreateDirector(CreateKubernetesProvider(indexer), cfg),
+		ErrorHandler: proxyErrorHandler,
+	})
+}
+
+func TestMaxBodySize(t *testing.T) {
+	body := fmt.Sprintf("[%s]", span(NewWithT(t), map[string]string{}))
+	cases := []struct {
+		name string
+		req  *http.Request
+	}{
+		{"With Content-Length", httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader(body))},
+		{"Without Content-Length", httptest.NewRequest("POST", "/api/v2/spans", chunkedBody{strings.NewReader(body)})},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			zipkin, received := fakeZipkin(http.StatusAccepted)
+			defer zipkin.Close()
+			cfg := DefaultConfig
+			cfg.MaxBodySize = int64(len(body) - 1)
+
+			recorder := httptest.NewRecorder()
+			limitedProxy(g, zipkin, cfg).ServeHTTP(recorder, c.req)
+
+			g.Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			g.Expect(received).NotTo(Receive())
+		})
+	}
+}
+
+func TestPassThroughBodySize(t *testing.T) {
+	body := fmt.Sprintf("[%s]", span(NewWithT(t), map[string]string{}))
+	cases := []struct {
+		name      string
+		threshold int
+		req       *http.Request
+		enriched  bool
+	}{
+		{"Small with Content-Length", len(body), httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader(body)), true},
+		{"Large with Content-Length", len(body) - 1, httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader(body)), false},
+		{"Small without Content-Length", len(body), httptest.NewRequest("POST", "/api/v2/spans", chunkedBody{strings.NewReader(body)}), true},
+		{"Large without Content-Length", len(body) - 1, httptest.NewRequest("POST", "/api/v2/spans", chunkedBody{strings.NewReader(body)}), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			zipkin, received := fakeZipkin(http.StatusAccepted)
+			defer zipkin.Close()
+			cfg := DefaultConfig
+			cfg.PassThroughBodySize = int64(c.threshold)
+
+			recorder := httptest.NewRecorder()
+			limitedProxy(g, zipkin, cfg).ServeHTTP(recorder, c.req)
+
+			g.Expect(recorder.Code).To(Equal(http.StatusAccepted))
+			forwarded := <-received
+			if c.enriched {
+				g.Expect(gjson.GetBytes(forwarded, "0.tags.owner").String()).To(Equal("from_label"))
+			} else {
+				g.Expect(string(forwarded)).To(Equal(body))
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := DefaultConfig
+	cfg.MaxConcurrentRequests = 1
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	handler := CreateRequestLimitHandler(cfg, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		releaseSlot, ok := acquireRequestSlot(req)
+		g.Expect(ok).To(BeTrue())
+		defer releaseSlot()
+		started <- struct{}{}
+		<-release
+	}))
+
+	done := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			handler(httptest.NewRecorder(), spansRequest(g))
+			done <- struct{}{}
+		}()
+	}
+
+	g.Eventually(started).Should(Receive())
+	g.Consistently(started, 50*time.Millisecond).ShouldNot(Receive())
+	release <- struct{}{}
+	g.Eventually(started).Should(Receive())
+	release <- struct{}{}
+	<-done
+	<-done
+}
+
+func TestMaxConcurrentRequestsReleasedBeforeProxying(t *testing.T) {
+	g := NewWithT(t)
+
+	release := make(chan struct{})
+	received := make(chan []byte, 2)
+	zipkin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- body
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer zipkin.Close()
+	defer close(release)
+	cfg := DefaultConfig
+	cfg.MaxConcurrentRequests = 1
+	handler := limitedProxy(g, zipkin, cfg)
+
+	for i := 0; i < 2; i++ {
+		go handler.ServeHTTP(httptest.NewRecorder(), spansRequest(g))
+	}
+
+	// Both requests reach Zipkin while the first one is still waiting for
+	// its response
+	g.Eventually(received).Should(Receive())
+	g.Eventually(received).Should(Receive())
+}
+
+func TestHandlerMaxBodySize(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := DefaultConfig
+	cfg.MaxBodySize = 10
+	req := httptest.NewRequest("POST", "/v1/traces", chunkedBody{strings.NewReader(otlpJSONRequest)})
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	CreateOTLPHandler(CreateKubernetesProvider(CreateIndexer()), cfg, CreateZipkinExporter(http.DefaultClient, cfg))(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusRequestEntityTooLarge))
+	body, err := ioutil.ReadAll(recorder.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(body)).To(ContainSubstring("larger than 10 bytes"))
+}
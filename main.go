@@ -2,19 +2,27 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog"
 )
@@ -25,16 +33,111 @@ const (
 )
 
 type Config struct {
-	LabelTagMapping map[string]string
-	ListenPort      int
-	ZipkinPort      int
+	LabelTagMapping            map[string]string
+	ListenPort                 int
+	ZipkinURL                  *url.URL
+	ZipkinMirrors              []zipkinMirror
+	MaxBodySize                int64
+	PassThroughBodySize        int64
+	MaxConcurrentRequests      int
+	MaxDecompressedBodySize    int64
+	RecompressBody             bool
+	JaegerAgentPort            int
+	UpstreamProtocol           string
+	OTLPEndpoint               string
+	AsyncForwarding            bool
+	QueueMaxBytes              int64
+	BatchMaxBytes              int64
+	BatchInterval              time.Duration
+	MaxRetries                 int
+	SpoolDir                   string
+	SpoolMaxBytes              int64
+	SpoolMaxAge                time.Duration
+	SpoolSegmentBytes          int64
+	CircuitBreakerFailures     int
+	CircuitBreakerOpenDuration time.Duration
+	CircuitBreakerProbes       int
+	TLSCertFile                string
+	TLSKeyFile                 string
+	TLSClientCAFile            string
+	TLSClientAuth              string
+	TLSTrustDomain             string
+	ShutdownGracePeriod        time.Duration
+	ShutdownDelay              time.Duration
+	ReadinessCheckZipkin       bool
+	PodCacheMaxStaleness       time.Duration
+	WatchNamespaces            []string
+	ExcludeNamespaces          []string
+	PodLabelSelector           string
+	PodFieldSelector           string
+	AgentMode                  bool
+	NodeName                   string
+	Kubeconfig                 string
+	KubeContext                string
+	MetadataProvider           string
+	MetadataFile               string
+	ClusterName                string
+	Clusters                   []kubernetesCluster
+	ClusterHeader              string
+	MetadataServerPort         int
+	MetadataServerURL          string
+	MetadataServerToken        string
+	MetadataServerCAFile       string
+	AdminToken                 string
 }
 
 var (
 	DefaultConfig = Config{
-		LabelTagMapping: map[string]string{"owner": "owner"},
-		ListenPort:      9411,
-		ZipkinPort:      9410,
+		LabelTagMapping:            map[string]string{"owner": "owner"},
+		ListenPort:                 9411,
+		ZipkinURL:                  zipkinPortURL(9410),
+		MaxBodySize:                32 * 1024 * 1024,
+		PassThroughBodySize:        0,
+		MaxConcurrentRequests:      64,
+		MaxDecompressedBodySize:    32 * 1024 * 1024,
+		RecompressBody:             false,
+		JaegerAgentPort:            0,
+		UpstreamProtocol:           upstreamProtocolZipkin,
+		OTLPEndpoint:               "http://127.0.0.1:4318/v1/traces",
+		AsyncForwarding:            false,
+		QueueMaxBytes:              64 * 1024 * 1024,
+		BatchMaxBytes:              1024 * 1024,
+		BatchInterval:              time.Second,
+		MaxRetries:                 5,
+		SpoolDir:                   "",
+		SpoolMaxBytes:              256 * 1024 * 1024,
+		SpoolMaxAge:                24 * time.Hour,
+		SpoolSegmentBytes:          8 * 1024 * 1024,
+		CircuitBreakerFailures:     5,
+		CircuitBreakerOpenDuration: 10 * time.Second,
+		CircuitBreakerProbes:       1,
+		TLSCertFile:                "",
+		TLSKeyFile:                 "",
+		TLSClientCAFile:            "",
+		TLSClientAuth:              tlsClientAuthRequire,
+		TLSTrustDomain:             "cluster.local",
+		ShutdownGracePeriod:        25 * time.Second,
+		ShutdownDelay:              5 * time.Second,
+		ReadinessCheckZipkin:       false,
+		PodCacheMaxStaleness:       0,
+		WatchNamespaces:            nil,
+		ExcludeNamespaces:          nil,
+		PodLabelSelector:           "",
+		PodFieldSelector:           "",
+		AgentMode:                  false,
+		NodeName:                   "",
+		Kubeconfig:                 "",
+		KubeContext:                "",
+		MetadataProvider:           metadataProviderKubernetes,
+		MetadataFile:               "",
+		ClusterName:                "",
+		Clusters:                   nil,
+		ClusterHeader:              "",
+		MetadataServerPort:         0,
+		MetadataServerURL:          "",
+		MetadataServerToken:        "",
+		MetadataServerCAFile:       "",
+		AdminToken:                 "",
 	}
 )
 
@@ -51,20 +154,25 @@ func podIpKeyFunc(obj interface{}) ([]string, error) {
 }
 
 func CreateIndexer() cache.Indexer {
-	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{ipIndex: podIpKeyFunc})
+	return cache.NewIndexer(cache.MetaNamespaceKeyFunc, podIndexers())
 }
 
-func getRequesterPod(indexer cache.Indexer, req *http.Request) (*v1.Pod, error) {
-	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
-	if err != nil {
-		return &v1.Pod{}, err
+// podIndexers returns the indexes that pods are looked up by.
+func podIndexers() cache.Indexers {
+	return cache.Indexers{
+		ipIndex:              podIpKeyFunc,
+		serviceAccountIndex:  podServiceAccountKeyFunc,
+		cache.NamespaceIndex: cache.MetaNamespaceIndexFunc,
 	}
-	podObjects, err := indexer.ByIndex(ipIndex, clientIP)
+}
+
+func getPodByIP(indexer cache.Indexer, ip string) (*v1.Pod, error) {
+	podObjects, err := indexer.ByIndex(ipIndex, ip)
 	if err != nil {
 		return &v1.Pod{}, err
 	}
 	if klog.V(1) {
-		klog.Infof("Found the following requester pod(s) for RemoteAddr \"%s\": %+v", req.RemoteAddr, podObjects)
+		klog.Infof("Found the following requester pod(s) for IP \"%s\": %+v", ip, podObjects)
 	}
 	if len(podObjects) < 1 {
 		return &v1.Pod{}, fmt.Errorf("Did not find any pod objects")
@@ -80,14 +188,143 @@ func getRequesterPod(indexer cache.Indexer, req *http.Request) (*v1.Pod, error)
 	return pod, nil
 }
 
-func CreateDirector(indexer cache.Indexer, cfg Config) func(req *http.Request) {
+// spanRewriter adds the given tag values to the spans encoded in body. It
+// returns the new body and whether any of the spans were modified.
+type spanRewriter func(body []byte, tagValues map[string]string) ([]byte, bool, error)
+
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeProtobuf = "application/x-protobuf"
+	contentTypeThrift   = "application/x-thrift"
+)
+
+// spanRewriters holds the span rewriter for each supported path and
+// Content-Type combination.
+var spanRewriters = map[string]map[string]spanRewriter{
+	"/api/v1/spans": {
+		contentTypeJSON:   addTagsV1JSON,
+		contentTypeThrift: addTagsV1Thrift,
+	},
+	"/api/v2/spans": {
+		contentTypeJSON:     addTagsV2JSON,
+		contentTypeProtobuf: addTagsV2Proto,
+	},
+}
+
+// getSpanRewriter picks the span rewriter based on the request path and
+// Content-Type header. Requests without a Content-Type are assumed to be JSON,
+// which is what Zipkin itself does.
+func getSpanRewriter(path string, header http.Header) (spanRewriter, error) {
+	rewriters, ok := spanRewriters[path]
+	if !ok {
+		return nil, fmt.Errorf("Only /api/v1/spans and /api/v2/spans requests are modified, got %s", path)
+	}
+	contentType, err := getSpansContentType(header)
+	if err != nil {
+		return nil, err
+	}
+	rewriter, ok := rewriters[contentType]
+	if !ok {
+		return nil, fmt.Errorf("Content-Type %s is not supported for %s", contentType, path)
+	}
+	return rewriter, nil
+}
+
+// getSpansContentType returns the media type of the spans, which defaults to
+// JSON.
+func getSpansContentType(header http.Header) (string, error) {
+	contentType := header.Get("Content-Type")
+	if contentType == "" {
+		return contentTypeJSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("Failed to parse Content-Type \"%s\": %w", contentType, err)
+	}
+	return mediaType, nil
+}
+
+// getTagValues maps the pod's labels to span tag values according to the
+// label to tag mapping. Labels that are not set on the pod are skipped. The
+// name of the pod's cluster is added as well, if it's known.
+func getTagValues(pod *v1.Pod, labelTagMapping map[string]string) map[string]string {
+	tagValues := map[string]string{}
+	for labelName, tagName := range labelTagMapping {
+		val := pod.ObjectMeta.Labels[labelName]
+		if klog.V(1) {
+			klog.Infof("Pod label %s value: \"%s\"", labelName, val)
+		}
+		if val == "" {
+			if klog.V(1) {
+				klog.Infof("Pod label %s not set", labelName)
+			}
+			continue
+		}
+		tagValues[tagName] = val
+	}
+	if clusterName := podClusterName(pod); clusterName != "" {
+		tagValues[clusterNameTag] = clusterName
+	}
+	return tagValues
+}
+
+// getRequestTagValues returns the tag values for the pod that sent the
+// request. The pod is identified by the client certificate if there is one
+// and by the IP otherwise. No tags are returned if the pod is not found.
+func getRequestTagValues(provider metadataProvider, req *http.Request, cfg Config) map[string]string {
+	if router, ok := provider.(requestRouter); ok {
+		provider = router.ForRequest(req)
+	}
+	if tagValues, ok := getClientCertificateTagValues(provider, req, cfg); ok {
+		return tagValues
+	}
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		klog.Errorf("Failed to parse RemoteAddr \"%s\": %s", req.RemoteAddr, err)
+		return map[string]string{}
+	}
+	return getIPTagValues(provider, clientIP, cfg)
+}
+
+// getIPTagValues returns the tag values for the pod with the given IP. Only
+// the cluster name is returned if the pod is not found, and only when the
+// cluster of the IP is known.
+func getIPTagValues(provider metadataProvider, ip string, cfg Config) map[string]string {
+	pod, err := provider.PodByIP(ip)
+	if err != nil {
+		if klog.V(1) {
+			klog.Infof("Failed to find pod: %s", err)
+		}
+		tagValues := map[string]string{}
+		// The cluster can still be known from the IP or the request
+		if locator, ok := provider.(clusterLocator); ok {
+			if clusterName := locator.ClusterForIP(ip); clusterName != "" {
+				tagValues[clusterNameTag] = clusterName
+			}
+		}
+		return tagValues
+	}
+	return getTagValues(pod, cfg.LabelTagMapping)
+}
+
+func CreateDirector(provider metadataProvider, cfg Config) func(req *http.Request) {
 	return func(req *http.Request) {
-		req.URL.Scheme = "http"
-		req.URL.Host = fmt.Sprintf("127.0.0.1:%d", cfg.ZipkinPort)
+		if cfg.ClusterHeader != "" {
+			// The header only routes the lookup and isn't meant for Zipkin
+			defer req.Header.Del(cfg.ClusterHeader)
+		}
+		// The span rewriter is picked by the path the client used, not by
+		// the path on Zipkin, which can have a prefix.
+		path := req.URL.Path
+		target := zipkinTarget(cfg, req.URL.Path)
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = target.Path
+		req.URL.RawPath = ""
+		req.Host = target.Host
 
 		if klog.V(1) {
 			klog.Infof("Got request: %+v", req)
-			klog.Infof("These are the pod IPs: %v", indexer.ListIndexFuncValues(ipIndex))
 		}
 		if req.Method != "POST" {
 			if klog.V(1) {
@@ -95,33 +332,14 @@ func CreateDirector(indexer cache.Indexer, cfg Config) func(req *http.Request) {
 			}
 			return
 		}
-		if req.URL.Path != "/api/v2/spans" {
-			if klog.V(1) {
-				klog.Infof("Ignoring path %s. Only /api/v2/spans requests are modified.", req.URL.Path)
-			}
-			return
-		}
-		pod, err := getRequesterPod(indexer, req)
+		rewriteSpans, err := getSpanRewriter(path, req.Header)
 		if err != nil {
 			if klog.V(1) {
-				klog.Infof("Failed to find pod: %s", err)
+				klog.Infof("Ignoring request: %s", err)
 			}
 			return
 		}
-		tagValues := map[string]string{}
-		for labelName, tagName := range cfg.LabelTagMapping {
-			val := pod.ObjectMeta.Labels[labelName]
-			if klog.V(1) {
-				klog.Infof("Pod label %s value: \"%s\"", labelName, val)
-			}
-			if val == "" {
-				if klog.V(1) {
-					klog.Infof("Pod label %s not set", labelName)
-				}
-				continue
-			}
-			tagValues[tagName] = val
-		}
+		tagValues := getRequestTagValues(provider, req, cfg)
 		if len(tagValues) == 0 {
 			if klog.V(1) {
 				klog.Infof("No labels set from mapping, continuing")
@@ -132,11 +350,39 @@ func CreateDirector(indexer cache.Indexer, cfg Config) func(req *http.Request) {
 			klog.Warningf("Request doesn't have a body, continuing")
 			return
 		}
-		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if cfg.PassThroughBodySize > 0 && req.ContentLength > cfg.PassThroughBodySize {
+			if klog.V(1) {
+				klog.Infof("Passing through body of %d bytes without adding tags", req.ContentLength)
+			}
+			return
+		}
+		// The slot is released when the director returns, before the
+		// request is proxied
+		release, ok := acquireRequestSlot(req)
+		if !ok {
+			return
+		}
+		defer release()
+		bodyReader := io.Reader(req.Body)
+		if cfg.PassThroughBodySize > 0 {
+			// Bodies without a Content-Length are only read up to the
+			// threshold, as they are passed through when they are larger.
+			bodyReader = io.LimitReader(req.Body, cfg.PassThroughBodySize+1)
+		}
+		bodyBytes, err := ioutil.ReadAll(bodyReader)
 		if err != nil {
 			klog.Error("Failed to read request body", err)
-			// Not sure if we can/should do anything here to fail gracefully
-			// without affecting the reverse proxy.
+			// Forward what was read followed by the rest of the body, so
+			// that the error is returned again when the body is forwarded
+			// and the request fails instead of being forwarded truncated.
+			req.Body = prependBody(bodyBytes, req.Body)
+			return
+		}
+		if cfg.PassThroughBodySize > 0 && int64(len(bodyBytes)) > cfg.PassThroughBodySize {
+			if klog.V(1) {
+				klog.Infof("Passing through body larger than %d bytes without adding tags", cfg.PassThroughBodySize)
+			}
+			req.Body = prependBody(bodyBytes, req.Body)
 			return
 		}
 		// If anything fails, then restore previous body. If we do any
@@ -147,38 +393,16 @@ func CreateDirector(indexer cache.Indexer, cfg Config) func(req *http.Request) {
 			req.Body = ioutil.NopCloser(bodyBuffer)
 			req.ContentLength = int64(bodyBuffer.Len())
 		}()
-		var spans []map[string]interface{}
-		if err = json.Unmarshal(bodyBytes, &spans); err != nil {
-			klog.Error("Failed to parse spans from request body", err)
+		contentEncoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+		spansBytes, err := decodeBody(bodyBytes, contentEncoding, cfg.MaxDecompressedBodySize)
+		if err != nil {
+			klog.Errorf("Failed to decompress request body: %s", err)
 			return
 		}
-		modified := false
-		for _, span := range spans {
-			tagsObj, ok := span["tags"]
-			if !ok {
-				if klog.V(1) {
-					klog.Infof("No tags were set for span, adding one tag: %+v", span)
-				}
-				span["tags"] = tagValues
-				modified = true
-				continue
-			}
-			tags, ok := tagsObj.(map[string]interface{})
-			if !ok {
-				klog.Errorf("Couldn't parse the tags: %+v", tagsObj)
-				klog.Errorf("The tags object type: %T", tagsObj)
-				continue
-			}
-			for tagName, value := range tagValues {
-				if tag, ok := tags[tagName]; ok && tag != "" {
-					if klog.V(1) {
-						klog.Infof("Tag %s is already set for the span, skipping: %+v", tagName, span)
-					}
-					continue
-				}
-				tags[tagName] = value
-				modified = true
-			}
+		newSpansBytes, modified, err := rewriteSpans(spansBytes, tagValues)
+		if err != nil {
+			klog.Errorf("Failed to add tags to spans from request body: %s", err)
+			return
 		}
 		if !modified {
 			if klog.V(1) {
@@ -186,12 +410,19 @@ func CreateDirector(indexer cache.Indexer, cfg Config) func(req *http.Request) {
 			}
 			return
 		}
-		// Overwrite the body to be used for the request.
-		bodyBytes, err = json.Marshal(spans)
+		if !cfg.RecompressBody {
+			// Overwrite the body to be used for the request.
+			req.Header.Del("Content-Encoding")
+			bodyBytes = newSpansBytes
+			return
+		}
+		newBodyBytes, err := encodeBody(newSpansBytes, contentEncoding)
 		if err != nil {
-			klog.Error("Failed to marshal new body", err)
+			klog.Errorf("Failed to compress request body: %s", err)
 			return
 		}
+		// Overwrite the body to be used for the request.
+		bodyBytes = newBodyBytes
 	}
 }
 
@@ -218,28 +449,426 @@ func ParseConfigFromEnv() (Config, error) {
 		cfg.ListenPort = listenPort
 	}
 
+	// ZIPKIN_PORT is kept for backwards compatibility. ZIPKIN_URL takes
+	// precedence if both are set.
 	zipkinPortEnv := os.Getenv("ZIPKIN_PORT")
 	if zipkinPortEnv != "" {
 		var zipkinPort int
 		if err := json.Unmarshal([]byte(zipkinPortEnv), &zipkinPort); err != nil {
 			return Config{}, fmt.Errorf("Failed to parse ZIPKIN_PORT env variable: %w", err)
 		}
-		cfg.ZipkinPort = zipkinPort
+		cfg.ZipkinURL = zipkinPortURL(zipkinPort)
 	}
 
-	return cfg, nil
-}
+	zipkinURLEnv := os.Getenv("ZIPKIN_URL")
+	if zipkinURLEnv != "" {
+		if zipkinPortEnv != "" {
+			klog.Warningf("Both ZIPKIN_URL and ZIPKIN_PORT are set, ignoring ZIPKIN_PORT")
+		}
+		zipkinURL, err := parseZipkinURL(zipkinURLEnv)
+		if err != nil {
+			return Config{}, fmt.Errorf("Failed to parse ZIPKIN_URL env variable: %w", err)
+		}
+		cfg.ZipkinURL = zipkinURL
+	}
 
-func healthzHandlerFunc(w http.ResponseWriter, req *http.Request) {
-	w.WriteHeader(200)
-	_, err := w.Write([]byte("ok"))
-	if err != nil {
-		klog.Error(err)
+	zipkinMirrorsEnv := os.Getenv("ZIPKIN_MIRRORS")
+	if zipkinMirrorsEnv != "" {
+		zipkinMirrors, err := parseZipkinMirrors(zipkinMirrorsEnv)
+		if err != nil {
+			return Config{}, fmt.Errorf("Failed to parse ZIPKIN_MIRRORS env variable: %w", err)
+		}
+		cfg.ZipkinMirrors = zipkinMirrors
+	}
+
+	maxBodySizeEnv := os.Getenv("MAX_BODY_SIZE")
+	if maxBodySizeEnv != "" {
+		var maxBodySize int64
+		if err := json.Unmarshal([]byte(maxBodySizeEnv), &maxBodySize); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse MAX_BODY_SIZE env variable: %w", err)
+		}
+		cfg.MaxBodySize = maxBodySize
+	}
+
+	passThroughBodySizeEnv := os.Getenv("PASS_THROUGH_BODY_SIZE")
+	if passThroughBodySizeEnv != "" {
+		var passThroughBodySize int64
+		if err := json.Unmarshal([]byte(passThroughBodySizeEnv), &passThroughBodySize); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse PASS_THROUGH_BODY_SIZE env variable: %w", err)
+		}
+		cfg.PassThroughBodySize = passThroughBodySize
+	}
+
+	maxConcurrentRequestsEnv := os.Getenv("MAX_CONCURRENT_REQUESTS")
+	if maxConcurrentRequestsEnv != "" {
+		var maxConcurrentRequests int
+		if err := json.Unmarshal([]byte(maxConcurrentRequestsEnv), &maxConcurrentRequests); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse MAX_CONCURRENT_REQUESTS env variable: %w", err)
+		}
+		cfg.MaxConcurrentRequests = maxConcurrentRequests
+	}
+
+	maxDecompressedBodySizeEnv := os.Getenv("MAX_DECOMPRESSED_BODY_SIZE")
+	if maxDecompressedBodySizeEnv != "" {
+		var maxDecompressedBodySize int64
+		if err := json.Unmarshal([]byte(maxDecompressedBodySizeEnv), &maxDecompressedBodySize); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse MAX_DECOMPRESSED_BODY_SIZE env variable: %w", err)
+		}
+		cfg.MaxDecompressedBodySize = maxDecompressedBodySize
+	}
+
+	recompressBodyEnv := os.Getenv("RECOMPRESS_BODY")
+	if recompressBodyEnv != "" {
+		var recompressBody bool
+		if err := json.Unmarshal([]byte(recompressBodyEnv), &recompressBody); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse RECOMPRESS_BODY env variable: %w", err)
+		}
+		cfg.RecompressBody = recompressBody
+	}
+
+	jaegerAgentPortEnv := os.Getenv("JAEGER_AGENT_PORT")
+	if jaegerAgentPortEnv != "" {
+		var jaegerAgentPort int
+		if err := json.Unmarshal([]byte(jaegerAgentPortEnv), &jaegerAgentPort); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse JAEGER_AGENT_PORT env variable: %w", err)
+		}
+		cfg.JaegerAgentPort = jaegerAgentPort
+	}
+
+	upstreamProtocolEnv := os.Getenv("UPSTREAM_PROTOCOL")
+	if upstreamProtocolEnv != "" {
+		if upstreamProtocolEnv != upstreamProtocolZipkin && upstreamProtocolEnv != upstreamProtocolOTLP {
+			return Config{}, fmt.Errorf("Failed to parse UPSTREAM_PROTOCOL env variable: expected %s or %s, got %s",
+				upstreamProtocolZipkin, upstreamProtocolOTLP, upstreamProtocolEnv)
+		}
+		cfg.UpstreamProtocol = upstreamProtocolEnv
+	}
+
+	otlpEndpointEnv := os.Getenv("OTLP_ENDPOINT")
+	if otlpEndpointEnv != "" {
+		if _, err := url.Parse(otlpEndpointEnv); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse OTLP_ENDPOINT env variable: %w", err)
+		}
+		cfg.OTLPEndpoint = otlpEndpointEnv
+	}
+
+	asyncForwardingEnv := os.Getenv("ASYNC_FORWARDING")
+	if asyncForwardingEnv != "" {
+		var asyncForwarding bool
+		if err := json.Unmarshal([]byte(asyncForwardingEnv), &asyncForwarding); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse ASYNC_FORWARDING env variable: %w", err)
+		}
+		if asyncForwarding && cfg.UpstreamProtocol != upstreamProtocolZipkin {
+			return Config{}, fmt.Errorf("ASYNC_FORWARDING is only supported with the %s upstream protocol", upstreamProtocolZipkin)
+		}
+		cfg.AsyncForwarding = asyncForwarding
+	}
+
+	queueMaxBytesEnv := os.Getenv("QUEUE_MAX_BYTES")
+	if queueMaxBytesEnv != "" {
+		var queueMaxBytes int64
+		if err := json.Unmarshal([]byte(queueMaxBytesEnv), &queueMaxBytes); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse QUEUE_MAX_BYTES env variable: %w", err)
+		}
+		cfg.QueueMaxBytes = queueMaxBytes
+	}
+
+	batchMaxBytesEnv := os.Getenv("BATCH_MAX_BYTES")
+	if batchMaxBytesEnv != "" {
+		var batchMaxBytes int64
+		if err := json.Unmarshal([]byte(batchMaxBytesEnv), &batchMaxBytes); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse BATCH_MAX_BYTES env variable: %w", err)
+		}
+		cfg.BatchMaxBytes = batchMaxBytes
+	}
+
+	batchIntervalEnv := os.Getenv("BATCH_INTERVAL")
+	if batchIntervalEnv != "" {
+		batchInterval, err := time.ParseDuration(batchIntervalEnv)
+		if err != nil {
+			return Config{}, fmt.Errorf("Failed to parse BATCH_INTERVAL env variable: %w", err)
+		}
+		cfg.BatchInterval = batchInterval
+	}
+
+	maxRetriesEnv := os.Getenv("MAX_RETRIES")
+	if maxRetriesEnv != "" {
+		var maxRetries int
+		if err := json.Unmarshal([]byte(maxRetriesEnv), &maxRetries); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse MAX_RETRIES env variable: %w", err)
+		}
+		cfg.MaxRetries = maxRetries
+	}
+
+	spoolDirEnv := os.Getenv("SPOOL_DIR")
+	if spoolDirEnv != "" {
+		if !cfg.AsyncForwarding {
+			return Config{}, fmt.Errorf("SPOOL_DIR requires ASYNC_FORWARDING to be enabled")
+		}
+		cfg.SpoolDir = spoolDirEnv
+	}
+
+	spoolMaxBytesEnv := os.Getenv("SPOOL_MAX_BYTES")
+	if spoolMaxBytesEnv != "" {
+		var spoolMaxBytes int64
+		if err := json.Unmarshal([]byte(spoolMaxBytesEnv), &spoolMaxBytes); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse SPOOL_MAX_BYTES env variable: %w", err)
+		}
+		cfg.SpoolMaxBytes = spoolMaxBytes
+	}
+
+	spoolMaxAgeEnv := os.Getenv("SPOOL_MAX_AGE")
+	if spoolMaxAgeEnv != "" {
+		spoolMaxAge, err := time.ParseDuration(spoolMaxAgeEnv)
+		if err != nil {
+			return Config{}, fmt.Errorf("Failed to parse SPOOL_MAX_AGE env variable: %w", err)
+		}
+		cfg.SpoolMaxAge = spoolMaxAge
+	}
+
+	spoolSegmentBytesEnv := os.Getenv("SPOOL_SEGMENT_BYTES")
+	if spoolSegmentBytesEnv != "" {
+		var spoolSegmentBytes int64
+		if err := json.Unmarshal([]byte(spoolSegmentBytesEnv), &spoolSegmentBytes); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse SPOOL_SEGMENT_BYTES env variable: %w", err)
+		}
+		cfg.SpoolSegmentBytes = spoolSegmentBytes
+	}
+
+	circuitBreakerFailuresEnv := os.Getenv("CIRCUIT_BREAKER_FAILURES")
+	if circuitBreakerFailuresEnv != "" {
+		var circuitBreakerFailures int
+		if err := json.Unmarshal([]byte(circuitBreakerFailuresEnv), &circuitBreakerFailures); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse CIRCUIT_BREAKER_FAILURES env variable: %w", err)
+		}
+		cfg.CircuitBreakerFailures = circuitBreakerFailures
+	}
+
+	circuitBreakerOpenDurationEnv := os.Getenv("CIRCUIT_BREAKER_OPEN_DURATION")
+	if circuitBreakerOpenDurationEnv != "" {
+		circuitBreakerOpenDuration, err := time.ParseDuration(circuitBreakerOpenDurationEnv)
+		if err != nil {
+			return Config{}, fmt.Errorf("Failed to parse CIRCUIT_BREAKER_OPEN_DURATION env variable: %w", err)
+		}
+		cfg.CircuitBreakerOpenDuration = circuitBreakerOpenDuration
+	}
+
+	circuitBreakerProbesEnv := os.Getenv("CIRCUIT_BREAKER_PROBES")
+	if circuitBreakerProbesEnv != "" {
+		var circuitBreakerProbes int
+		if err := json.Unmarshal([]byte(circuitBreakerProbesEnv), &circuitBreakerProbes); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse CIRCUIT_BREAKER_PROBES env variable: %w", err)
+		}
+		if circuitBreakerProbes < 1 {
+			return Config{}, fmt.Errorf("Failed to parse CIRCUIT_BREAKER_PROBES env variable: has to be at least 1, got %d", circuitBreakerProbes)
+		}
+		cfg.CircuitBreakerProbes = circuitBreakerProbes
+	}
+
+	cfg.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	cfg.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return Config{}, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE have to be set together")
+	}
+
+	cfg.TLSClientCAFile = os.Getenv("TLS_CLIENT_CA_FILE")
+	if cfg.TLSClientCAFile != "" && cfg.TLSCertFile == "" {
+		return Config{}, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE to be set")
+	}
+
+	tlsClientAuthEnv := os.Getenv("TLS_CLIENT_AUTH")
+	if tlsClientAuthEnv != "" {
+		if tlsClientAuthEnv != tlsClientAuthRequire && tlsClientAuthEnv != tlsClientAuthVerifyIfGiven {
+			return Config{}, fmt.Errorf("Failed to parse TLS_CLIENT_AUTH env variable: expected %s or %s, got %s",
+				tlsClientAuthRequire, tlsClientAuthVerifyIfGiven, tlsClientAuthEnv)
+		}
+		cfg.TLSClientAuth = tlsClientAuthEnv
+	}
+
+	tlsTrustDomainEnv := os.Getenv("TLS_TRUST_DOMAIN")
+	if tlsTrustDomainEnv != "" {
+		if strings.ContainsAny(tlsTrustDomainEnv, "/:") {
+			return Config{}, fmt.Errorf("Failed to parse TLS_TRUST_DOMAIN env variable: expected a trust domain like cluster.local, got %s", tlsTrustDomainEnv)
+		}
+		cfg.TLSTrustDomain = tlsTrustDomainEnv
+	}
+
+	shutdownGracePeriodEnv := os.Getenv("SHUTDOWN_GRACE_PERIOD")
+	if shutdownGracePeriodEnv != "" {
+		shutdownGracePeriod, err := time.ParseDuration(shutdownGracePeriodEnv)
+		if err != nil {
+			return Config{}, fmt.Errorf("Failed to parse SHUTDOWN_GRACE_PERIOD env variable: %w", err)
+		}
+		cfg.ShutdownGracePeriod = shutdownGracePeriod
+	}
+
+	shutdownDelayEnv := os.Getenv("SHUTDOWN_DELAY")
+	if shutdownDelayEnv != "" {
+		shutdownDelay, err := time.ParseDuration(shutdownDelayEnv)
+		if err != nil {
+			return Config{}, fmt.Errorf("Failed to parse SHUTDOWN_DELAY env variable: %w", err)
+		}
+		cfg.ShutdownDelay = shutdownDelay
+	}
+	if cfg.ShutdownDelay >= cfg.ShutdownGracePeriod {
+		return Config{}, fmt.Errorf("SHUTDOWN_DELAY (%s) has to be shorter than SHUTDOWN_GRACE_PERIOD (%s)",
+			cfg.ShutdownDelay, cfg.ShutdownGracePeriod)
+	}
+
+	readinessCheckZipkinEnv := os.Getenv("READINESS_CHECK_ZIPKIN")
+	if readinessCheckZipkinEnv != "" {
+		var readinessCheckZipkin bool
+		if err := json.Unmarshal([]byte(readinessCheckZipkinEnv), &readinessCheckZipkin); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse READINESS_CHECK_ZIPKIN env variable: %w", err)
+		}
+		if readinessCheckZipkin && cfg.UpstreamProtocol != upstreamProtocolZipkin {
+			return Config{}, fmt.Errorf("READINESS_CHECK_ZIPKIN is only supported with the %s upstream protocol", upstreamProtocolZipkin)
+		}
+		cfg.ReadinessCheckZipkin = readinessCheckZipkin
+	}
+
+	podCacheMaxStalenessEnv := os.Getenv("POD_CACHE_MAX_STALENESS")
+	if podCacheMaxStalenessEnv != "" {
+		podCacheMaxStaleness, err := time.ParseDuration(podCacheMaxStalenessEnv)
+		if err != nil {
+			return Config{}, fmt.Errorf("Failed to parse POD_CACHE_MAX_STALENESS env variable: %w", err)
+		}
+		cfg.PodCacheMaxStaleness = podCacheMaxStaleness
+	}
+
+	watchNamespacesEnv := os.Getenv("WATCH_NAMESPACES")
+	if watchNamespacesEnv != "" {
+		var watchNamespaces []string
+		if err := json.Unmarshal([]byte(watchNamespacesEnv), &watchNamespaces); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse WATCH_NAMESPACES env variable: %w", err)
+		}
+		cfg.WatchNamespaces = watchNamespaces
+	}
+
+	excludeNamespacesEnv := os.Getenv("EXCLUDE_NAMESPACES")
+	if excludeNamespacesEnv != "" {
+		var excludeNamespaces []string
+		if err := json.Unmarshal([]byte(excludeNamespacesEnv), &excludeNamespaces); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse EXCLUDE_NAMESPACES env variable: %w", err)
+		}
+		cfg.ExcludeNamespaces = excludeNamespaces
+	}
+	if len(cfg.WatchNamespaces) > 0 && len(watchedNamespaces(cfg)) == 0 {
+		return Config{}, fmt.Errorf("All namespaces in WATCH_NAMESPACES are excluded by EXCLUDE_NAMESPACES")
+	}
+
+	cfg.PodLabelSelector = os.Getenv("POD_LABEL_SELECTOR")
+	if _, err := labels.Parse(cfg.PodLabelSelector); err != nil {
+		return Config{}, fmt.Errorf("Failed to parse POD_LABEL_SELECTOR env variable: %w", err)
+	}
+
+	cfg.PodFieldSelector = os.Getenv("POD_FIELD_SELECTOR")
+	if _, err := fields.ParseSelector(cfg.PodFieldSelector); err != nil {
+		return Config{}, fmt.Errorf("Failed to parse POD_FIELD_SELECTOR env variable: %w", err)
+	}
+
+	agentModeEnv := os.Getenv("AGENT_MODE")
+	if agentModeEnv != "" {
+		var agentMode bool
+		if err := json.Unmarshal([]byte(agentModeEnv), &agentMode); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse AGENT_MODE env variable: %w", err)
+		}
+		cfg.AgentMode = agentMode
+	}
+	cfg.NodeName = os.Getenv("NODE_NAME")
+	if cfg.AgentMode {
+		if cfg.NodeName == "" {
+			return Config{}, fmt.Errorf("AGENT_MODE requires NODE_NAME to be set")
+		}
+		// The default of a Zipkin on localhost is never right for an agent
+		if cfg.UpstreamProtocol == upstreamProtocolZipkin && zipkinURLEnv == "" {
+			return Config{}, fmt.Errorf("AGENT_MODE requires ZIPKIN_URL to be set")
+		}
+	}
+
+	cfg.Kubeconfig = os.Getenv("KUBECONFIG")
+	cfg.KubeContext = os.Getenv("KUBE_CONTEXT")
+
+	metadataProviderEnv := os.Getenv("METADATA_PROVIDER")
+	if metadataProviderEnv != "" {
+		if metadataProviderEnv != metadataProviderKubernetes && metadataProviderEnv != metadataProviderFile &&
+			metadataProviderEnv != metadataProviderServer {
+			return Config{}, fmt.Errorf("Failed to parse METADATA_PROVIDER env variable: expected %s, %s or %s, got %s",
+				metadataProviderKubernetes, metadataProviderFile, metadataProviderServer, metadataProviderEnv)
+		}
+		cfg.MetadataProvider = metadataProviderEnv
+	}
+	cfg.MetadataFile = os.Getenv("METADATA_FILE")
+	if (cfg.MetadataProvider == metadataProviderFile) != (cfg.MetadataFile != "") {
+		return Config{}, fmt.Errorf("METADATA_FILE has to be set if and only if METADATA_PROVIDER is %s", metadataProviderFile)
+	}
+	metadataServerURLEnv := os.Getenv("METADATA_SERVER_URL")
+	if metadataServerURLEnv != "" {
+		metadataServerURL, err := url.Parse(metadataServerURLEnv)
+		if err != nil {
+			return Config{}, fmt.Errorf("Failed to parse METADATA_SERVER_URL env variable: %w", err)
+		}
+		if metadataServerURL.Scheme != "http" && metadataServerURL.Scheme != "https" {
+			return Config{}, fmt.Errorf("Failed to parse METADATA_SERVER_URL env variable: expected an http or https URL, got %s",
+				metadataServerURLEnv)
+		}
+		cfg.MetadataServerURL = strings.TrimSuffix(metadataServerURLEnv, "/")
+	}
+	if (cfg.MetadataProvider == metadataProviderServer) != (cfg.MetadataServerURL != "") {
+		return Config{}, fmt.Errorf("METADATA_SERVER_URL has to be set if and only if METADATA_PROVIDER is %s", metadataProviderServer)
 	}
+	metadataServerPortEnv := os.Getenv("METADATA_SERVER_PORT")
+	if metadataServerPortEnv != "" {
+		var metadataServerPort int
+		if err := json.Unmarshal([]byte(metadataServerPortEnv), &metadataServerPort); err != nil {
+			return Config{}, fmt.Errorf("Failed to parse METADATA_SERVER_PORT env variable: %w", err)
+		}
+		cfg.MetadataServerPort = metadataServerPort
+	}
+	if cfg.MetadataServerPort != 0 && cfg.MetadataProvider != metadataProviderKubernetes {
+		return Config{}, fmt.Errorf("METADATA_SERVER_PORT is only supported with the %s metadata provider", metadataProviderKubernetes)
+	}
+	cfg.MetadataServerToken = os.Getenv("METADATA_SERVER_TOKEN")
+	if (cfg.MetadataServerPort != 0 || cfg.MetadataProvider == metadataProviderServer) && cfg.MetadataServerToken == "" {
+		return Config{}, fmt.Errorf("METADATA_SERVER_TOKEN is required with METADATA_SERVER_PORT and the %s metadata provider", metadataProviderServer)
+	}
+	cfg.MetadataServerCAFile = os.Getenv("METADATA_SERVER_CA_FILE")
+	if cfg.MetadataServerCAFile != "" && cfg.MetadataProvider != metadataProviderServer {
+		return Config{}, fmt.Errorf("METADATA_SERVER_CA_FILE is only supported with the %s metadata provider", metadataProviderServer)
+	}
+	if cfg.MetadataProvider != metadataProviderKubernetes && cfg.AgentMode {
+		return Config{}, fmt.Errorf("AGENT_MODE is only supported with the %s metadata provider", metadataProviderKubernetes)
+	}
+
+	cfg.ClusterName = os.Getenv("CLUSTER_NAME")
+	clustersEnv := os.Getenv("CLUSTERS")
+	if clustersEnv != "" {
+		clusters, err := parseClusters(clustersEnv)
+		if err != nil {
+			return Config{}, fmt.Errorf("Failed to parse CLUSTERS env variable: %w", err)
+		}
+		if cfg.MetadataProvider != metadataProviderKubernetes {
+			return Config{}, fmt.Errorf("CLUSTERS is only supported with the %s metadata provider", metadataProviderKubernetes)
+		}
+		if cfg.ClusterName != "" {
+			return Config{}, fmt.Errorf("CLUSTER_NAME can't be set together with CLUSTERS, which names every cluster")
+		}
+		cfg.Clusters = clusters
+	}
+	cfg.ClusterHeader = os.Getenv("CLUSTER_HEADER")
+	if cfg.ClusterHeader != "" && len(cfg.Clusters) == 0 {
+		return Config{}, fmt.Errorf("CLUSTER_HEADER requires CLUSTERS to be set")
+	}
+
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+
+	return cfg, nil
 }
 
-func main() {
-	config, err := rest.InClusterConfig()
+// startKubernetesProvider starts watching the pods until stop is closed.
+// When events is not nil, the changes of the pods are published to it.
+func startKubernetesProvider(cfg Config, events *podEvents, stop <-chan struct{}) (metadataProvider, []*podCacheStore) {
+	config, err := CreateRestConfig(cfg)
 	if err != nil {
 		klog.Fatal(err)
 	}
@@ -250,27 +879,238 @@ func main() {
 		klog.Fatal(err)
 	}
 
-	podListWatcher := cache.NewListWatchFromClient(
-		clientset.CoreV1().RESTClient(),
-		"pods",
-		allNamespaces,
-		fields.Everything(),
-	)
-	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{ipIndex: podIpKeyFunc})
-	reflector := cache.NewReflector(podListWatcher, &v1.Pod{}, indexer, 10*time.Second)
+	if cfg.AgentMode {
+		klog.Infof("Running as an agent for the pods on node %s", cfg.NodeName)
+	}
+	if cfg.ClusterName != "" {
+		klog.Infof("Watching pods in cluster %s", cfg.ClusterName)
+	}
+	indexer := CreateIndexer()
+	if events != nil {
+		events.AddIndexer(indexer)
+	}
+	var podCaches []*podCacheStore
+	for _, namespace := range watchedNamespaces(cfg) {
+		podListWatcher := CreatePodListWatch(clientset.CoreV1().RESTClient(), namespace, cfg)
+		podCache := CreatePodCacheStore(indexer, namespace, cfg)
+		podCache.events = events
+		podCaches = append(podCaches, podCache)
+		reflector := cache.NewReflector(podListWatcher, &v1.Pod{}, podCache, 10*time.Second)
+		go reflector.Run(stop)
+	}
+	return CreateKubernetesProvider(indexer), podCaches
+}
 
-	// Now let's start the controller
-	stop := make(chan struct{})
-	defer close(stop)
-	go reflector.Run(stop)
+func main() {
+	kubeconfig := flag.String("kubeconfig", "", "The kubeconfig to use instead of the in-cluster config. Overrides KUBECONFIG.")
+	kubeContext := flag.String("context", "", "The kubeconfig context to use. Overrides KUBE_CONTEXT.")
+	flag.Parse()
 
 	cfg, err := ParseConfigFromEnv()
 	if err != nil {
 		klog.Fatal(err)
 	}
-	proxyHandler := &httputil.ReverseProxy{Director: CreateDirector(indexer, cfg)}
+	if *kubeconfig != "" {
+		cfg.Kubeconfig = *kubeconfig
+	}
+	if *kubeContext != "" {
+		cfg.KubeContext = *kubeContext
+	}
+
+	lc := CreateLifecycle(cfg)
+	readinessChecks := []healthCheck{shutdownHealthCheck(lc)}
+	stop := make(chan struct{})
+	var events *podEvents
+	if cfg.MetadataServerPort != 0 {
+		events = CreatePodEvents(cfg.LabelTagMapping)
+	}
+	var provider metadataProvider
+	if cfg.MetadataProvider == metadataProviderFile {
+		provider, err = CreateFileProvider(cfg.MetadataFile)
+		if err != nil {
+			klog.Fatal(err)
+		}
+	} else if cfg.MetadataProvider == metadataProviderServer {
+		serverProvider, err := CreateServerProvider(cfg)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		go serverProvider.Run(stop)
+		readinessChecks = append(readinessChecks, metadataServerHealthCheck(serverProvider))
+		provider = serverProvider
+	} else if len(cfg.Clusters) > 0 {
+		multiCluster := CreateMultiClusterProvider(cfg.ClusterHeader)
+		for _, cluster := range cfg.Clusters {
+			clusterCfg := cfg
+			clusterCfg.ClusterName = cluster.Name
+			clusterCfg.Kubeconfig = cluster.Kubeconfig
+			clusterCfg.KubeContext = cluster.KubeContext
+			clusterProvider, podCaches := startKubernetesProvider(clusterCfg, events, stop)
+			multiCluster.AddCluster(cluster, clusterProvider)
+			readinessChecks = append(readinessChecks, podCacheHealthCheck(cluster.Name, podCaches, cfg.PodCacheMaxStaleness))
+		}
+		provider = multiCluster
+	} else {
+		var podCaches []*podCacheStore
+		provider, podCaches = startKubernetesProvider(cfg, events, stop)
+		readinessChecks = append(readinessChecks, podCacheHealthCheck("", podCaches, cfg.PodCacheMaxStaleness))
+	}
+
 	mux := http.NewServeMux()
-	mux.Handle("/", proxyHandler)
-	mux.HandleFunc("/healthz", healthzHandlerFunc)
-	klog.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.ListenPort), mux))
+	metrics := CreateMetricsRegistry()
+	// Namespaced, so that Zipkin's own /metrics is still proxied
+	mux.Handle("/zipkates/metrics", metrics)
+	// The UDP listener has to be closed before the span queue is drained, so
+	// it's opened and registered before the queue is created
+	var jaegerAgentConn net.PacketConn
+	if cfg.JaegerAgentPort != 0 {
+		jaegerAgentConn, err = net.ListenPacket("udp", fmt.Sprintf(":%d", cfg.JaegerAgentPort))
+		if err != nil {
+			klog.Fatal(err)
+		}
+		lc.OnShutdown("Jaeger agent", func(context.Context) error {
+			return jaegerAgentConn.Close()
+		})
+	}
+	var exporter spanExporter
+	if cfg.UpstreamProtocol == upstreamProtocolOTLP {
+		upstreamClient := &http.Client{Timeout: 10 * time.Second}
+		exporter = CreateOTLPExporter(upstreamClient, cfg.OTLPEndpoint)
+		mux.Handle("/", CreateZipkinSpansHandler(provider, cfg, exporter))
+	} else {
+		zipkinTransport := CreateZipkinTransport(cfg, metrics)
+		upstreamClient := &http.Client{Timeout: 10 * time.Second, Transport: zipkinTransport}
+		if cfg.ReadinessCheckZipkin {
+			// Bypasses the circuit breaker, so that probes don't count as
+			// failed requests
+			healthClient := &http.Client{Transport: createUpstreamTransport(cfg.ZipkinURL)}
+			readinessChecks = append(readinessChecks, zipkinHealthCheck(healthClient, cfg))
+		}
+		var proxy http.Handler = &httputil.ReverseProxy{
+			Director:     CreateDirector(provider, cfg),
+			Transport:    zipkinTransport,
+			ErrorHandler: proxyErrorHandler,
+		}
+		if breaker := zipkinCircuitBreaker(zipkinTransport); breaker != nil {
+			proxy = CreateLoadSheddingHandler(breaker, proxy)
+		}
+		if cfg.AsyncForwarding {
+			queue := CreateZipkinSpanQueue(zipkinTransport, cfg)
+			queueStop := make(chan struct{})
+			var spool *spanSpool
+			if cfg.SpoolDir != "" {
+				spool, err = OpenSpanSpool(cfg, queue.send)
+				if err != nil {
+					klog.Fatal(err)
+				}
+				queue.spool = spool
+				go spool.Run(queueStop)
+			}
+			go queue.Run(queueStop)
+			lc.OnShutdown("span queue", func(ctx context.Context) error {
+				close(queueStop)
+				return queue.Wait(ctx)
+			})
+			if spool != nil {
+				// Spooled spans stay on disk and are replayed after a restart
+				lc.OnShutdown("spool", func(context.Context) error {
+					return spool.Close()
+				})
+			}
+			exporter = CreateQueuedZipkinExporter(queue)
+			mux.Handle("/", CreateAsyncHandler(provider, cfg, queue, proxy))
+		} else {
+			exporter = CreateZipkinExporter(upstreamClient, cfg)
+			mux.Handle("/", proxy)
+		}
+	}
+	mux.Handle("/v1/traces", CreateOTLPHandler(provider, cfg, exporter))
+	mux.Handle("/api/traces", CreateJaegerHandler(provider, cfg, exporter))
+	readyz := CreateReadyzHandler(readinessChecks...)
+	mux.Handle("/readyz", readyz)
+	// Kept for existing readiness probes
+	mux.Handle("/healthz", readyz)
+	mux.HandleFunc("/livez", livezHandlerFunc)
+	if cfg.AdminToken != "" {
+		mux.Handle("/admin/tags", CreateAdminTagsHandler(provider, cfg))
+	}
+
+	if jaegerAgentConn != nil {
+		go func() {
+			err := ServeJaegerAgent(jaegerAgentConn, provider, cfg, exporter)
+			if !lc.ShuttingDown() {
+				klog.Fatal(err)
+			}
+		}()
+	}
+	if events != nil {
+		metadataServer := &http.Server{
+			Addr:    fmt.Sprintf(":%d", cfg.MetadataServerPort),
+			Handler: CreateMetadataServerHandler(provider, events, cfg.MetadataServerToken),
+		}
+		if cfg.TLSCertFile != "" {
+			// Clients authenticate with the token, not with certificates
+			metadataTLSCfg := cfg
+			metadataTLSCfg.TLSClientCAFile = ""
+			tlsReloader, err := CreateTLSReloader(metadataTLSCfg)
+			if err != nil {
+				klog.Fatal(err)
+			}
+			metadataServer.TLSConfig = tlsReloader.TLSConfig()
+		}
+		lc.OnShutdown("metadata server", func(ctx context.Context) error {
+			// Watches only end when their events are closed
+			events.Close()
+			return metadataServer.Shutdown(ctx)
+		})
+		go func() {
+			var err error
+			if metadataServer.TLSConfig != nil {
+				err = metadataServer.ListenAndServeTLS("", "")
+			} else {
+				err = metadataServer.ListenAndServe()
+			}
+			if !lc.ShuttingDown() {
+				klog.Fatal(err)
+			}
+		}()
+	}
+	lc.OnShutdown("pod watches", func(context.Context) error {
+		close(stop)
+		return nil
+	})
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", cfg.ListenPort),
+		Handler: CreateRequestLimitHandler(cfg, mux),
+	}
+	if cfg.TLSCertFile != "" {
+		tlsReloader, err := CreateTLSReloader(cfg)
+		if err != nil {
+			klog.Fatal(err)
+		}
+		server.TLSConfig = tlsReloader.TLSConfig()
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			serveErr <- server.ListenAndServeTLS("", "")
+		} else {
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-serveErr:
+		klog.Fatal(err)
+	case sig := <-signals:
+		klog.Infof("Received %s, shutting down", sig)
+	}
+	err = lc.Shutdown(server)
+	klog.Flush()
+	if err != nil {
+		os.Exit(1)
+	}
 }
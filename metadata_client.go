@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+const (
+	// metadataWatchTimeout is how long the watch may go without any event,
+	// including heartbeats, before it's considered broken.
+	metadataWatchTimeout = 2 * metadataWatchHeartbeat
+	// metadataWatchRetryInterval is how long to wait before reconnecting to
+	// the metadata server.
+	metadataWatchRetryInterval = 5 * time.Second
+)
+
+// serverProvider looks up pods in a local cache of the pods that a metadata
+// server watches, so that only the server puts load on the API server. No pods
+// are found until the cache has been filled, which readiness waits for.
+type serverProvider struct {
+	url             string
+	token           string
+	labelTagMapping map[string]string
+	client          *http.Client
+	indexer         cache.Indexer
+	// synced is 1 once all pods have been received from the server
+	synced int32
+}
+
+// CreateServerProvider creates the provider for the metadata server in the
+// configuration. Its certificate is verified with cfg.MetadataServerCAFile
+// if it's set and with the system's CAs otherwise.
+func CreateServerProvider(cfg Config) (*serverProvider, error) {
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if cfg.MetadataServerCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.MetadataServerCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read metadata server CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in %s", cfg.MetadataServerCAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &serverProvider{
+		url:             cfg.MetadataServerURL,
+		token:           cfg.MetadataServerToken,
+		labelTagMapping: cfg.LabelTagMapping,
+		client:          &http.Client{Transport: transport},
+		indexer:         cache.NewIndexer(clusterPodKeyFunc, podIndexers()),
+	}, nil
+}
+
+// clusterPodKeyFunc is the key of a pod in the local cache. Pods from
+// different clusters can have the same namespace and name.
+func clusterPodKeyFunc(obj interface{}) (string, error) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		return "", err
+	}
+	if pod, ok := obj.(*v1.Pod); ok {
+		if clusterName := podClusterName(pod); clusterName != "" {
+			return clusterName + "/" + key, nil
+		}
+	}
+	return key, nil
+}
+
+// Synced returns whether all pods have been received from the server.
+func (p *serverProvider) Synced() bool {
+	return atomic.LoadInt32(&p.synced) == 1
+}
+
+// Run keeps the local cache up to date until stop is closed. Broken watches
+// are restarted and get all pods again.
+func (p *serverProvider) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+	for {
+		err := p.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		klog.Errorf("Watching the metadata server failed, retrying in %s: %s", metadataWatchRetryInterval, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(metadataWatchRetryInterval):
+		}
+	}
+}
+
+func (p *serverProvider) watch(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequest("GET", p.url+"/watch", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+p.token)
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", req.URL, resp.Status)
+	}
+
+	// Cancelling the request is the only way to stop a blocked read
+	var timedOut int32
+	timeout := time.AfterFunc(metadataWatchTimeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+	defer timeout.Stop()
+	decoder := json.NewDecoder(resp.Body)
+	var initial []interface{}
+	synced := false
+	for {
+		var event podEvent
+		if err := decoder.Decode(&event); err != nil {
+			if atomic.LoadInt32(&timedOut) == 1 {
+				return fmt.Errorf("No events received for %s", metadataWatchTimeout)
+			}
+			return err
+		}
+		timeout.Reset(metadataWatchTimeout)
+
+		switch event.Type {
+		case podEventAdded, podEventModified:
+			if event.Pod == nil {
+				continue
+			}
+			if !synced {
+				initial = append(initial, event.Pod)
+			} else if err := p.indexer.Update(event.Pod); err != nil {
+				return err
+			}
+		case podEventDeleted:
+			// Only changes after the initial pods are deleted
+			if event.Pod == nil || !synced {
+				continue
+			}
+			if err := p.indexer.Delete(event.Pod); err != nil {
+				return err
+			}
+		case podEventSynced:
+			if err := p.checkLabels(event.Labels); err != nil {
+				return err
+			}
+			if err := p.indexer.Replace(initial, ""); err != nil {
+				return err
+			}
+			initial = nil
+			synced = true
+			if !p.Synced() {
+				klog.Infof("Received %d pods from the metadata server", len(p.indexer.ListKeys()))
+			}
+			atomic.StoreInt32(&p.synced, 1)
+		}
+	}
+}
+
+// checkLabels returns an error when the server drops labels that are mapped
+// to tags here, as spans would silently miss those tags.
+func (p *serverProvider) checkLabels(labels []string) error {
+	kept := make(map[string]bool, len(labels))
+	for _, label := range labels {
+		kept[label] = true
+	}
+	var missing []string
+	for label := range p.labelTagMapping {
+		if !kept[label] {
+			missing = append(missing, label)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("The metadata server doesn't keep the labels %v that LABEL_TAG_MAPPING maps to tags", missing)
+	}
+	return nil
+}
+
+func (p *serverProvider) PodByIP(ip string) (*v1.Pod, error) {
+	if !p.Synced() {
+		return nil, errors.New("Pods have not been received from the metadata server yet")
+	}
+	return getPodByIP(p.indexer, ip)
+}
+
+func (p *serverProvider) PodsByIdentity(identity podIdentity) ([]*v1.Pod, error) {
+	var objects []interface{}
+	var err error
+	if identity.pod != "" {
+		objects, err = p.indexer.ByIndex(cache.NamespaceIndex, identity.namespace)
+	} else {
+		objects, err = p.indexer.ByIndex(serviceAccountIndex, identity.namespace+"/"+identity.serviceAccount)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pods []*v1.Pod
+	for _, obj := range objects {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			return nil, fmt.Errorf("%+v is not a v1.Pod", obj)
+		}
+		if identity.pod == "" || pod.Name == identity.pod {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
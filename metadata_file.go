@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/klog"
+)
+
+// metadataFileReloadInterval is how often the metadata file is checked for
+// changes at most.
+const metadataFileReloadInterval = 10 * time.Second
+
+// metadataFileContents is the format of the metadata file.
+type metadataFileContents struct {
+	Pods []metadataFilePod `json:"pods"`
+}
+
+// metadataFilePod is a workload in the metadata file. It's matched either by
+// its IP or by a CIDR that contains the IP.
+type metadataFilePod struct {
+	Name           string            `json:"name"`
+	Namespace      string            `json:"namespace"`
+	Cluster        string            `json:"cluster"`
+	ServiceAccount string            `json:"serviceAccount"`
+	IP             string            `json:"ip"`
+	CIDR           string            `json:"cidr"`
+	Labels         map[string]string `json:"labels"`
+	Annotations    map[string]string `json:"annotations"`
+}
+
+type cidrPod struct {
+	network *net.IPNet
+	pod     *v1.Pod
+}
+
+// fileMetadata is the parsed metadata file.
+type fileMetadata struct {
+	pods  []*v1.Pod
+	byIP  map[string]*v1.Pod
+	cidrs []cidrPod
+}
+
+// fileProvider looks up pods in a YAML or JSON file, e.g. for services that
+// run in docker-compose. The file is reloaded when it changes. If reloading
+// fails, the previously loaded file keeps being used.
+type fileProvider struct {
+	path string
+	// now is a field so that tests can skip the reload interval
+	now func() time.Time
+
+	mu        sync.Mutex
+	metadata  *fileMetadata
+	modTime   time.Time
+	size      int64
+	lastCheck time.Time
+}
+
+// CreateFileProvider loads the metadata file.
+func CreateFileProvider(path string) (*fileProvider, error) {
+	p := &fileProvider{path: path, now: time.Now}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.load(info); err != nil {
+		return nil, err
+	}
+	p.lastCheck = p.now()
+	return p, nil
+}
+
+func (p *fileProvider) PodByIP(ip string) (*v1.Pod, error) {
+	metadata := p.current()
+	if pod, ok := metadata.byIP[ip]; ok {
+		return pod, nil
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, fmt.Errorf("Invalid IP %s", ip)
+	}
+	// The CIDRs are sorted from the most specific to the least specific
+	for _, c := range metadata.cidrs {
+		if c.network.Contains(parsed) {
+			return c.pod, nil
+		}
+	}
+	return nil, fmt.Errorf("Did not find any pod for IP %s in %s", ip, p.path)
+}
+
+func (p *fileProvider) PodsByIdentity(identity podIdentity) ([]*v1.Pod, error) {
+	var pods []*v1.Pod
+	for _, pod := range p.current().pods {
+		if pod.Namespace != identity.namespace {
+			continue
+		}
+		if (identity.pod != "" && pod.Name == identity.pod) ||
+			(identity.serviceAccount != "" && pod.Spec.ServiceAccountName == identity.serviceAccount) {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// current returns the current metadata after reloading the file if it
+// changed since it was loaded.
+func (p *fileProvider) current() *fileMetadata {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	if now.Sub(p.lastCheck) < metadataFileReloadInterval {
+		return p.metadata
+	}
+	p.lastCheck = now
+	info, err := os.Stat(p.path)
+	if err != nil {
+		klog.Errorf("Failed to check metadata file for changes: %s", err)
+		return p.metadata
+	}
+	if info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return p.metadata
+	}
+	if err := p.load(info); err != nil {
+		klog.Errorf("Failed to reload metadata file, using the previous one: %s", err)
+	} else {
+		klog.Infof("Reloaded metadata file %s", p.path)
+	}
+	return p.metadata
+}
+
+// load loads the file. It has to be called with the lock held, or before the
+// provider is used.
+func (p *fileProvider) load(info os.FileInfo) error {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata file: %w", err)
+	}
+	metadata, err := parseMetadataFile(data)
+	if err != nil {
+		return fmt.Errorf("Failed to parse metadata file %s: %w", p.path, err)
+	}
+	p.metadata = metadata
+	p.modTime = info.ModTime()
+	p.size = info.Size()
+	return nil
+}
+
+func parseMetadataFile(data []byte) (*fileMetadata, error) {
+	var contents metadataFileContents
+	if err := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(data), 4096).Decode(&contents); err != nil {
+		return nil, err
+	}
+	metadata := &fileMetadata{byIP: map[string]*v1.Pod{}}
+	cidrs := map[string]bool{}
+	for i, entry := range contents.Pods {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        entry.Name,
+				Namespace:   entry.Namespace,
+				Labels:      entry.Labels,
+				Annotations: entry.Annotations,
+			},
+			Spec:   v1.PodSpec{ServiceAccountName: entry.ServiceAccount},
+			Status: v1.PodStatus{PodIP: entry.IP},
+		}
+		setPodClusterName(pod, entry.Cluster)
+		switch {
+		case entry.IP != "" && entry.CIDR != "":
+			return nil, fmt.Errorf("Pod %d has both an ip and a cidr", i)
+		case entry.IP != "":
+			ip := net.ParseIP(entry.IP)
+			if ip == nil {
+				return nil, fmt.Errorf("Pod %d has an invalid ip %s", i, entry.IP)
+			}
+			// Lookups use the IP as it's formatted in remote addresses
+			key := ip.String()
+			if _, ok := metadata.byIP[key]; ok {
+				return nil, fmt.Errorf("Pod %d has the same ip %s as another pod", i, entry.IP)
+			}
+			metadata.byIP[key] = pod
+		case entry.CIDR != "":
+			_, network, err := net.ParseCIDR(entry.CIDR)
+			if err != nil {
+				return nil, fmt.Errorf("Pod %d has an invalid cidr: %w", i, err)
+			}
+			if cidrs[network.String()] {
+				return nil, fmt.Errorf("Pod %d has the same cidr %s as another pod", i, entry.CIDR)
+			}
+			cidrs[network.String()] = true
+			metadata.cidrs = append(metadata.cidrs, cidrPod{network: network, pod: pod})
+		default:
+			return nil, fmt.Errorf("Pod %d has neither an ip nor a cidr", i)
+		}
+		metadata.pods = append(metadata.pods, pod)
+	}
+	sort.SliceStable(metadata.cidrs, func(i, j int) bool {
+		iOnes, _ := metadata.cidrs[i].network.Mask.Size()
+		jOnes, _ := metadata.cidrs[j].network.Mask.Size()
+		return iOnes > jOnes
+	})
+	return metadata, nil
+}
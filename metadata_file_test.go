@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+const testMetadataFile = `
+pods:
+- name: backend
+  ip: 172.18.0.5
+  labels:
+    owner: backend-team
+  annotations:
+    description: The backend
+- name: compose-network
+  cidr: 172.18.0.0/16
+  labels:
+    owner: platform-team
+- name: compose-subnet
+  cidr: 172.18.1.0/24
+  labels:
+    owner: frontend-team
+`
+
+func writeMetadataFile(g *WithT, dir, content string) string {
+	path := filepath.Join(dir, "metadata.yaml")
+	g.Expect(ioutil.WriteFile(path, []byte(content), 0600)).To(Succeed())
+	return path
+}
+
+func TestFileProvider(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "zipkates-metadata")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	provider, err := CreateFileProvider(writeMetadataFile(g, dir, testMetadataFile))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	cases := map[string]string{
+		"172.18.0.5":  "backend-team",
+		"172.18.1.10": "frontend-team",
+		"172.18.2.10": "platform-team",
+	}
+	for ip, owner := range cases {
+		g.Expect(getIPTagValues(provider, ip, DefaultConfig)).To(Equal(map[string]string{"owner": owner}), ip)
+	}
+	g.Expect(getIPTagValues(provider, "10.0.0.1", DefaultConfig)).To(BeEmpty())
+
+	pod, err := provider.PodByIP("172.18.0.5")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pod.Name).To(Equal("backend"))
+	g.Expect(pod.Annotations).To(Equal(map[string]string{"description": "The backend"}))
+}
+
+func TestFileProviderJSON(t *testing.T) {
+	g := NewWithT(t)
+
+	metadata, err := parseMetadataFile([]byte(`{"pods": [{"ip": "::1", "labels": {"owner": "team"}}]}`))
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(metadata.byIP).To(HaveKey("::1"))
+	g.Expect(metadata.byIP["::1"].Labels).To(Equal(map[string]string{"owner": "team"}))
+}
+
+func TestFileProviderIdentity(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "zipkates-metadata")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	provider, err := CreateFileProvider(writeMetadataFile(g, dir, `
+pods:
+- {name: backend-1, namespace: compose, serviceAccount: backend, ip: 172.18.0.5, labels: {owner: team}}
+- {name: backend-2, namespace: compose, serviceAccount: backend, ip: 172.18.0.6, labels: {owner: team}}
+`))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	pods, err := provider.PodsByIdentity(podIdentity{namespace: "compose", serviceAccount: "backend"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pods).To(HaveLen(2))
+
+	pods, err = provider.PodsByIdentity(podIdentity{namespace: "compose", pod: "backend-2"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pods).To(HaveLen(1))
+	g.Expect(pods[0].Status.PodIP).To(Equal("172.18.0.6"))
+}
+
+func TestFileProviderReload(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "zipkates-metadata")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	path := writeMetadataFile(g, dir, testMetadataFile)
+	provider, err := CreateFileProvider(path)
+	g.Expect(err).NotTo(HaveOccurred())
+	now := time.Now()
+	provider.now = func() time.Time { return now }
+	owner := func() string {
+		return getIPTagValues(provider, "172.18.0.5", DefaultConfig)["owner"]
+	}
+
+	writeMetadataFile(g, dir, "pods: [{ip: 172.18.0.5, labels: {owner: new-team}}]")
+	later := time.Now().Add(time.Minute)
+	g.Expect(os.Chtimes(path, later, later)).To(Succeed())
+	g.Expect(owner()).To(Equal("backend-team"))
+	now = now.Add(metadataFileReloadInterval)
+	g.Expect(owner()).To(Equal("new-team"))
+
+	// A broken file is not used
+	writeMetadataFile(g, dir, "pods: [{labels: {owner: broken}}]")
+	g.Expect(os.Chtimes(path, later.Add(time.Minute), later.Add(time.Minute))).To(Succeed())
+	now = now.Add(metadataFileReloadInterval)
+	g.Expect(owner()).To(Equal("new-team"))
+}
+
+func TestInvalidMetadataFile(t *testing.T) {
+	cases := map[string]string{
+		"Not YAML":             "pods: [",
+		"Neither IP nor CIDR":  "pods: [{name: backend}]",
+		"Both IP and CIDR":     "pods: [{ip: 10.0.0.1, cidr: 10.0.0.0/8}]",
+		"Invalid IP":           "pods: [{ip: 10.0.0}]",
+		"Invalid CIDR":         "pods: [{cidr: 10.0.0.0/33}]",
+		"Duplicate IP":         "pods: [{ip: 10.0.0.1}, {ip: 10.0.0.1}]",
+		"Duplicate CIDR":       "pods: [{cidr: 10.0.0.0/8}, {cidr: 10.1.0.0/8}]",
+		"Labels are not a map": "pods: [{ip: 10.0.0.1, labels: [owner]}]",
+		"Pods are not a list":  "pods: {ip: 10.0.0.1}",
+		"Not an object at all": "[]",
+	}
+	for name, content := range cases {
+		t.Run(name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			_, err := parseMetadataFile([]byte(content))
+
+			g.Expect(err).To(HaveOccurred())
+		})
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// Types of the events streamed by the metadata server's /watch endpoint.
+const (
+	podEventAdded     = "ADDED"
+	podEventModified  = "MODIFIED"
+	podEventDeleted   = "DELETED"
+	podEventSynced    = "SYNCED"
+	podEventHeartbeat = "HEARTBEAT"
+)
+
+const (
+	// podEventBufferSize is how many events a watcher can fall behind before
+	// it's disconnected. It can reconnect and get all pods again.
+	podEventBufferSize = 1024
+	// metadataWatchHeartbeat is how often a heartbeat is sent to watchers
+	// when there are no changes, so that they can notice broken connections.
+	metadataWatchHeartbeat = 30 * time.Second
+)
+
+// podEvent is a change of a pod in the cache. Pods are sent as they are
+// stored, with only the fields that are needed for tags. The SYNCED event has
+// the labels that the server keeps, so that clients can check that they get
+// every label they map to a tag.
+type podEvent struct {
+	Type   string   `json:"type"`
+	Pod    *v1.Pod  `json:"pod,omitempty"`
+	Labels []string `json:"labels,omitempty"`
+}
+
+// podWatcher receives the events of a single watch. The events channel is
+// never closed, so that publishers can send to it without holding a lock.
+// closed is closed instead when the watcher falls too far behind or the
+// events are closed.
+type podWatcher struct {
+	events    chan podEvent
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (w *podWatcher) close() {
+	w.closeOnce.Do(func() { close(w.closed) })
+}
+
+// podEvents broadcasts the changes of the pod caches to the watchers of the
+// metadata server.
+type podEvents struct {
+	labels []string
+
+	mu       sync.Mutex
+	indexers []cache.Indexer
+	watchers map[*podWatcher]bool
+	closed   bool
+}
+
+// CreatePodEvents creates the events for pods that only keep the labels that
+// are mapped to tags.
+func CreatePodEvents(labelTagMapping map[string]string) *podEvents {
+	labels := make([]string, 0, len(labelTagMapping))
+	for label := range labelTagMapping {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	return &podEvents{labels: labels, watchers: map[*podWatcher]bool{}}
+}
+
+// AddIndexer adds an indexer that the pods for new watchers are listed from.
+func (e *podEvents) AddIndexer(indexer cache.Indexer) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.indexers = append(e.indexers, indexer)
+}
+
+// Watch returns the current pods and a watcher for the changes after them.
+// Changes that happen while the pods are listed can be both in the list and
+// in the watcher, which is harmless because events replace the whole pod.
+func (e *podEvents) Watch() ([]*v1.Pod, *podWatcher) {
+	watcher := &podWatcher{
+		events: make(chan podEvent, podEventBufferSize),
+		closed: make(chan struct{}),
+	}
+	e.mu.Lock()
+	if e.closed {
+		watcher.close()
+	} else {
+		e.watchers[watcher] = true
+	}
+	indexers := e.indexers
+	e.mu.Unlock()
+
+	var pods []*v1.Pod
+	for _, indexer := range indexers {
+		for _, obj := range indexer.List() {
+			if pod, ok := obj.(*v1.Pod); ok {
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return pods, watcher
+}
+
+// StopWatching stops sending events to the watcher.
+func (e *podEvents) StopWatching(watcher *podWatcher) {
+	e.mu.Lock()
+	delete(e.watchers, watcher)
+	e.mu.Unlock()
+	watcher.close()
+}
+
+// Close disconnects all watchers, e.g. before shutting down.
+func (e *podEvents) Close() {
+	e.mu.Lock()
+	e.closed = true
+	watchers := e.watchers
+	e.watchers = map[*podWatcher]bool{}
+	e.mu.Unlock()
+	for watcher := range watchers {
+		watcher.close()
+	}
+}
+
+// Publish sends the change of the pod to all watchers. The object is skipped
+// when it's not a pod. It never blocks, so that slow watchers can't hold up
+// the reflectors.
+func (e *podEvents) Publish(eventType string, obj interface{}) {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	watchers := make([]*podWatcher, 0, len(e.watchers))
+	for watcher := range e.watchers {
+		watchers = append(watchers, watcher)
+	}
+	e.mu.Unlock()
+	for _, watcher := range watchers {
+		select {
+		case watcher.events <- podEvent{Type: eventType, Pod: pod}:
+		default:
+			klog.Warningf("Disconnecting a metadata watcher that fell %d events behind", podEventBufferSize)
+			e.StopWatching(watcher)
+		}
+	}
+}
+
+// CreateMetadataServerHandler serves the pods that this instance watches to
+// instances that use the server metadata provider. Requests have to be
+// authenticated with the token as a bearer token.
+//
+// GET /lookup?ip=<ip> responds with the pod with the IP, the same way spans
+// from it are looked up.
+//
+// GET /watch streams newline delimited events. All current pods are sent as
+// ADDED events first, followed by a SYNCED event with the labels that pods
+// keep. Changes are sent as they happen after that, with HEARTBEAT events in
+// between when nothing changes.
+func CreateMetadataServerHandler(provider metadataProvider, events *podEvents, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lookup", func(w http.ResponseWriter, req *http.Request) {
+		ip := req.URL.Query().Get("ip")
+		if ip == "" {
+			http.Error(w, "The ip query parameter is required", http.StatusBadRequest)
+			return
+		}
+		lookupProvider := provider
+		if router, ok := provider.(requestRouter); ok {
+			lookupProvider = router.ForRequest(req)
+		}
+		pod, err := lookupProvider.PodByIP(ip)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(pod); err != nil {
+			klog.Errorf("Failed to write pod lookup response: %s", err)
+		}
+	})
+	mux.HandleFunc("/watch", func(w http.ResponseWriter, req *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+		pods, watcher := events.Watch()
+		defer events.StopWatching(watcher)
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		for _, pod := range pods {
+			if err := encoder.Encode(podEvent{Type: podEventAdded, Pod: pod}); err != nil {
+				return
+			}
+		}
+		if err := encoder.Encode(podEvent{Type: podEventSynced, Labels: events.labels}); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(metadataWatchHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			var event podEvent
+			select {
+			case <-req.Context().Done():
+				return
+			case <-heartbeat.C:
+				event = podEvent{Type: podEventHeartbeat}
+			case <-watcher.closed:
+				return
+			case event = <-watcher.events:
+			}
+			if err := encoder.Encode(event); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !hasBearerToken(req, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="zipkates"`)
+			http.Error(w, "A valid bearer token is required", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
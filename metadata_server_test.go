@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+	"k8s.io/api/core/v1"
+)
+
+const testMetadataServerToken = "metadata-s3cr3t"
+
+func metadataServerHandler() (*podCacheStore, *podEvents, http.Handler) {
+	indexer := CreateIndexer()
+	events := CreatePodEvents(DefaultConfig.LabelTagMapping)
+	events.AddIndexer(indexer)
+	store := CreatePodCacheStore(indexer, allNamespaces, DefaultConfig)
+	store.events = events
+	return store, events, CreateMetadataServerHandler(CreateKubernetesProvider(indexer), events, testMetadataServerToken)
+}
+
+// startMetadataServer serves the pods of a store that publishes its changes.
+func startMetadataServer() (*podCacheStore, *podEvents, *httptest.Server) {
+	store, events, handler := metadataServerHandler()
+	return store, events, httptest.NewServer(handler)
+}
+
+func stopMetadataServer(events *podEvents, server *httptest.Server) {
+	// Watches only end when their events are closed
+	events.Close()
+	server.Close()
+}
+
+func metadataClientConfig(server *httptest.Server) Config {
+	cfg := DefaultConfig
+	cfg.MetadataServerURL = server.URL
+	cfg.MetadataServerToken = testMetadataServerToken
+	return cfg
+}
+
+func metadataServerGet(g *WithT, url string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	req.Header.Set("Authorization", "Bearer "+testMetadataServerToken)
+	resp, err := http.DefaultClient.Do(req)
+	g.Expect(err).NotTo(HaveOccurred())
+	return resp
+}
+
+// defaultPod returns a pod in the default namespace.
+func defaultPod(name, ip string, labels map[string]string) *v1.Pod {
+	p := pod(name, ip, labels)
+	p.Namespace = "default"
+	return p
+}
+
+func versionedPod(name, ip, resourceVersion string) *v1.Pod {
+	p := defaultPod(name, ip, nil)
+	p.ResourceVersion = resourceVersion
+	return p
+}
+
+func TestPodCacheStorePublishesEvents(t *testing.T) {
+	g := NewWithT(t)
+	store, events, server := startMetadataServer()
+	defer stopMetadataServer(events, server)
+	g.Expect(store.Add(versionedPod("stale", differentIp, "1"))).To(Succeed())
+
+	pods, watcher := events.Watch()
+	g.Expect(pods).To(HaveLen(1))
+
+	g.Expect(store.Add(defaultPod("first", testIp, map[string]string{"owner": "team", "unmapped": "dropped"}))).To(Succeed())
+	event := <-watcher.events
+	g.Expect(event.Type).To(Equal(podEventAdded))
+	g.Expect(event.Pod.Name).To(Equal("first"))
+	g.Expect(event.Pod.Labels).To(Equal(map[string]string{"owner": "team"}))
+
+	g.Expect(store.Update(defaultPod("first", testIp, map[string]string{"owner": "other-team"}))).To(Succeed())
+	event = <-watcher.events
+	g.Expect(event.Type).To(Equal(podEventModified))
+	g.Expect(event.Pod.Labels["owner"]).To(Equal("other-team"))
+
+	g.Expect(store.Delete(defaultPod("first", testIp, nil))).To(Succeed())
+	event = <-watcher.events
+	g.Expect(event.Type).To(Equal(podEventDeleted))
+	g.Expect(event.Pod.Name).To(Equal("first"))
+
+	events.StopWatching(watcher)
+	g.Expect(watcher.closed).To(BeClosed())
+}
+
+func TestPodCacheStorePublishesChangedPodsOnRelist(t *testing.T) {
+	for _, namespace := range []string{allNamespaces, "default"} {
+		namespace := namespace
+		t.Run(namespace, func(t *testing.T) {
+			g := NewWithT(t)
+			indexer := CreateIndexer()
+			events := CreatePodEvents(DefaultConfig.LabelTagMapping)
+			store := CreatePodCacheStore(indexer, namespace, DefaultConfig)
+			store.events = events
+			g.Expect(store.Replace([]interface{}{
+				versionedPod("unchanged", "10.0.0.1", "1"),
+				versionedPod("changed", "10.0.0.2", "2"),
+				versionedPod("deleted", "10.0.0.3", "3"),
+			}, "3")).To(Succeed())
+
+			_, watcher := events.Watch()
+			defer events.StopWatching(watcher)
+			g.Expect(store.Replace([]interface{}{
+				versionedPod("unchanged", "10.0.0.1", "1"),
+				versionedPod("changed", "10.0.0.2", "4"),
+				versionedPod("added", "10.0.0.4", "5"),
+			}, "5")).To(Succeed())
+
+			var received []string
+			for len(watcher.events) > 0 {
+				event := <-watcher.events
+				received = append(received, event.Type+" "+event.Pod.Name)
+			}
+			g.Expect(received).To(ConsistOf("MODIFIED changed", "MODIFIED added", "DELETED deleted"))
+		})
+	}
+}
+
+func TestSlowMetadataWatcherIsDisconnected(t *testing.T) {
+	g := NewWithT(t)
+	store, events, server := startMetadataServer()
+	defer stopMetadataServer(events, server)
+
+	_, watcher := events.Watch()
+	for i := 0; i <= podEventBufferSize; i++ {
+		g.Expect(store.Update(defaultPod("pod", testIp, nil))).To(Succeed())
+	}
+
+	g.Expect(watcher.events).To(HaveLen(podEventBufferSize))
+	g.Expect(watcher.closed).To(BeClosed())
+	// Other watchers keep getting events
+	_, other := events.Watch()
+	g.Expect(store.Update(defaultPod("pod", testIp, nil))).To(Succeed())
+	g.Expect(other.events).To(Receive())
+}
+
+func TestMetadataServerAuthentication(t *testing.T) {
+	store, events, server := startMetadataServer()
+	defer stopMetadataServer(events, server)
+	NewWithT(t).Expect(store.Add(defaultPod("backend", testIp, nil))).To(Succeed())
+
+	for _, path := range []string{"/lookup?ip=" + testIp, "/watch"} {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			g := NewWithT(t)
+
+			req, err := http.NewRequest("GET", server.URL+path, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer wrong")
+			resp, err := http.DefaultClient.Do(req)
+			g.Expect(err).NotTo(HaveOccurred())
+			resp.Body.Close()
+
+			g.Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+		})
+	}
+}
+
+func TestMetadataServerLookup(t *testing.T) {
+	store, events, server := startMetadataServer()
+	defer stopMetadataServer(events, server)
+	NewWithT(t).Expect(store.Add(defaultPod("backend", testIp, map[string]string{"owner": "team"}))).To(Succeed())
+
+	t.Run("Found", func(t *testing.T) {
+		g := NewWithT(t)
+
+		resp := metadataServerGet(g, server.URL+"/lookup?ip="+testIp)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		g.Expect(gjson.GetBytes(body, "metadata.name").String()).To(Equal("backend"))
+		g.Expect(gjson.GetBytes(body, "metadata.labels.owner").String()).To(Equal("team"))
+	})
+
+	t.Run("Not found", func(t *testing.T) {
+		g := NewWithT(t)
+
+		resp := metadataServerGet(g, server.URL+"/lookup?ip="+differentIp)
+		resp.Body.Close()
+
+		g.Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	t.Run("Without an IP", func(t *testing.T) {
+		g := NewWithT(t)
+
+		resp := metadataServerGet(g, server.URL+"/lookup")
+		resp.Body.Close()
+
+		g.Expect(resp.StatusCode).To(Equal(http.StatusBadRequest))
+	})
+}
+
+func TestMetadataServerSyncedEventHasLabels(t *testing.T) {
+	g := NewWithT(t)
+	_, events, server := startMetadataServer()
+	defer stopMetadataServer(events, server)
+
+	resp := metadataServerGet(g, server.URL+"/watch")
+	defer resp.Body.Close()
+	buf := make([]byte, 1024)
+	n, err := resp.Body.Read(buf)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(string(buf[:n])).To(MatchJSON(`{"type": "SYNCED", "labels": ["owner"]}`))
+}
+
+func TestServerProviderBeforeSync(t *testing.T) {
+	g := NewWithT(t)
+	store, events, server := startMetadataServer()
+	defer stopMetadataServer(events, server)
+	g.Expect(store.Add(defaultPod("backend", testIp, map[string]string{"owner": "team"}))).To(Succeed())
+	provider, err := CreateServerProvider(metadataClientConfig(server))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	// Pods are not looked up on the server while spans wait
+	_, err = provider.PodByIP(testIp)
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(metadataServerHealthCheck(provider).check(context.Background())).NotTo(Succeed())
+}
+
+func TestServerProviderWatch(t *testing.T) {
+	g := NewWithT(t)
+	store, events, server := startMetadataServer()
+	defer stopMetadataServer(events, server)
+	existing := defaultPod("backend", testIp, map[string]string{"owner": "team"})
+	existing.Spec.ServiceAccountName = "backend"
+	g.Expect(store.Add(existing)).To(Succeed())
+	provider, err := CreateServerProvider(metadataClientConfig(server))
+	g.Expect(err).NotTo(HaveOccurred())
+	stop := make(chan struct{})
+	defer close(stop)
+	go provider.Run(stop)
+
+	g.Eventually(provider.Synced).Should(BeTrue())
+	g.Expect(metadataServerHealthCheck(provider).check(context.Background())).To(Succeed())
+	pod, err := provider.PodByIP(testIp)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pod.Name).To(Equal("backend"))
+	pods, err := provider.PodsByIdentity(podIdentity{namespace: "default", serviceAccount: "backend"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pods).To(HaveLen(1))
+	pods, err = provider.PodsByIdentity(podIdentity{namespace: "default", pod: "backend"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pods).To(HaveLen(1))
+
+	g.Expect(store.Add(defaultPod("frontend", differentIp, map[string]string{"owner": "web"}))).To(Succeed())
+	g.Eventually(func() error {
+		_, err := provider.PodByIP(differentIp)
+		return err
+	}).Should(Succeed())
+
+	g.Expect(store.Delete(existing)).To(Succeed())
+	g.Eventually(func() error {
+		_, err := provider.PodByIP(testIp)
+		return err
+	}).Should(HaveOccurred())
+}
+
+func TestServerProviderRequiresMappedLabels(t *testing.T) {
+	g := NewWithT(t)
+	_, events, server := startMetadataServer()
+	defer stopMetadataServer(events, server)
+	cfg := metadataClientConfig(server)
+	cfg.LabelTagMapping = map[string]string{"owner": "owner", "team": "team"}
+	provider, err := CreateServerProvider(cfg)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	err = provider.watch(context.Background())
+
+	g.Expect(err).To(MatchError(ContainSubstring("[team]")))
+	g.Expect(provider.Synced()).To(BeFalse())
+}
+
+func TestServerProviderTLS(t *testing.T) {
+	g := NewWithT(t)
+	store, events, handler := metadataServerHandler()
+	server := httptest.NewTLSServer(handler)
+	defer stopMetadataServer(events, server)
+	g.Expect(store.Add(defaultPod("backend", testIp, nil))).To(Succeed())
+	dir, err := ioutil.TempDir("", "zipkates-metadata-ca")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	g.Expect(ioutil.WriteFile(caFile, caPEM, 0600)).To(Succeed())
+
+	t.Run("Untrusted", func(t *testing.T) {
+		g := NewWithT(t)
+		provider, err := CreateServerProvider(metadataClientConfig(server))
+		g.Expect(err).NotTo(HaveOccurred())
+
+		g.Expect(provider.watch(context.Background())).NotTo(Succeed())
+	})
+
+	t.Run("Trusted with METADATA_SERVER_CA_FILE", func(t *testing.T) {
+		g := NewWithT(t)
+		cfg := metadataClientConfig(server)
+		cfg.MetadataServerCAFile = caFile
+		provider, err := CreateServerProvider(cfg)
+		g.Expect(err).NotTo(HaveOccurred())
+		stop := make(chan struct{})
+		defer close(stop)
+		go provider.Run(stop)
+
+		g.Eventually(provider.Synced).Should(BeTrue())
+	})
+}
+
+func TestServerProviderKeepsPodsOfClustersApart(t *testing.T) {
+	g := NewWithT(t)
+	provider, err := CreateServerProvider(DefaultConfig)
+	g.Expect(err).NotTo(HaveOccurred())
+	eu := defaultPod("backend", testIp, nil)
+	setPodClusterName(eu, "eu")
+	us := defaultPod("backend", differentIp, nil)
+	setPodClusterName(us, "us")
+
+	g.Expect(provider.indexer.Add(eu)).To(Succeed())
+	g.Expect(provider.indexer.Add(us)).To(Succeed())
+
+	pods, err := provider.PodsByIdentity(podIdentity{namespace: "default", pod: "backend"})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(pods).To(HaveLen(2))
+}
+
+func TestServerProviderReconnects(t *testing.T) {
+	g := NewWithT(t)
+	store, events, server := startMetadataServer()
+	defer stopMetadataServer(events, server)
+	g.Expect(store.Add(defaultPod("backend", testIp, nil))).To(Succeed())
+	provider, err := CreateServerProvider(metadataClientConfig(server))
+	g.Expect(err).NotTo(HaveOccurred())
+
+	watchErr := make(chan error, 1)
+	go func() {
+		watchErr <- provider.watch(context.Background())
+	}()
+	g.Eventually(provider.Synced).Should(BeTrue())
+
+	// Closing the events ends the watch, like a restart of the server does
+	events.Close()
+	g.Eventually(watchErr, 5*time.Second).Should(Receive(HaveOccurred()))
+	// The pods received before are still used
+	_, err = provider.PodByIP(testIp)
+	g.Expect(err).NotTo(HaveOccurred())
+}
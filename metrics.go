@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/klog"
+)
+
+// Prometheus metric types.
+const (
+	metricTypeCounter = "counter"
+	metricTypeGauge   = "gauge"
+)
+
+// metricSample is a single value of a metric. labels are already formatted,
+// e.g. state="open".
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+type registeredMetric struct {
+	name    string
+	help    string
+	typ     string
+	samples func() []metricSample
+}
+
+// metricsRegistry serves the registered metrics in the Prometheus text
+// format. Metric values are read when they are scraped.
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []registeredMetric
+}
+
+func CreateMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{}
+}
+
+// Register adds a metric whose samples are returned by samples.
+func (r *metricsRegistry) Register(name, help, typ string, samples func() []metricSample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, registeredMetric{name: name, help: help, typ: typ, samples: samples})
+	sort.Slice(r.metrics, func(i, j int) bool { return r.metrics[i].name < r.metrics[j].name })
+}
+
+// RegisterCounter adds a metric without labels that's read from the counter.
+func (r *metricsRegistry) RegisterCounter(name, help string, counter *int64) {
+	r.Register(name, help, metricTypeCounter, func() []metricSample {
+		return []metricSample{{value: float64(atomic.LoadInt64(counter))}}
+	})
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	metrics := append([]registeredMetric{}, r.metrics...)
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.typ)
+		for _, sample := range metric.samples() {
+			if err != nil {
+				break
+			}
+			if sample.labels == "" {
+				_, err = fmt.Fprintf(w, "%s %v\n", metric.name, sample.value)
+			} else {
+				_, err = fmt.Fprintf(w, "%s{%s} %v\n", metric.name, sample.labels, sample.value)
+			}
+		}
+		if err != nil {
+			klog.Errorf("Failed to write metrics: %s", err)
+			return
+		}
+	}
+}
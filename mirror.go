@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// zipkinMirror is an additional Zipkin that a percentage of the span uploads
+// are copied to, e.g. while migrating to a new storage backend.
+type zipkinMirror struct {
+	URL        *url.URL
+	Percentage float64
+}
+
+// parseZipkinMirrors parses a JSON list of mirrors like
+// [{"url": "http://zipkin-staging:9411", "percentage": 10}]. The percentage
+// defaults to 100.
+func parseZipkinMirrors(value string) ([]zipkinMirror, error) {
+	var rawMirrors []struct {
+		URL        string   `json:"url"`
+		Percentage *float64 `json:"percentage"`
+	}
+	if err := json.Unmarshal([]byte(value), &rawMirrors); err != nil {
+		return nil, err
+	}
+	mirrors := make([]zipkinMirror, 0, len(rawMirrors))
+	for _, rawMirror := range rawMirrors {
+		mirrorURL, err := parseZipkinURL(rawMirror.URL)
+		if err != nil {
+			return nil, err
+		}
+		percentage := 100.0
+		if rawMirror.Percentage != nil {
+			percentage = *rawMirror.Percentage
+		}
+		if percentage < 0 || percentage > 100 {
+			return nil, fmt.Errorf("Percentage of %s has to be between 0 and 100, got %v", rawMirror.URL, percentage)
+		}
+		mirrors = append(mirrors, zipkinMirror{URL: mirrorURL, Percentage: percentage})
+	}
+	return mirrors, nil
+}
+
+// mirrorWorkers limits how many requests are sent to each mirror at the same
+// time. Uploads that arrive while all workers are busy are not mirrored, so
+// that a slow mirror can't use up the sidecar's memory.
+const mirrorWorkers = 16
+
+// mirrorTimeout is the timeout of requests to mirrors.
+const mirrorTimeout = 10 * time.Second
+
+type mirrorUpstream struct {
+	zipkinMirror
+	client  *http.Client
+	workers chan struct{}
+}
+
+// mirroringTransport sends requests to the primary Zipkin and copies span
+// uploads to the mirrors in the background. Only the primary's response is
+// returned and mirroring failures are only logged.
+type mirroringTransport struct {
+	primaryURL *url.URL
+	primary    http.RoundTripper
+	mirrors    []*mirrorUpstream
+	// sample returns a number in [0, 100) to pick the uploads that are
+	// mirrored. It's a field so that tests can replace it.
+	sample func() float64
+}
+
+func createMirroringTransport(primaryURL *url.URL, primary http.RoundTripper, mirrors []zipkinMirror) *mirroringTransport {
+	transport := &mirroringTransport{
+		primaryURL: primaryURL,
+		primary:    primary,
+		sample:     func() float64 { return rand.Float64() * 100 },
+	}
+	for _, mirror := range mirrors {
+		transport.mirrors = append(transport.mirrors, &mirrorUpstream{
+			zipkinMirror: mirror,
+			client: &http.Client{
+				Timeout:   mirrorTimeout,
+				Transport: createUpstreamTransport(mirror.URL),
+			},
+			workers: make(chan struct{}, mirrorWorkers),
+		})
+	}
+	return transport
+}
+
+func (t *mirroringTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Zipkin only accepts POST requests for span uploads
+	if req.Method != "POST" || req.Body == nil {
+		return t.primary.RoundTrip(req)
+	}
+	selected := t.selectMirrors()
+	if len(selected) == 0 {
+		return t.primary.RoundTrip(req)
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	t.mirror(selected, upstreamPath(t.primaryURL, req.URL.Path), req.URL.RawQuery, req.Header, body)
+	return t.primary.RoundTrip(req)
+}
+
+// MirrorSpans copies spans that are sent to the primary Zipkin without going
+// through RoundTrip to the mirrors. The queue uses it to mirror uploads once
+// when they are queued, instead of every time it retries sending them.
+func (t *mirroringTransport) MirrorSpans(path, contentType string, body []byte) {
+	selected := t.selectMirrors()
+	if len(selected) == 0 {
+		return
+	}
+	t.mirror(selected, path, "", http.Header{"Content-Type": []string{contentType}}, body)
+}
+
+func (t *mirroringTransport) selectMirrors() []*mirrorUpstream {
+	var selected []*mirrorUpstream
+	for _, mirror := range t.mirrors {
+		if t.sample() < mirror.Percentage {
+			selected = append(selected, mirror)
+		}
+	}
+	return selected
+}
+
+// mirror sends the upload to the mirrors in the background.
+func (t *mirroringTransport) mirror(selected []*mirrorUpstream, path, rawQuery string, header http.Header, body []byte) {
+	for _, mirror := range selected {
+		select {
+		case mirror.workers <- struct{}{}:
+		default:
+			klog.Warningf("Not mirroring spans to %s, too many requests in flight", mirror.URL)
+			continue
+		}
+		go func(mirror *mirrorUpstream) {
+			defer func() { <-mirror.workers }()
+			if err := mirror.send(path, rawQuery, header, body); err != nil {
+				klog.Errorf("Failed to mirror spans to %s: %s", mirror.URL, err)
+			}
+		}(mirror)
+	}
+}
+
+func (m *mirrorUpstream) send(path, rawQuery string, header http.Header, body []byte) error {
+	target := upstreamTarget(m.URL, path)
+	target.RawQuery = rawQuery
+	req, err := http.NewRequest("POST", target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"Content-Type", "Content-Encoding"} {
+		if value := header.Get(name); value != "" {
+			req.Header.Set(name, value)
+		}
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain the body to allow reusing the connection
+	_, _ = ioutil.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", target, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+)
+
+func mirroringProxy(g *WithT, primary *httptest.Server, mirrors string) (*httputil.ReverseProxy, *mirroringTransport) {
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+	cfg := fakeZipkinConfig(g, primary)
+	var err error
+	cfg.ZipkinMirrors, err = parseZipkinMirrors(mirrors)
+	g.Expect(err).NotTo(HaveOccurred())
+	transport := CreateZipkinTransport(cfg, CreateMetricsRegistry()).(*mirroringTransport)
+	return &httputil.ReverseProxy{Director: CreateDirector(CreateKubernetesProvider(indexer), cfg), Transport: transport}, transport
+}
+
+func spansRequest(g *WithT) *http.Request {
+	return httptest.NewRequest(
+		"POST", "/api/v2/spans",
+		strings.NewReader(fmt.Sprintf("[%s]", span(g, map[string]string{}))),
+	)
+}
+
+func TestMirroring(t *testing.T) {
+	g := NewWithT(t)
+
+	primary, primaryReceived := fakeZipkin(http.StatusAccepted)
+	defer primary.Close()
+	mirror, mirrorReceived := fakeZipkin(http.StatusInternalServerError)
+	defer mirror.Close()
+	proxy, _ := mirroringProxy(g, primary, fmt.Sprintf(`[{"url": "%s"}]`, mirror.URL))
+
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, spansRequest(g))
+
+	g.Expect(recorder.Code).To(Equal(http.StatusAccepted))
+	g.Expect(gjson.GetBytes(<-primaryReceived, "0.tags.owner").String()).To(Equal("from_label"))
+	g.Expect(gjson.GetBytes(<-mirrorReceived, "0.tags.owner").String()).To(Equal("from_label"))
+}
+
+func TestMirroringPercentage(t *testing.T) {
+	g := NewWithT(t)
+
+	primary, primaryReceived := fakeZipkin(http.StatusAccepted)
+	defer primary.Close()
+	mirror, mirrorReceived := fakeZipkin(http.StatusAccepted)
+	defer mirror.Close()
+	proxy, transport := mirroringProxy(g, primary, fmt.Sprintf(`[{"url": "%s", "percentage": 25}]`, mirror.URL))
+
+	transport.sample = func() float64 { return 25 }
+	proxy.ServeHTTP(httptest.NewRecorder(), spansRequest(g))
+	<-primaryReceived
+	g.Consistently(mirrorReceived, 50*time.Millisecond).ShouldNot(Receive())
+
+	transport.sample = func() float64 { return 24.9 }
+	proxy.ServeHTTP(httptest.NewRecorder(), spansRequest(g))
+	<-primaryReceived
+	g.Eventually(mirrorReceived).Should(Receive())
+}
+
+func TestMirroringSkipsQueries(t *testing.T) {
+	g := NewWithT(t)
+
+	primary, _ := fakeZipkin(http.StatusOK)
+	defer primary.Close()
+	mirrored := make(chan string, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mirrored <- req.URL.Path
+	}))
+	defer mirror.Close()
+	proxy, _ := mirroringProxy(g, primary, fmt.Sprintf(`[{"url": "%s"}]`, mirror.URL))
+
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/v2/services", nil))
+
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	g.Consistently(mirrored, 50*time.Millisecond).ShouldNot(Receive())
+}
+
+func TestMirrorPathPrefix(t *testing.T) {
+	g := NewWithT(t)
+
+	primary, _ := fakeZipkin(http.StatusAccepted)
+	defer primary.Close()
+	mirrored := make(chan string, 1)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mirrored <- req.URL.Path + " " + req.Header.Get("Content-Type")
+	}))
+	defer mirror.Close()
+	proxy, _ := mirroringProxy(g, primary, fmt.Sprintf(`[{"url": "%s/zipkin/"}]`, mirror.URL))
+
+	req := spansRequest(g)
+	req.Header.Set("Content-Type", "application/json")
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	g.Eventually(mirrored).Should(Receive(Equal("/zipkin/api/v2/spans application/json")))
+}
+
+func TestQueuedSpansAreMirroredOnce(t *testing.T) {
+	g := NewWithT(t)
+
+	sends := int32(0)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The first send fails and is retried
+		if atomic.AddInt32(&sends, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer primary.Close()
+	mirror, mirrorReceived := fakeZipkin(http.StatusAccepted)
+	defer mirror.Close()
+	cfg := asyncConfig()
+	zipkinURL, err := parseZipkinURL(primary.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+	cfg.ZipkinURL = zipkinURL
+	cfg.ZipkinMirrors, err = parseZipkinMirrors(fmt.Sprintf(`[{"url": "%s"}]`, mirror.URL))
+	g.Expect(err).NotTo(HaveOccurred())
+	queue := CreateZipkinSpanQueue(CreateZipkinTransport(cfg, CreateMetricsRegistry()), cfg)
+	queue.initialBackoff = time.Millisecond
+
+	g.Expect(queue.Enqueue("/api/v2/spans", contentTypeJSON, []byte("[]"))).To(Succeed())
+	queue.flush()
+	queue.retries.Wait()
+
+	g.Expect(atomic.LoadInt32(&sends)).To(Equal(int32(2)))
+	g.Eventually(mirrorReceived).Should(Receive(Equal([]byte("[]"))))
+	g.Consistently(mirrorReceived, 50*time.Millisecond).ShouldNot(Receive())
+}
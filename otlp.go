@@ -0,0 +1,668 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog"
+)
+
+// The types below mirror the OTLP trace data model in
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+// They only include the fields that are converted to Zipkin spans. The JSON
+// tags follow the OTLP/HTTP JSON mapping.
+
+type otlpExportTraceServiceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	// InstrumentationLibrarySpans is what ScopeSpans was called before OTLP
+	// v0.15.0. Older SDKs still send it.
+	InstrumentationLibrarySpans []otlpScopeSpans `json:"instrumentationLibrarySpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope                  otlpScope  `json:"scope"`
+	InstrumentationLibrary otlpScope  `json:"instrumentationLibrary"`
+	Spans                  []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           otlpID         `json:"traceId"`
+	SpanID            otlpID         `json:"spanId"`
+	ParentSpanID      otlpID         `json:"parentSpanId"`
+	Name              string         `json:"name"`
+	Kind              otlpSpanKind   `json:"kind"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   otlpUint64     `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Events            []otlpEvent    `json:"events"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano otlpUint64 `json:"timeUnixNano"`
+	Name         string     `json:"name"`
+}
+
+type otlpStatus struct {
+	Message string         `json:"message"`
+	Code    otlpStatusCode `json:"code"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string           `json:"stringValue"`
+	BoolValue   *bool             `json:"boolValue"`
+	IntValue    *otlpInt64        `json:"intValue"`
+	DoubleValue *float64          `json:"doubleValue"`
+	ArrayValue  *otlpArrayValue   `json:"arrayValue"`
+	KvlistValue *otlpKeyValueList `json:"kvlistValue"`
+	BytesValue  []byte            `json:"bytesValue"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+type otlpKeyValueList struct {
+	Values []otlpKeyValue `json:"values"`
+}
+
+// otlpID is a trace or span ID. They are hex encoded in OTLP/HTTP JSON.
+type otlpID []byte
+
+func (id *otlpID) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return fmt.Errorf("Failed to decode OTLP ID \"%s\": %w", s, err)
+	}
+	*id = decoded
+	return nil
+}
+
+// otlpUint64 is an unsigned 64-bit integer, which the OTLP/HTTP JSON mapping
+// allows to be encoded either as a number or as a string.
+type otlpUint64 uint64
+
+func (v *otlpUint64) UnmarshalJSON(data []byte) error {
+	parsed, err := strconv.ParseUint(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Failed to parse OTLP integer %s: %w", data, err)
+	}
+	*v = otlpUint64(parsed)
+	return nil
+}
+
+// otlpInt64 is the signed variant of otlpUint64.
+type otlpInt64 int64
+
+func (v *otlpInt64) UnmarshalJSON(data []byte) error {
+	parsed, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("Failed to parse OTLP integer %s: %w", data, err)
+	}
+	*v = otlpInt64(parsed)
+	return nil
+}
+
+type otlpSpanKind int32
+
+const (
+	otlpSpanKindUnspecified otlpSpanKind = iota
+	otlpSpanKindInternal
+	otlpSpanKindServer
+	otlpSpanKindClient
+	otlpSpanKindProducer
+	otlpSpanKindConsumer
+)
+
+var otlpSpanKindNames = map[string]otlpSpanKind{
+	"SPAN_KIND_UNSPECIFIED": otlpSpanKindUnspecified,
+	"SPAN_KIND_INTERNAL":    otlpSpanKindInternal,
+	"SPAN_KIND_SERVER":      otlpSpanKindServer,
+	"SPAN_KIND_CLIENT":      otlpSpanKindClient,
+	"SPAN_KIND_PRODUCER":    otlpSpanKindProducer,
+	"SPAN_KIND_CONSUMER":    otlpSpanKindConsumer,
+}
+
+func (k *otlpSpanKind) UnmarshalJSON(data []byte) error {
+	return unmarshalOTLPEnum(data, (*int32)(k), func(name string) (int32, bool) {
+		kind, ok := otlpSpanKindNames[name]
+		return int32(kind), ok
+	})
+}
+
+type otlpStatusCode int32
+
+const (
+	otlpStatusCodeUnset otlpStatusCode = iota
+	otlpStatusCodeOk
+	otlpStatusCodeError
+)
+
+var otlpStatusCodeNames = map[string]otlpStatusCode{
+	"STATUS_CODE_UNSET": otlpStatusCodeUnset,
+	"STATUS_CODE_OK":    otlpStatusCodeOk,
+	"STATUS_CODE_ERROR": otlpStatusCodeError,
+}
+
+func (c *otlpStatusCode) UnmarshalJSON(data []byte) error {
+	return unmarshalOTLPEnum(data, (*int32)(c), func(name string) (int32, bool) {
+		code, ok := otlpStatusCodeNames[name]
+		return int32(code), ok
+	})
+}
+
+// unmarshalOTLPEnum parses an enum that's either encoded as its number or as
+// its name.
+func unmarshalOTLPEnum(data []byte, v *int32, byName func(string) (int32, bool)) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		value, ok := byName(name)
+		if !ok {
+			return fmt.Errorf("Unknown OTLP enum value %s", name)
+		}
+		*v = value
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// String formats the value the way it's stored in a Zipkin tag.
+func (v otlpAnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	}
+	value := v.interfaceValue()
+	if value == nil {
+		return ""
+	}
+	result, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(result)
+}
+
+func (v otlpAnyValue) interfaceValue() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, 0, len(v.ArrayValue.Values))
+		for _, value := range v.ArrayValue.Values {
+			values = append(values, value.interfaceValue())
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := make(map[string]interface{}, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			values[kv.Key] = kv.Value.interfaceValue()
+		}
+		return values
+	case v.BytesValue != nil:
+		return v.BytesValue
+	}
+	return nil
+}
+
+func decodeOTLPJSON(body []byte) (otlpExportTraceServiceRequest, error) {
+	var request otlpExportTraceServiceRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return otlpExportTraceServiceRequest{}, fmt.Errorf("Failed to parse OTLP JSON: %w", err)
+	}
+	return request, nil
+}
+
+// Field numbers from the OTLP proto definitions.
+const (
+	otlpRequestResourceSpans             = 1
+	otlpResourceSpansResource            = 1
+	otlpResourceSpansScopeSpans          = 2
+	otlpResourceSpansInstrumentationLibs = 1000
+	otlpResourceAttributes               = 1
+	otlpScopeSpansScope                  = 1
+	otlpScopeSpansSpans                  = 2
+	otlpScopeName                        = 1
+	otlpScopeVersion                     = 2
+	otlpSpanTraceID                      = 1
+	otlpSpanSpanID                       = 2
+	otlpSpanParentSpanID                 = 4
+	otlpSpanName                         = 5
+	otlpSpanKindField                    = 6
+	otlpSpanStartTime                    = 7
+	otlpSpanEndTime                      = 8
+	otlpSpanAttributes                   = 9
+	otlpSpanEvents                       = 11
+	otlpSpanStatus                       = 15
+	otlpEventTime                        = 1
+	otlpEventName                        = 2
+	otlpStatusMessage                    = 2
+	otlpStatusCodeField                  = 3
+	otlpKeyValueKey                      = 1
+	otlpKeyValueValue                    = 2
+	otlpAnyValueString                   = 1
+	otlpAnyValueBool                     = 2
+	otlpAnyValueInt                      = 3
+	otlpAnyValueDouble                   = 4
+	otlpAnyValueArray                    = 5
+	otlpAnyValueKvlist                   = 6
+	otlpAnyValueBytes                    = 7
+	otlpValuesField                      = 1
+)
+
+func decodeOTLPProto(body []byte) (otlpExportTraceServiceRequest, error) {
+	var request otlpExportTraceServiceRequest
+	err := forEachProtoField(body, func(field protoField) error {
+		if field.number != otlpRequestResourceSpans || field.wireType != protoBytes {
+			return nil
+		}
+		resourceSpans, err := decodeOTLPResourceSpans(field.value)
+		request.ResourceSpans = append(request.ResourceSpans, resourceSpans)
+		return err
+	})
+	if err != nil {
+		return otlpExportTraceServiceRequest{}, fmt.Errorf("Failed to parse OTLP protobuf: %w", err)
+	}
+	return request, nil
+}
+
+func decodeOTLPResourceSpans(msg []byte) (otlpResourceSpans, error) {
+	var resourceSpans otlpResourceSpans
+	err := forEachProtoField(msg, func(field protoField) error {
+		if field.wireType != protoBytes {
+			return nil
+		}
+		switch field.number {
+		case otlpResourceSpansResource:
+			return forEachProtoField(field.value, func(resourceField protoField) error {
+				if resourceField.number != otlpResourceAttributes || resourceField.wireType != protoBytes {
+					return nil
+				}
+				kv, err := decodeOTLPKeyValue(resourceField.value, 0)
+				resourceSpans.Resource.Attributes = append(resourceSpans.Resource.Attributes, kv)
+				return err
+			})
+		case otlpResourceSpansScopeSpans, otlpResourceSpansInstrumentationLibs:
+			scopeSpans, err := decodeOTLPScopeSpans(field.value)
+			resourceSpans.ScopeSpans = append(resourceSpans.ScopeSpans, scopeSpans)
+			return err
+		}
+		return nil
+	})
+	return resourceSpans, err
+}
+
+func decodeOTLPScopeSpans(msg []byte) (otlpScopeSpans, error) {
+	var scopeSpans otlpScopeSpans
+	err := forEachProtoField(msg, func(field protoField) error {
+		if field.wireType != protoBytes {
+			return nil
+		}
+		switch field.number {
+		case otlpScopeSpansScope:
+			return forEachProtoField(field.value, func(scopeField protoField) error {
+				if scopeField.wireType != protoBytes {
+					return nil
+				}
+				switch scopeField.number {
+				case otlpScopeName:
+					scopeSpans.Scope.Name = string(scopeField.value)
+				case otlpScopeVersion:
+					scopeSpans.Scope.Version = string(scopeField.value)
+				}
+				return nil
+			})
+		case otlpScopeSpansSpans:
+			span, err := decodeOTLPSpan(field.value)
+			scopeSpans.Spans = append(scopeSpans.Spans, span)
+			return err
+		}
+		return nil
+	})
+	return scopeSpans, err
+}
+
+func decodeOTLPSpan(msg []byte) (otlpSpan, error) {
+	var span otlpSpan
+	err := forEachProtoField(msg, func(field protoField) error {
+		switch field.number {
+		case otlpSpanTraceID:
+			span.TraceID = field.value
+		case otlpSpanSpanID:
+			span.SpanID = field.value
+		case otlpSpanParentSpanID:
+			span.ParentSpanID = field.value
+		case otlpSpanName:
+			span.Name = string(field.value)
+		case otlpSpanKindField:
+			span.Kind = otlpSpanKind(field.varint)
+		case otlpSpanStartTime:
+			span.StartTimeUnixNano = otlpUint64(protoFixed64Value(field))
+		case otlpSpanEndTime:
+			span.EndTimeUnixNano = otlpUint64(protoFixed64Value(field))
+		case otlpSpanAttributes:
+			kv, err := decodeOTLPKeyValue(field.value, 0)
+			span.Attributes = append(span.Attributes, kv)
+			return err
+		case otlpSpanEvents:
+			var event otlpEvent
+			err := forEachProtoField(field.value, func(eventField protoField) error {
+				switch eventField.number {
+				case otlpEventTime:
+					event.TimeUnixNano = otlpUint64(protoFixed64Value(eventField))
+				case otlpEventName:
+					event.Name = string(eventField.value)
+				}
+				return nil
+			})
+			span.Events = append(span.Events, event)
+			return err
+		case otlpSpanStatus:
+			return forEachProtoField(field.value, func(statusField protoField) error {
+				switch statusField.number {
+				case otlpStatusMessage:
+					span.Status.Message = string(statusField.value)
+				case otlpStatusCodeField:
+					span.Status.Code = otlpStatusCode(statusField.varint)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return span, err
+}
+
+// otlpMaxDepth limits how deeply nested array and kvlist values can be, so
+// that malicious requests can't exhaust the stack.
+const otlpMaxDepth = 64
+
+func decodeOTLPKeyValue(msg []byte, depth int) (otlpKeyValue, error) {
+	var kv otlpKeyValue
+	err := forEachProtoField(msg, func(field protoField) error {
+		switch field.number {
+		case otlpKeyValueKey:
+			kv.Key = string(field.value)
+		case otlpKeyValueValue:
+			value, err := decodeOTLPAnyValue(field.value, depth)
+			kv.Value = value
+			return err
+		}
+		return nil
+	})
+	return kv, err
+}
+
+func decodeOTLPAnyValue(msg []byte, depth int) (otlpAnyValue, error) {
+	var value otlpAnyValue
+	if depth > otlpMaxDepth {
+		return value, fmt.Errorf("OTLP value is nested more than %d levels deep", otlpMaxDepth)
+	}
+	err := forEachProtoField(msg, func(field protoField) error {
+		switch field.number {
+		case otlpAnyValueString:
+			s := string(field.value)
+			value.StringValue = &s
+		case otlpAnyValueBool:
+			b := field.varint != 0
+			value.BoolValue = &b
+		case otlpAnyValueInt:
+			i := otlpInt64(field.varint)
+			value.IntValue = &i
+		case otlpAnyValueDouble:
+			d := math.Float64frombits(protoFixed64Value(field))
+			value.DoubleValue = &d
+		case otlpAnyValueArray:
+			value.ArrayValue = &otlpArrayValue{}
+			return forEachProtoField(field.value, func(valuesField protoField) error {
+				if valuesField.number != otlpValuesField {
+					return nil
+				}
+				elem, err := decodeOTLPAnyValue(valuesField.value, depth+1)
+				value.ArrayValue.Values = append(value.ArrayValue.Values, elem)
+				return err
+			})
+		case otlpAnyValueKvlist:
+			value.KvlistValue = &otlpKeyValueList{}
+			return forEachProtoField(field.value, func(valuesField protoField) error {
+				if valuesField.number != otlpValuesField {
+					return nil
+				}
+				kv, err := decodeOTLPKeyValue(valuesField.value, depth+1)
+				value.KvlistValue.Values = append(value.KvlistValue.Values, kv)
+				return err
+			})
+		case otlpAnyValueBytes:
+			value.BytesValue = append([]byte{}, field.value...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// Semantic convention attribute names that get special treatment when
+// converting to Zipkin.
+const (
+	otlpServiceName  = "service.name"
+	otlpPeerService  = "peer.service"
+	otlpNetPeerIP    = "net.peer.ip"
+	otlpNetPeerPort  = "net.peer.port"
+	otlpScopeNameTag = "otel.scope.name"
+	otlpScopeVerTag  = "otel.scope.version"
+	otlpStatusTag    = "otel.status_code"
+	zipkinErrorTag   = "error"
+)
+
+var otlpSpanKindToZipkin = map[otlpSpanKind]string{
+	otlpSpanKindServer:   zipkinKindServer,
+	otlpSpanKindClient:   zipkinKindClient,
+	otlpSpanKindProducer: zipkinKindProducer,
+	otlpSpanKindConsumer: zipkinKindConsumer,
+}
+
+// otlpToZipkin converts OTLP spans to Zipkin v2 spans. The conversion follows
+// the one of the Zipkin exporter in the OpenTelemetry Collector: resource
+// attributes other than service.name become tags along with span attributes.
+func otlpToZipkin(request otlpExportTraceServiceRequest) []zipkinSpan {
+	spans := []zipkinSpan{}
+	for _, resourceSpans := range request.ResourceSpans {
+		serviceName := ""
+		resourceTags := map[string]string{}
+		for _, attribute := range resourceSpans.Resource.Attributes {
+			if attribute.Key == otlpServiceName {
+				serviceName = attribute.Value.String()
+				continue
+			}
+			resourceTags[attribute.Key] = attribute.Value.String()
+		}
+		scopeSpansList := append(resourceSpans.ScopeSpans, resourceSpans.InstrumentationLibrarySpans...)
+		for _, scopeSpans := range scopeSpansList {
+			scope := scopeSpans.Scope
+			if scope.Name == "" {
+				scope = scopeSpans.InstrumentationLibrary
+			}
+			for _, span := range scopeSpans.Spans {
+				if len(span.TraceID) == 0 || len(span.SpanID) == 0 {
+					klog.Warningf("Skipping OTLP span without trace or span ID: %+v", span)
+					continue
+				}
+				spans = append(spans, otlpSpanToZipkin(span, serviceName, resourceTags, scope))
+			}
+		}
+	}
+	return spans
+}
+
+func otlpSpanToZipkin(span otlpSpan, serviceName string, resourceTags map[string]string, scope otlpScope) zipkinSpan {
+	result := zipkinSpan{
+		TraceID:   hex.EncodeToString(span.TraceID),
+		ID:        hex.EncodeToString(span.SpanID),
+		Kind:      otlpSpanKindToZipkin[span.Kind],
+		Name:      span.Name,
+		Timestamp: uint64(span.StartTimeUnixNano) / 1000,
+	}
+	if len(span.ParentSpanID) > 0 {
+		result.ParentID = hex.EncodeToString(span.ParentSpanID)
+	}
+	if span.EndTimeUnixNano > span.StartTimeUnixNano {
+		result.Duration = uint64(span.EndTimeUnixNano-span.StartTimeUnixNano) / 1000
+		// Zipkin treats a zero duration as unknown
+		if result.Duration == 0 {
+			result.Duration = 1
+		}
+	}
+	if serviceName != "" {
+		result.LocalEndpoint = &zipkinEndpoint{ServiceName: serviceName}
+	}
+
+	tags := map[string]string{}
+	for key, value := range resourceTags {
+		tags[key] = value
+	}
+	remoteEndpoint := zipkinEndpoint{}
+	for _, attribute := range span.Attributes {
+		value := attribute.Value.String()
+		tags[attribute.Key] = value
+		switch attribute.Key {
+		case otlpPeerService:
+			remoteEndpoint.ServiceName = value
+		case otlpNetPeerIP:
+			remoteEndpoint.setIP(net.ParseIP(value))
+		case otlpNetPeerPort:
+			remoteEndpoint.Port, _ = strconv.Atoi(value)
+		}
+	}
+	if remoteEndpoint != (zipkinEndpoint{}) {
+		result.RemoteEndpoint = &remoteEndpoint
+	}
+	if scope.Name != "" {
+		tags[otlpScopeNameTag] = scope.Name
+	}
+	if scope.Version != "" {
+		tags[otlpScopeVerTag] = scope.Version
+	}
+	switch span.Status.Code {
+	case otlpStatusCodeOk:
+		tags[otlpStatusTag] = "OK"
+	case otlpStatusCodeError:
+		tags[otlpStatusTag] = "ERROR"
+		tags[zipkinErrorTag] = span.Status.Message
+	}
+	if len(tags) > 0 {
+		result.Tags = tags
+	}
+
+	for _, event := range span.Events {
+		result.Annotations = append(result.Annotations, zipkinAnnotation{
+			Timestamp: uint64(event.TimeUnixNano) / 1000,
+			Value:     event.Name,
+		})
+	}
+	return result
+}
+
+// CreateOTLPHandler returns a handler for the OTLP/HTTP traces endpoint. The
+// spans get the same tag values as spans sent to /api/v2/spans. Exporters that
+// send OTLP upstream get the request as it was sent, while the spans are
+// converted to Zipkin v2 spans for other exporters.
+func CreateOTLPHandler(provider metadataProvider, cfg Config, exporter spanExporter) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(w, "Only POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		contentType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil || (contentType != contentTypeJSON && contentType != contentTypeProtobuf) {
+			http.Error(w, "Content-Type has to be application/json or application/x-protobuf", http.StatusUnsupportedMediaType)
+			return
+		}
+		release, ok := acquireRequestSlot(req)
+		if !ok {
+			return
+		}
+		defer release()
+		bodyBytes, ok := readRequestBody(w, req, cfg)
+		if !ok {
+			return
+		}
+		contentEncoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+		bodyBytes, err = decodeBody(bodyBytes, contentEncoding, cfg.MaxDecompressedBodySize)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decompress request body: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		var request otlpExportTraceServiceRequest
+		if contentType == contentTypeJSON {
+			request, err = decodeOTLPJSON(bodyBytes)
+		} else {
+			request, err = decodeOTLPProto(bodyBytes)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		release()
+		tagValues := getRequestTagValues(provider, req, cfg)
+		if forwarder, ok := exporter.(otlpForwarder); ok {
+			err = forwarder.ForwardOTLP(bodyBytes, contentType, tagValues)
+		} else {
+			err = exporter.ExportSpans(otlpToZipkin(request), tagValues)
+		}
+		if err != nil {
+			klog.Errorf("Failed to export OTLP spans: %s", err)
+			// 503 tells OTLP exporters that they can retry
+			http.Error(w, "Failed to export spans", http.StatusServiceUnavailable)
+			return
+		}
+
+		// An empty ExportTraceServiceResponse means that all spans were
+		// accepted.
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+		if contentType == contentTypeJSON {
+			if _, err := w.Write([]byte("{}")); err != nil {
+				klog.Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+)
+
+const otlpJSONRequest = `{
+  "resourceSpans": [{
+    "resource": {
+      "attributes": [
+        {"key": "service.name", "value": {"stringValue": "backend"}},
+        {"key": "host.name", "value": {"stringValue": "test-host"}}
+      ]
+    },
+    "scopeSpans": [{
+      "scope": {"name": "test-scope", "version": "1.0.0"},
+      "spans": [{
+        "traceId": "5af7183fb1d4cf5f5af7183fb1d4cf5f",
+        "spanId": "352bff9a74ca9ad2",
+        "parentSpanId": "6b221d5bc9e6496c",
+        "name": "get /api",
+        "kind": "SPAN_KIND_SERVER",
+        "startTimeUnixNano": "1556604172355737000",
+        "endTimeUnixNano": "1556604172357168000",
+        "attributes": [
+          {"key": "http.method", "value": {"stringValue": "GET"}},
+          {"key": "http.status_code", "value": {"intValue": "500"}},
+          {"key": "net.peer.ip", "value": {"stringValue": "172.19.0.2"}}
+        ],
+        "events": [{"timeUnixNano": "1556604172356000000", "name": "exception"}],
+        "status": {"code": 2, "message": "Internal error"}
+      }]
+    }]
+  }]
+}`
+
+func TestOTLPJSONConversion(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	zipkin, received := fakeZipkin(http.StatusAccepted)
+	defer zipkin.Close()
+
+	req := httptest.NewRequest("POST", "/v1/traces", strings.NewReader(otlpJSONRequest))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	CreateOTLPHandler(CreateKubernetesProvider(indexer), fakeZipkinConfig(g, zipkin), fakeZipkinExporter(g, zipkin))(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	g.Expect(recorder.Body.String()).To(Equal("{}"))
+	var body []byte
+	g.Expect(received).To(Receive(&body))
+	g.Expect(gjson.GetBytes(body, "#").Int()).To(Equal(int64(1)))
+	g.Expect(gjson.GetBytes(body, "0.traceId").String()).To(Equal("5af7183fb1d4cf5f5af7183fb1d4cf5f"))
+	g.Expect(gjson.GetBytes(body, "0.id").String()).To(Equal("352bff9a74ca9ad2"))
+	g.Expect(gjson.GetBytes(body, "0.parentId").String()).To(Equal("6b221d5bc9e6496c"))
+	g.Expect(gjson.GetBytes(body, "0.kind").String()).To(Equal("SERVER"))
+	g.Expect(gjson.GetBytes(body, "0.timestamp").Raw).To(Equal("1556604172355737"))
+	g.Expect(gjson.GetBytes(body, "0.duration").Raw).To(Equal("1431"))
+	g.Expect(gjson.GetBytes(body, "0.localEndpoint.serviceName").String()).To(Equal("backend"))
+	g.Expect(gjson.GetBytes(body, "0.remoteEndpoint.ipv4").String()).To(Equal("172.19.0.2"))
+	g.Expect(gjson.GetBytes(body, "0.annotations.0.value").String()).To(Equal("exception"))
+	g.Expect(gjson.GetBytes(body, "0.tags").Value()).To(Equal(map[string]interface{}{
+		"host.name":          "test-host",
+		"http.method":        "GET",
+		"http.status_code":   "500",
+		"net.peer.ip":        "172.19.0.2",
+		"otel.scope.name":    "test-scope",
+		"otel.scope.version": "1.0.0",
+		"otel.status_code":   "ERROR",
+		"error":              "Internal error",
+		"owner":              owner,
+	}))
+}
+
+func TestOTLPProtobufConversion(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	zipkin, received := fakeZipkin(http.StatusAccepted)
+	defer zipkin.Close()
+
+	var span []byte
+	span = appendProtoBytes(span, otlpSpanTraceID, bytes.Repeat([]byte{0xab}, 16))
+	span = appendProtoBytes(span, otlpSpanSpanID, bytes.Repeat([]byte{0xcd}, 8))
+	span = appendProtoBytes(span, otlpSpanName, []byte("get /api"))
+	span = appendProtoVarint(span, otlpSpanKindField<<3|protoVarint)
+	span = appendProtoVarint(span, uint64(otlpSpanKindClient))
+	span = appendProtoFixed64(span, otlpSpanStartTime, 1556604172355737000)
+	span = appendProtoFixed64(span, otlpSpanEndTime, 1556604172357168000)
+	span = appendProtoBytes(span, otlpSpanAttributes, otlpStringKeyValue("http.method", "GET"))
+	span = appendProtoBytes(span, otlpSpanAttributes, otlpStringKeyValue("owner", "from_span"))
+	var scopeSpans []byte
+	scopeSpans = appendProtoBytes(scopeSpans, otlpScopeSpansSpans, span)
+	var resource []byte
+	resource = appendProtoBytes(resource, otlpResourceAttributes, otlpStringKeyValue("service.name", "backend"))
+	var resourceSpans []byte
+	resourceSpans = appendProtoBytes(resourceSpans, otlpResourceSpansResource, resource)
+	resourceSpans = appendProtoBytes(resourceSpans, otlpResourceSpansScopeSpans, scopeSpans)
+	var request []byte
+	request = appendProtoBytes(request, otlpRequestResourceSpans, resourceSpans)
+
+	req := httptest.NewRequest("POST", "/v1/traces", bytes.NewReader(request))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	recorder := httptest.NewRecorder()
+	CreateOTLPHandler(CreateKubernetesProvider(indexer), fakeZipkinConfig(g, zipkin), fakeZipkinExporter(g, zipkin))(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusOK))
+	g.Expect(recorder.Header().Get("Content-Type")).To(Equal("application/x-protobuf"))
+	g.Expect(recorder.Body.Len()).To(Equal(0))
+	var body []byte
+	g.Expect(received).To(Receive(&body))
+	g.Expect(gjson.GetBytes(body, "0.traceId").String()).To(Equal(strings.Repeat("ab", 16)))
+	g.Expect(gjson.GetBytes(body, "0.id").String()).To(Equal(strings.Repeat("cd", 8)))
+	g.Expect(gjson.GetBytes(body, "0.kind").String()).To(Equal("CLIENT"))
+	g.Expect(gjson.GetBytes(body, "0.duration").Raw).To(Equal("1431"))
+	g.Expect(gjson.GetBytes(body, "0.localEndpoint.serviceName").String()).To(Equal("backend"))
+	g.Expect(gjson.GetBytes(body, "0.tags.http\\.method").String()).To(Equal("GET"))
+	g.Expect(gjson.GetBytes(body, "0.tags.owner").String()).To(Equal("from_span"))
+}
+
+func TestOTLPZipkinFailure(t *testing.T) {
+	g := NewWithT(t)
+
+	zipkin, _ := fakeZipkin(http.StatusInternalServerError)
+	defer zipkin.Close()
+
+	req := httptest.NewRequest("POST", "/v1/traces", strings.NewReader(otlpJSONRequest))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	CreateOTLPHandler(CreateKubernetesProvider(CreateIndexer()), fakeZipkinConfig(g, zipkin), fakeZipkinExporter(g, zipkin))(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+}
+
+func TestOTLPInvalidBody(t *testing.T) {
+	g := NewWithT(t)
+
+	zipkin, received := fakeZipkin(http.StatusAccepted)
+	defer zipkin.Close()
+
+	req := httptest.NewRequest("POST", "/v1/traces", strings.NewReader(`{"resourceSpans": {}}`))
+	req.Header.Set("Content-Type", "application/json")
+	recorder := httptest.NewRecorder()
+	CreateOTLPHandler(CreateKubernetesProvider(CreateIndexer()), fakeZipkinConfig(g, zipkin), fakeZipkinExporter(g, zipkin))(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	g.Expect(received).NotTo(Receive())
+}
+
+func TestOTLPDeeplyNestedValue(t *testing.T) {
+	g := NewWithT(t)
+
+	zipkin, received := fakeZipkin(http.StatusAccepted)
+	defer zipkin.Close()
+
+	var value []byte
+	value = appendProtoBytes(value, otlpAnyValueString, []byte("leaf"))
+	for i := 0; i < 10000; i++ {
+		var array []byte
+		array = appendProtoBytes(array, otlpValuesField, value)
+		value = appendProtoBytes(nil, otlpAnyValueArray, array)
+	}
+	var kv []byte
+	kv = appendProtoBytes(kv, otlpKeyValueKey, []byte("nested"))
+	kv = appendProtoBytes(kv, otlpKeyValueValue, value)
+	var span []byte
+	span = appendProtoBytes(span, otlpSpanAttributes, kv)
+	var scopeSpans []byte
+	scopeSpans = appendProtoBytes(scopeSpans, otlpScopeSpansSpans, span)
+	var resourceSpans []byte
+	resourceSpans = appendProtoBytes(resourceSpans, otlpResourceSpansScopeSpans, scopeSpans)
+	var request []byte
+	request = appendProtoBytes(request, otlpRequestResourceSpans, resourceSpans)
+
+	req := httptest.NewRequest("POST", "/v1/traces", bytes.NewReader(request))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	recorder := httptest.NewRecorder()
+	CreateOTLPHandler(CreateKubernetesProvider(CreateIndexer()), fakeZipkinConfig(g, zipkin), fakeZipkinExporter(g, zipkin))(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	g.Expect(recorder.Body.String()).To(ContainSubstring("nested more than"))
+	g.Expect(received).NotTo(Receive())
+}
+
+func TestOTLPUnsupportedContentType(t *testing.T) {
+	g := NewWithT(t)
+
+	req := httptest.NewRequest("POST", "/v1/traces", strings.NewReader(otlpJSONRequest))
+	req.Header.Set("Content-Type", "text/plain")
+	recorder := httptest.NewRecorder()
+	CreateOTLPHandler(CreateKubernetesProvider(CreateIndexer()), DefaultConfig, CreateZipkinExporter(http.DefaultClient, DefaultConfig))(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusUnsupportedMediaType))
+}
+
+// fakeZipkin starts a server that sends the bodies of all requests sent to
+// /api/v2/spans to the returned channel and responds with the given status.
+func fakeZipkin(status int) (*httptest.Server, chan []byte) {
+	received := make(chan []byte, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/v2/spans" {
+			body, _ := ioutil.ReadAll(req.Body)
+			received <- body
+		}
+		w.WriteHeader(status)
+	}))
+	return server, received
+}
+
+func fakeZipkinConfig(g *WithT, zipkin *httptest.Server) Config {
+	zipkinURL, err := parseZipkinURL(zipkin.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+	cfg := DefaultConfig
+	cfg.ZipkinURL = zipkinURL
+	return cfg
+}
+
+func fakeZipkinExporter(g *WithT, zipkin *httptest.Server) spanExporter {
+	return CreateZipkinExporter(zipkin.Client(), fakeZipkinConfig(g, zipkin))
+}
+
+func otlpStringKeyValue(key, value string) []byte {
+	var anyValue []byte
+	anyValue = appendProtoBytes(anyValue, otlpAnyValueString, []byte(value))
+	var kv []byte
+	kv = appendProtoBytes(kv, otlpKeyValueKey, []byte(key))
+	return appendProtoBytes(kv, otlpKeyValueValue, anyValue)
+}
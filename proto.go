@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+
+	"k8s.io/klog"
+)
+
+// Protobuf wire types as described in
+// https://developers.google.com/protocol-buffers/docs/encoding
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// Field numbers from the Zipkin v2 proto3 definition in
+// https://github.com/openzipkin/zipkin-api/blob/master/zipkin.proto
+const (
+	zipkinListOfSpansSpans    = 1
+	zipkinSpanTraceID         = 1
+	zipkinSpanParentID        = 2
+	zipkinSpanID              = 3
+	zipkinSpanKind            = 4
+	zipkinSpanName            = 5
+	zipkinSpanTimestamp       = 6
+	zipkinSpanDuration        = 7
+	zipkinSpanLocalEndpoint   = 8
+	zipkinSpanRemoteEndpoint  = 9
+	zipkinSpanAnnotations     = 10
+	zipkinSpanTags            = 11
+	zipkinSpanDebug           = 12
+	zipkinSpanShared          = 13
+	zipkinEndpointServiceName = 1
+	zipkinEndpointIPv4        = 2
+	zipkinEndpointIPv6        = 3
+	zipkinEndpointPort        = 4
+	zipkinAnnotationTimestamp = 1
+	zipkinAnnotationValue     = 2
+	zipkinMapEntryKey         = 1
+	zipkinMapEntryValue       = 2
+)
+
+// zipkinProtoKinds maps the Span.Kind enum values to the JSON names.
+var zipkinProtoKinds = map[uint64]string{
+	1: zipkinKindClient,
+	2: zipkinKindServer,
+	3: zipkinKindProducer,
+	4: zipkinKindConsumer,
+}
+
+var errProtoTruncated = errors.New("Truncated protobuf message")
+
+// protoField is a single field of an encoded protobuf message. raw holds the
+// whole field including its key. value holds the payload of length-delimited
+// fields and the little-endian bytes of fixed-size fields, while varint holds
+// the value of varint fields.
+type protoField struct {
+	number   int
+	wireType int
+	varint   uint64
+	value    []byte
+	raw      []byte
+}
+
+// forEachProtoField calls fn for every top-level field of the encoded
+// protobuf message in order.
+func forEachProtoField(msg []byte, fn func(field protoField) error) error {
+	for len(msg) > 0 {
+		field := protoField{}
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		field.number = int(key >> 3)
+		field.wireType = int(key & 7)
+		length := n
+		switch field.wireType {
+		case protoVarint:
+			v, m := binary.Uvarint(msg[length:])
+			if m <= 0 {
+				return errProtoTruncated
+			}
+			field.varint = v
+			length += m
+		case protoFixed64, protoFixed32:
+			size := 8
+			if field.wireType == protoFixed32 {
+				size = 4
+			}
+			if length+size > len(msg) {
+				return errProtoTruncated
+			}
+			field.value = msg[length : length+size]
+			length += size
+		case protoBytes:
+			size, m := binary.Uvarint(msg[length:])
+			if m <= 0 || size > uint64(len(msg)-length-m) {
+				return errProtoTruncated
+			}
+			length += m
+			field.value = msg[length : length+int(size)]
+			length += int(size)
+		default:
+			return fmt.Errorf("Unsupported protobuf wire type %d", field.wireType)
+		}
+		if length > len(msg) {
+			return errProtoTruncated
+		}
+		field.raw = msg[:length]
+		if err := fn(field); err != nil {
+			return err
+		}
+		msg = msg[length:]
+	}
+	return nil
+}
+
+func appendProtoVarint(buf []byte, v uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], v)
+	return append(buf, scratch[:n]...)
+}
+
+func protoFixed64Value(field protoField) uint64 {
+	if field.wireType != protoFixed64 {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(field.value)
+}
+
+func appendProtoVarintField(buf []byte, number int, value uint64) []byte {
+	buf = appendProtoVarint(buf, uint64(number)<<3|protoVarint)
+	return appendProtoVarint(buf, value)
+}
+
+func appendProtoFixed64(buf []byte, number int, value uint64) []byte {
+	buf = appendProtoVarint(buf, uint64(number)<<3|protoFixed64)
+	var scratch [8]byte
+	binary.LittleEndian.PutUint64(scratch[:], value)
+	return append(buf, scratch[:]...)
+}
+
+func appendProtoBytes(buf []byte, number int, value []byte) []byte {
+	buf = appendProtoVarint(buf, uint64(number)<<3|protoBytes)
+	buf = appendProtoVarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// appendProtoMapEntry appends a map<string, string> entry. Protobuf parsers
+// merge repeated occurrences of a map field, so entries can be appended to the
+// end of an already encoded message.
+func appendProtoMapEntry(buf []byte, number int, key, value string) []byte {
+	var entry []byte
+	entry = appendProtoBytes(entry, zipkinMapEntryKey, []byte(key))
+	entry = appendProtoBytes(entry, zipkinMapEntryValue, []byte(value))
+	return appendProtoBytes(buf, number, entry)
+}
+
+// readProtoStringMap decodes the map<string, string> field with the given
+// number from the encoded message.
+func readProtoStringMap(msg []byte, number int) (map[string]string, error) {
+	result := map[string]string{}
+	err := forEachProtoField(msg, func(field protoField) error {
+		if field.number != number || field.wireType != protoBytes {
+			return nil
+		}
+		var key, value string
+		err := forEachProtoField(field.value, func(entryField protoField) error {
+			if entryField.wireType != protoBytes {
+				return nil
+			}
+			switch entryField.number {
+			case zipkinMapEntryKey:
+				key = string(entryField.value)
+			case zipkinMapEntryValue:
+				value = string(entryField.value)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		result[key] = value
+		return nil
+	})
+	return result, err
+}
+
+// addTagsV2Proto adds the tag values to Zipkin v2 proto3 spans. The spans are
+// not fully decoded. Instead the missing tags are appended to the end of each
+// encoded span, which keeps all other fields byte for byte as they were.
+func addTagsV2Proto(body []byte, tagValues map[string]string) ([]byte, bool, error) {
+	newBody := make([]byte, 0, len(body))
+	modified := false
+	err := forEachProtoField(body, func(field protoField) error {
+		if field.number != zipkinListOfSpansSpans || field.wireType != protoBytes {
+			newBody = append(newBody, field.raw...)
+			return nil
+		}
+		tags, err := readProtoStringMap(field.value, zipkinSpanTags)
+		if err != nil {
+			return err
+		}
+		span := field.value
+		spanModified := false
+		for tagName, value := range tagValues {
+			if tags[tagName] != "" {
+				if klog.V(1) {
+					klog.Infof("Tag %s is already set for the span, skipping", tagName)
+				}
+				continue
+			}
+			if !spanModified {
+				// Copy the span to avoid modifying the original body
+				span = append([]byte{}, span...)
+				spanModified = true
+			}
+			span = appendProtoMapEntry(span, zipkinSpanTags, tagName, value)
+		}
+		if !spanModified {
+			newBody = append(newBody, field.raw...)
+			return nil
+		}
+		newBody = appendProtoBytes(newBody, zipkinListOfSpansSpans, span)
+		modified = true
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to parse proto3 spans: %w", err)
+	}
+	if !modified {
+		return body, false, nil
+	}
+	return newBody, true, nil
+}
+
+// decodeZipkinProtoSpans fully decodes Zipkin v2 proto3 spans. Unlike
+// addTagsV2Proto, it's used when the spans are converted to another format.
+func decodeZipkinProtoSpans(body []byte) ([]zipkinSpan, error) {
+	spans := []zipkinSpan{}
+	err := forEachProtoField(body, func(field protoField) error {
+		if field.number != zipkinListOfSpansSpans || field.wireType != protoBytes {
+			return nil
+		}
+		span := zipkinSpan{}
+		err := forEachProtoField(field.value, func(spanField protoField) error {
+			switch spanField.number {
+			case zipkinSpanTraceID:
+				span.TraceID = hex.EncodeToString(spanField.value)
+			case zipkinSpanParentID:
+				span.ParentID = hex.EncodeToString(spanField.value)
+			case zipkinSpanID:
+				span.ID = hex.EncodeToString(spanField.value)
+			case zipkinSpanKind:
+				span.Kind = zipkinProtoKinds[spanField.varint]
+			case zipkinSpanName:
+				span.Name = string(spanField.value)
+			case zipkinSpanTimestamp:
+				span.Timestamp = protoFixed64Value(spanField)
+			case zipkinSpanDuration:
+				span.Duration = spanField.varint
+			case zipkinSpanLocalEndpoint, zipkinSpanRemoteEndpoint:
+				endpoint, err := decodeZipkinProtoEndpoint(spanField.value)
+				if spanField.number == zipkinSpanLocalEndpoint {
+					span.LocalEndpoint = endpoint
+				} else {
+					span.RemoteEndpoint = endpoint
+				}
+				return err
+			case zipkinSpanAnnotations:
+				annotation := zipkinAnnotation{}
+				err := forEachProtoField(spanField.value, func(annotationField protoField) error {
+					switch annotationField.number {
+					case zipkinAnnotationTimestamp:
+						annotation.Timestamp = protoFixed64Value(annotationField)
+					case zipkinAnnotationValue:
+						annotation.Value = string(annotationField.value)
+					}
+					return nil
+				})
+				span.Annotations = append(span.Annotations, annotation)
+				return err
+			case zipkinSpanDebug:
+				span.Debug = spanField.varint != 0
+			case zipkinSpanShared:
+				span.Shared = spanField.varint != 0
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		tags, err := readProtoStringMap(field.value, zipkinSpanTags)
+		if err != nil {
+			return err
+		}
+		if len(tags) > 0 {
+			span.Tags = tags
+		}
+		spans = append(spans, span)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse proto3 spans: %w", err)
+	}
+	return spans, nil
+}
+
+func decodeZipkinProtoEndpoint(msg []byte) (*zipkinEndpoint, error) {
+	endpoint := &zipkinEndpoint{}
+	err := forEachProtoField(msg, func(field protoField) error {
+		switch field.number {
+		case zipkinEndpointServiceName:
+			endpoint.ServiceName = string(field.value)
+		case zipkinEndpointIPv4, zipkinEndpointIPv6:
+			endpoint.setIP(net.IP(field.value))
+		case zipkinEndpointPort:
+			endpoint.Port = int(field.varint)
+		}
+		return nil
+	})
+	return endpoint, err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestProtoTagAddition(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	req := protoRequest(protoListOfSpans(protoSpan(map[string]string{"http.path": "/api"})))
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	spans := protoSpans(g, body)
+	g.Expect(spans).To(HaveLen(1))
+	tags, err := readProtoStringMap(spans[0], zipkinSpanTags)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(tags).To(Equal(map[string]string{"http.path": "/api", "owner": owner}))
+	g.Expect(req.ContentLength).To(Equal(int64(len(body))))
+}
+
+func TestProtoKeepOriginalTag(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	originalBody := protoListOfSpans(protoSpan(map[string]string{"owner": "from_span"}))
+	req := protoRequest(originalBody)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(body).To(Equal(originalBody))
+}
+
+func TestProtoMultipleSpans(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	first := protoSpan(map[string]string{"owner": "from_span"})
+	second := protoSpan(nil)
+	req := protoRequest(protoListOfSpans(first, second))
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	spans := protoSpans(g, body)
+	g.Expect(spans).To(HaveLen(2))
+	g.Expect(spans[0]).To(Equal(first))
+	g.Expect(spans[1][:len(second)]).To(Equal(second))
+	tags, err := readProtoStringMap(spans[1], zipkinSpanTags)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(tags).To(Equal(map[string]string{"owner": "from_label"}))
+}
+
+func TestProtoTruncatedBody(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	listOfSpans := protoListOfSpans(protoSpan(nil))
+	originalBody := listOfSpans[:len(listOfSpans)-3]
+	req := protoRequest(originalBody)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(body).To(Equal(originalBody))
+}
+
+func TestUnsupportedContentType(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	originalBody := "[]"
+	req := httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader(originalBody))
+	req.Header.Set("Content-Type", "text/plain")
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(string(body)).To(Equal(originalBody))
+}
+
+func protoRequest(body []byte) *http.Request {
+	req := httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	return req
+}
+
+func protoSpan(tags map[string]string) []byte {
+	var span []byte
+	span = appendProtoBytes(span, 1, []byte{0x5a, 0xf7, 0x18, 0x3f, 0xb1, 0xd4, 0xcf, 0x5f})
+	span = appendProtoBytes(span, 3, []byte{0x35, 0x2b, 0xff, 0x9a, 0x74, 0xca, 0x9a, 0xd2})
+	span = appendProtoBytes(span, 5, []byte("get /api"))
+	span = appendProtoVarint(span, 6<<3|protoFixed64)
+	var timestamp [8]byte
+	binary.LittleEndian.PutUint64(timestamp[:], 1556604172355737)
+	span = append(span, timestamp[:]...)
+	for key, value := range tags {
+		span = appendProtoMapEntry(span, zipkinSpanTags, key, value)
+	}
+	return span
+}
+
+func protoListOfSpans(spans ...[]byte) []byte {
+	var list []byte
+	for _, span := range spans {
+		list = appendProtoBytes(list, zipkinListOfSpansSpans, span)
+	}
+	return list
+}
+
+func protoSpans(g *WithT, body []byte) [][]byte {
+	var spans [][]byte
+	err := forEachProtoField(body, func(field protoField) error {
+		g.Expect(field.number).To(Equal(zipkinListOfSpansSpans))
+		spans = append(spans, field.value)
+		return nil
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	return spans
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+)
+
+// Metadata providers.
+const (
+	metadataProviderKubernetes = "kubernetes"
+	metadataProviderFile       = "file"
+	metadataProviderServer     = "server"
+)
+
+// metadataProvider looks up the pods that spans are sent from. Providers
+// other than Kubernetes describe their workloads as pods as well, with the
+// labels that are mapped to tags.
+type metadataProvider interface {
+	// PodByIP returns the pod with the IP.
+	PodByIP(ip string) (*v1.Pod, error)
+	// PodsByIdentity returns the pods with the identity from a client
+	// certificate.
+	PodsByIdentity(identity podIdentity) ([]*v1.Pod, error)
+}
+
+// requestRouter is implemented by providers that pick a different provider
+// based on the request, e.g. by a header.
+type requestRouter interface {
+	ForRequest(req *http.Request) metadataProvider
+}
+
+// kubernetesProvider looks up pods in the indexer that the reflector keeps up
+// to date.
+type kubernetesProvider struct {
+	indexer cache.Indexer
+}
+
+func CreateKubernetesProvider(indexer cache.Indexer) metadataProvider {
+	return &kubernetesProvider{indexer: indexer}
+}
+
+func (p *kubernetesProvider) PodByIP(ip string) (*v1.Pod, error) {
+	if klog.V(1) {
+		klog.Infof("These are the pod IPs: %v", p.indexer.ListIndexFuncValues(ipIndex))
+	}
+	return getPodByIP(p.indexer, ip)
+}
+
+func (p *kubernetesProvider) PodsByIdentity(identity podIdentity) ([]*v1.Pod, error) {
+	var objects []interface{}
+	if identity.pod != "" {
+		obj, exists, err := p.indexer.GetByKey(identity.namespace + "/" + identity.pod)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			objects = append(objects, obj)
+		}
+	} else {
+		var err error
+		objects, err = p.indexer.ByIndex(serviceAccountIndex, identity.namespace+"/"+identity.serviceAccount)
+		if err != nil {
+			return nil, err
+		}
+	}
+	pods := make([]*v1.Pod, 0, len(objects))
+	for _, obj := range objects {
+		pod, ok := obj.(*v1.Pod)
+		if !ok {
+			return nil, fmt.Errorf("%+v is not a v1.Pod", obj)
+		}
+		pods = append(pods, pod)
+	}
+	return pods, nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+var (
+	errQueueFull    = errors.New("The span queue is full")
+	errQueueStopped = errors.New("The span queue has stopped")
+)
+
+// Backoff between retries of batches that failed with a retryable error. The
+// backoff is doubled after every retry.
+const (
+	queueInitialBackoff = 500 * time.Millisecond
+	queueMaxBackoff     = 30 * time.Second
+)
+
+// queuedSpans is a single upload of encoded spans, or a batch of uploads
+// coalesced into one.
+type queuedSpans struct {
+	path        string
+	contentType string
+	body        []byte
+}
+
+// spanQueue buffers enriched span uploads in memory and sends them to Zipkin
+// in the background. Uploads with the same path and Content-Type are
+// coalesced into batches of up to BatchMaxBytes.
+type spanQueue struct {
+	cfg  Config
+	send func(batch queuedSpans) error
+	// initialBackoff is a field so that tests don't have to wait for retries
+	initialBackoff time.Duration
+	// spool is where batches go when Zipkin is failing, if it's configured
+	spool *spanSpool
+	// mirror copies uploads to the Zipkin mirrors when they are queued, if
+	// there are any. send doesn't mirror them, as it's called again for
+	// retries and replays from the spool.
+	mirror func(path, contentType string, body []byte)
+
+	mu           sync.Mutex
+	pending      []queuedSpans
+	pendingBytes int64
+	// size is the size of all uploads in the queue, including the ones that
+	// are currently being sent or retried.
+	size int64
+	// stopped is set when Run has seen stop, after which nothing is queued
+	// anymore.
+	stopped bool
+	notify  chan struct{}
+	// retries tracks the batches that are being retried in the background.
+	retries sync.WaitGroup
+	// done is closed when Run returns and abort when Wait gives up waiting
+	// for the spans to be sent.
+	done      chan struct{}
+	abort     chan struct{}
+	abortOnce sync.Once
+}
+
+func CreateSpanQueue(client *http.Client, cfg Config) *spanQueue {
+	return &spanQueue{
+		cfg: cfg,
+		send: func(batch queuedSpans) error {
+			url := zipkinTarget(cfg, batch.path).String()
+			return postSpans(client, url, batch.contentType, batch.body)
+		},
+		initialBackoff: queueInitialBackoff,
+		notify:         make(chan struct{}, 1),
+		done:           make(chan struct{}),
+		abort:          make(chan struct{}),
+	}
+}
+
+// CreateZipkinSpanQueue creates a queue that sends spans with the Zipkin
+// transport. When the transport mirrors uploads, queued spans are mirrored
+// once when they are queued and only sent to the primary Zipkin afterwards, so
+// that retries and replays from the spool don't mirror them again.
+func CreateZipkinSpanQueue(transport http.RoundTripper, cfg Config) *spanQueue {
+	mirroring, ok := transport.(*mirroringTransport)
+	if !ok {
+		return CreateSpanQueue(&http.Client{Timeout: 10 * time.Second, Transport: transport}, cfg)
+	}
+	queue := CreateSpanQueue(&http.Client{Timeout: 10 * time.Second, Transport: mirroring.primary}, cfg)
+	queue.mirror = mirroring.MirrorSpans
+	return queue
+}
+
+// Enqueue adds uncompressed, already enriched spans to the queue. It fails
+// with errQueueFull when there's no room for the spans and with
+// errQueueStopped when the queue is shutting down.
+func (q *spanQueue) Enqueue(path, contentType string, body []byte) error {
+	q.mu.Lock()
+	if q.stopped {
+		q.mu.Unlock()
+		return errQueueStopped
+	}
+	if q.size+int64(len(body)) > q.cfg.QueueMaxBytes {
+		q.mu.Unlock()
+		return errQueueFull
+	}
+	q.pending = append(q.pending, queuedSpans{path: path, contentType: contentType, body: body})
+	q.pendingBytes += int64(len(body))
+	q.size += int64(len(body))
+	q.mu.Unlock()
+
+	if q.mirror != nil {
+		q.mirror(path, contentType, body)
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run sends the queued spans until stop is closed. Spans that are still
+// queued when stop is closed are sent, and the retries are waited for, before
+// returning.
+func (q *spanQueue) Run(stop <-chan struct{}) {
+	defer close(q.done)
+	for {
+		select {
+		case <-q.notify:
+		case <-stop:
+			q.mu.Lock()
+			q.stopped = true
+			q.mu.Unlock()
+			q.flush()
+			q.retries.Wait()
+			return
+		}
+		// Wait for more spans to arrive to send them in larger batches,
+		// unless there's already enough for a full batch.
+		timer := time.NewTimer(q.cfg.BatchInterval)
+	wait:
+		for q.pendingSize() < q.cfg.BatchMaxBytes {
+			select {
+			case <-q.notify:
+			case <-timer.C:
+				break wait
+			case <-stop:
+				break wait
+			}
+		}
+		timer.Stop()
+		q.flush()
+	}
+}
+
+// Wait waits for Run to return after stop has been closed. When ctx is done
+// first, retries are given up on and the spans that haven't been sent yet are
+// dropped.
+func (q *spanQueue) Wait(ctx context.Context) error {
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+	}
+	q.abortOnce.Do(func() { close(q.abort) })
+	q.mu.Lock()
+	size := q.size
+	q.mu.Unlock()
+	return fmt.Errorf("Gave up sending %d bytes of queued spans: %w", size, ctx.Err())
+}
+
+func (q *spanQueue) pendingSize() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pendingBytes
+}
+
+// flush sends all pending spans. Batches that fail with a retryable error are
+// retried in the background, so that their backoff doesn't hold up the
+// batches after them. Retried batches still count towards QueueMaxBytes until
+// they are done.
+func (q *spanQueue) flush() {
+	q.mu.Lock()
+	pending := q.pending
+	q.pending = nil
+	q.pendingBytes = 0
+	q.mu.Unlock()
+
+	for _, batch := range coalesceSpans(pending, q.cfg.BatchMaxBytes) {
+		if q.spool != nil {
+			q.finish(batch, q.sendOrSpool(batch.spans))
+			continue
+		}
+		err := q.send(batch.spans)
+		if err == nil || !isRetryableError(err) || q.cfg.MaxRetries <= 0 {
+			q.finish(batch, err)
+			continue
+		}
+		q.retries.Add(1)
+		go func(batch coalescedSpans, err error) {
+			defer q.retries.Done()
+			q.finish(batch, q.retry(batch.spans, err))
+		}(batch, err)
+	}
+}
+
+// finish removes a sent batch from the queue.
+func (q *spanQueue) finish(batch coalescedSpans, err error) {
+	if err != nil {
+		klog.Errorf("Dropping %d span uploads: %s", batch.uploads, err)
+	}
+	q.mu.Lock()
+	q.size -= batch.size
+	q.mu.Unlock()
+}
+
+// sendOrSpool sends the batch to Zipkin. Batches that fail are spooled right
+// away instead of being retried, and batches are spooled as long as the spool
+// is not empty, so that they are sent in order.
+func (q *spanQueue) sendOrSpool(batch queuedSpans) error {
+	if q.spool.Empty() {
+		err := q.send(batch)
+		if err == nil || !isRetryableError(err) {
+			return err
+		}
+		klog.Warningf("Failed to send spans, spooling them: %s", err)
+	}
+	return q.spool.Append(batch)
+}
+
+// retry sends a batch that failed with err again, up to MaxRetries times.
+func (q *spanQueue) retry(batch queuedSpans, err error) error {
+	backoff := q.initialBackoff
+	for retry := 0; retry < q.cfg.MaxRetries; retry++ {
+		klog.Warningf("Failed to send spans, retrying in %s: %s", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-q.abort:
+			return err
+		}
+		err = q.send(batch)
+		if err == nil || !isRetryableError(err) {
+			return err
+		}
+		backoff *= 2
+		if backoff > queueMaxBackoff {
+			backoff = queueMaxBackoff
+		}
+	}
+	return err
+}
+
+// isRetryableError returns whether sending spans again might succeed. Errors
+// from the upstream are retried when it's overloaded or failing, while
+// connection errors are always retried.
+func isRetryableError(err error) bool {
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.statusCode >= 500 || statusErr.statusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+type coalescedSpans struct {
+	spans   queuedSpans
+	uploads int
+	size    int64
+}
+
+// coalesceSpans groups the uploads by path and Content-Type and merges every
+// group into batches of up to maxBytes. A single upload larger than maxBytes
+// is sent as is.
+func coalesceSpans(pending []queuedSpans, maxBytes int64) []coalescedSpans {
+	type groupKey struct{ path, contentType string }
+	var keys []groupKey
+	groups := map[groupKey][]queuedSpans{}
+	for _, spans := range pending {
+		key := groupKey{spans.path, spans.contentType}
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], spans)
+	}
+
+	var batches []coalescedSpans
+	for _, key := range keys {
+		var bodies [][]byte
+		var size int64
+		flush := func() {
+			if len(bodies) == 0 {
+				return
+			}
+			body, err := mergeSpanBodies(key.contentType, bodies)
+			if err != nil {
+				// Enqueued bodies were already parsed, so this shouldn't
+				// happen. Send them one by one just in case.
+				klog.Errorf("Failed to merge span uploads: %s", err)
+				for _, body := range bodies {
+					batches = append(batches, coalescedSpans{
+						spans:   queuedSpans{path: key.path, contentType: key.contentType, body: body},
+						uploads: 1,
+						size:    int64(len(body)),
+					})
+				}
+			} else {
+				batches = append(batches, coalescedSpans{
+					spans:   queuedSpans{path: key.path, contentType: key.contentType, body: body},
+					uploads: len(bodies),
+					size:    size,
+				})
+			}
+			bodies = nil
+			size = 0
+		}
+		for _, spans := range groups[key] {
+			if len(bodies) > 0 && size+int64(len(spans.body)) > maxBytes {
+				flush()
+			}
+			bodies = append(bodies, spans.body)
+			size += int64(len(spans.body))
+		}
+		flush()
+	}
+	return batches
+}
+
+// mergeSpanBodies merges the lists of spans into a single list.
+func mergeSpanBodies(contentType string, bodies [][]byte) ([]byte, error) {
+	if len(bodies) == 1 {
+		return bodies[0], nil
+	}
+	switch contentType {
+	case contentTypeJSON:
+		return mergeJSONSpans(bodies)
+	case contentTypeProtobuf:
+		// ListOfSpans only has the repeated spans field, so concatenating
+		// the messages concatenates the lists.
+		return bytes.Join(bodies, nil), nil
+	case contentTypeThrift:
+		return mergeThriftSpans(bodies)
+	}
+	return nil, fmt.Errorf("Content-Type %s can't be merged", contentType)
+}
+
+func mergeJSONSpans(bodies [][]byte) ([]byte, error) {
+	merged := []byte{'['}
+	empty := true
+	for _, body := range bodies {
+		body = bytes.TrimSpace(body)
+		if len(body) < 2 || body[0] != '[' || body[len(body)-1] != ']' {
+			return nil, fmt.Errorf("Expected a JSON array of spans")
+		}
+		spans := bytes.TrimSpace(body[1 : len(body)-1])
+		if len(spans) == 0 {
+			continue
+		}
+		if !empty {
+			merged = append(merged, ',')
+		}
+		merged = append(merged, spans...)
+		empty = false
+	}
+	return append(merged, ']'), nil
+}
+
+func mergeThriftSpans(bodies [][]byte) ([]byte, error) {
+	var spans []byte
+	count := 0
+	for _, body := range bodies {
+		_, err := forEachThriftListElem(body, func(_ byte, span []byte) error {
+			spans = append(spans, span...)
+			count++
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	merged := appendThriftListHeader(make([]byte, 0, len(spans)+5), thriftStruct, count)
+	return append(merged, spans...), nil
+}
+
+// CreateAsyncHandler adds the spans of span uploads to the queue after
+// enriching them and responds right away with 202 Accepted, which is what
+// Zipkin responds with as well. All other requests are passed to next.
+func CreateAsyncHandler(provider metadataProvider, cfg Config, queue *spanQueue, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		rewriteSpans, err := getSpanRewriter(req.URL.Path, req.Header)
+		if err != nil {
+			if klog.V(1) {
+				klog.Infof("Not queueing request: %s", err)
+			}
+			next.ServeHTTP(w, req)
+			return
+		}
+		if cfg.PassThroughBodySize > 0 && req.ContentLength > cfg.PassThroughBodySize {
+			// Large bodies are proxied as is instead of being buffered
+			next.ServeHTTP(w, req)
+			return
+		}
+		// getSpanRewriter already checked the Content-Type
+		contentType, _ := getSpansContentType(req.Header)
+		release, ok := acquireRequestSlot(req)
+		if !ok {
+			return
+		}
+		defer release()
+		bodyBytes, ok := readRequestBody(w, req, cfg)
+		if !ok {
+			return
+		}
+		contentEncoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+		bodyBytes, err = decodeBody(bodyBytes, contentEncoding, cfg.MaxDecompressedBodySize)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to decompress request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		// Spans are parsed even without tags to make sure that a malformed
+		// upload can't break the batch it's coalesced into.
+		bodyBytes, _, err = rewriteSpans(bodyBytes, getRequestTagValues(provider, req, cfg))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		release()
+		if err := queue.Enqueue(req.URL.Path, contentType, bodyBytes); err != nil {
+			klog.Errorf("Failed to queue spans: %s", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
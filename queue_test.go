@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+)
+
+func asyncConfig() Config {
+	cfg := DefaultConfig
+	cfg.AsyncForwarding = true
+	cfg.BatchInterval = 10 * time.Millisecond
+	return cfg
+}
+
+func TestAsyncForwarding(t *testing.T) {
+	g := NewWithT(t)
+
+	zipkin, received := fakeZipkin(http.StatusAccepted)
+	defer zipkin.Close()
+	cfg := fakeZipkinConfig(g, zipkin)
+	cfg.AsyncForwarding = true
+	cfg.BatchInterval = 50 * time.Millisecond
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+	queue := CreateSpanQueue(zipkin.Client(), cfg)
+	stop := make(chan struct{})
+	defer close(stop)
+	go queue.Run(stop)
+	handler := CreateAsyncHandler(CreateKubernetesProvider(indexer), cfg, queue, http.NotFoundHandler())
+
+	for i := 0; i < 2; i++ {
+		recorder := httptest.NewRecorder()
+		handler(recorder, spansRequest(g))
+		g.Expect(recorder.Code).To(Equal(http.StatusAccepted))
+	}
+
+	var body []byte
+	g.Eventually(received).Should(Receive(&body))
+	g.Expect(gjson.GetBytes(body, "#.tags.owner").String()).To(Equal(`["from_label","from_label"]`))
+}
+
+func TestAsyncForwardingPassesOtherRequests(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := asyncConfig()
+	queue := CreateSpanQueue(http.DefaultClient, cfg)
+	next := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := CreateAsyncHandler(CreateKubernetesProvider(CreateIndexer()), cfg, queue, next)
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/api/v2/services", nil),
+		httptest.NewRequest("POST", "/api/v2/dependencies", nil),
+	} {
+		recorder := httptest.NewRecorder()
+		handler(recorder, req)
+		g.Expect(recorder.Code).To(Equal(http.StatusTeapot))
+	}
+}
+
+func TestAsyncForwardingMalformedSpans(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := asyncConfig()
+	queue := CreateSpanQueue(http.DefaultClient, cfg)
+	handler := CreateAsyncHandler(CreateKubernetesProvider(CreateIndexer()), cfg, queue, http.NotFoundHandler())
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest("POST", "/api/v2/spans", strings.NewReader(`[{"id":`)))
+
+	g.Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	g.Expect(queue.pending).To(BeEmpty())
+}
+
+func TestAsyncForwardingQueueFull(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := asyncConfig()
+	cfg.QueueMaxBytes = 10
+	queue := CreateSpanQueue(http.DefaultClient, cfg)
+	handler := CreateAsyncHandler(CreateKubernetesProvider(CreateIndexer()), cfg, queue, http.NotFoundHandler())
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, spansRequest(g))
+
+	g.Expect(recorder.Code).To(Equal(http.StatusServiceUnavailable))
+}
+
+func TestQueueRetries(t *testing.T) {
+	cases := []struct {
+		name     string
+		failures []error
+		sends    int
+	}{
+		{"Succeeds", nil, 1},
+		{"Retries server errors", []error{
+			&upstreamStatusError{statusCode: http.StatusServiceUnavailable},
+			errors.New("connection refused"),
+		}, 3},
+		{"Gives up after MaxRetries", []error{
+			errors.New("connection refused"),
+			errors.New("connection refused"),
+			errors.New("connection refused"),
+		}, 3},
+		{"Doesn't retry client errors", []error{
+			&upstreamStatusError{statusCode: http.StatusBadRequest},
+		}, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cfg := asyncConfig()
+			cfg.MaxRetries = 2
+			queue := CreateSpanQueue(http.DefaultClient, cfg)
+			queue.initialBackoff = time.Millisecond
+			sends := 0
+			queue.send = func(batch queuedSpans) error {
+				sends++
+				if sends <= len(c.failures) {
+					return c.failures[sends-1]
+				}
+				return nil
+			}
+
+			g.Expect(queue.Enqueue("/api/v2/spans", contentTypeJSON, []byte("[]"))).To(Succeed())
+			queue.flush()
+			queue.retries.Wait()
+
+			g.Expect(sends).To(Equal(c.sends))
+			g.Expect(queue.size).To(BeZero())
+		})
+	}
+}
+
+func TestQueueRetriesDontBlockOtherBatches(t *testing.T) {
+	g := NewWithT(t)
+
+	queue := CreateSpanQueue(nil, asyncConfig())
+	queue.initialBackoff = time.Hour
+	sent := make(chan string, 10)
+	queue.send = func(batch queuedSpans) error {
+		if batch.path == "/api/v1/spans" {
+			return &upstreamStatusError{statusCode: http.StatusServiceUnavailable}
+		}
+		sent <- batch.path
+		return nil
+	}
+	stop := make(chan struct{})
+	go queue.Run(stop)
+
+	g.Expect(queue.Enqueue("/api/v1/spans", contentTypeJSON, []byte("[]"))).To(Succeed())
+	g.Eventually(queue.pendingSize).Should(BeZero())
+	g.Expect(queue.Enqueue("/api/v2/spans", contentTypeJSON, []byte("[]"))).To(Succeed())
+
+	g.Eventually(sent).Should(Receive(Equal("/api/v2/spans")))
+	close(stop)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	g.Expect(queue.Wait(ctx)).To(MatchError(ContainSubstring("Gave up sending 2 bytes")))
+}
+
+func TestQueueRejectsSpansAfterStop(t *testing.T) {
+	g := NewWithT(t)
+
+	queue := CreateSpanQueue(nil, asyncConfig())
+	queue.send = func(queuedSpans) error { return nil }
+	stop := make(chan struct{})
+	go queue.Run(stop)
+	close(stop)
+	g.Expect(queue.Wait(context.Background())).To(Succeed())
+
+	g.Expect(queue.Enqueue("/api/v2/spans", contentTypeJSON, []byte("[]"))).To(MatchError(errQueueStopped))
+}
+
+func TestQueueBatching(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := asyncConfig()
+	cfg.BatchMaxBytes = 2 * int64(len(protoListOfSpans(protoSpan(nil))))
+	queue := CreateSpanQueue(http.DefaultClient, cfg)
+	var mu sync.Mutex
+	var batches []queuedSpans
+	queue.send = func(batch queuedSpans) error {
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, batch)
+		return nil
+	}
+
+	for i := 0; i < 3; i++ {
+		g.Expect(queue.Enqueue("/api/v2/spans", contentTypeProtobuf, protoListOfSpans(protoSpan(nil)))).To(Succeed())
+	}
+	g.Expect(queue.Enqueue("/api/v1/spans", contentTypeJSON, []byte(" [ ] "))).To(Succeed())
+	g.Expect(queue.Enqueue("/api/v1/spans", contentTypeJSON, []byte(`[{"id":"1"}, {"id":"2"}]`))).To(Succeed())
+	g.Expect(queue.Enqueue("/api/v1/spans", contentTypeJSON, []byte(`[{"id":"3"}]`))).To(Succeed())
+	queue.flush()
+
+	g.Expect(batches).To(HaveLen(3))
+	g.Expect(batches[0].path).To(Equal("/api/v2/spans"))
+	g.Expect(protoSpans(g, batches[0].body)).To(HaveLen(2))
+	g.Expect(protoSpans(g, batches[1].body)).To(HaveLen(1))
+	g.Expect(batches[2].path).To(Equal("/api/v1/spans"))
+	g.Expect(batches[2].contentType).To(Equal(contentTypeJSON))
+	g.Expect(string(batches[2].body)).To(Equal(`[{"id":"1"}, {"id":"2"},{"id":"3"}]`))
+	g.Expect(queue.size).To(BeZero())
+}
+
+func TestMergeThriftSpans(t *testing.T) {
+	g := NewWithT(t)
+
+	merged, err := mergeSpanBodies(contentTypeThrift, [][]byte{
+		thriftListOfSpans(thriftSpan(map[string]string{"owner": "first"})),
+		thriftListOfSpans(),
+		thriftListOfSpans(thriftSpan(nil), thriftSpan(map[string]string{"owner": "third"})),
+	})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(thriftSpans(g, merged)).To(Equal([]map[string]string{
+		{"owner": "first"},
+		{},
+		{"owner": "third"},
+	}))
+}
+
+func TestQueuedZipkinExporter(t *testing.T) {
+	g := NewWithT(t)
+
+	queue := CreateSpanQueue(http.DefaultClient, asyncConfig())
+	exporter := CreateQueuedZipkinExporter(queue)
+
+	err := exporter.ExportSpans([]zipkinSpan{{TraceID: "5af7183fb1d4cf5f", ID: "352bff9a74ca9ad2"}}, map[string]string{"owner": "team"})
+
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(queue.pending).To(HaveLen(1))
+	g.Expect(queue.pending[0].path).To(Equal("/api/v2/spans"))
+	g.Expect(gjson.GetBytes(queue.pending[0].body, "0.tags.owner").String()).To(Equal("team"))
+}
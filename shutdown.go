@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// lifecycle shuts the proxy down gracefully. Readiness fails first so that
+// the pod is removed from the Service endpoints, then the server stops
+// accepting connections and waits for active requests, and finally the
+// registered drains, e.g. of the span queue, are run. All of it has to finish
+// within ShutdownGracePeriod.
+type lifecycle struct {
+	cfg          Config
+	shuttingDown int32
+
+	mu     sync.Mutex
+	drains []namedDrain
+}
+
+type namedDrain struct {
+	name  string
+	drain func(ctx context.Context) error
+}
+
+func CreateLifecycle(cfg Config) *lifecycle {
+	return &lifecycle{cfg: cfg}
+}
+
+// OnShutdown registers a function to run after the server has stopped.
+// Drains run in the order they were registered and all of them are run, even
+// when the grace period is already over, so that they can clean up.
+func (l *lifecycle) OnShutdown(name string, drain func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.drains = append(l.drains, namedDrain{name: name, drain: drain})
+}
+
+// ShuttingDown returns whether Shutdown has been called.
+func (l *lifecycle) ShuttingDown() bool {
+	return atomic.LoadInt32(&l.shuttingDown) == 1
+}
+
+// Shutdown stops the server and runs the drains. It returns the first error
+// of the server or the drains.
+func (l *lifecycle) Shutdown(server *http.Server) error {
+	ctx, cancel := context.WithTimeout(context.Background(), l.cfg.ShutdownGracePeriod)
+	defer cancel()
+	atomic.StoreInt32(&l.shuttingDown, 1)
+
+	// Keep serving while the endpoints are updated, as new requests can
+	// arrive until then.
+	klog.Infof("Failing readiness, stopping the server in %s", l.cfg.ShutdownDelay)
+	select {
+	case <-time.After(l.cfg.ShutdownDelay):
+	case <-ctx.Done():
+	}
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		klog.Errorf("Failed to wait for active requests: %s", err)
+	}
+
+	l.mu.Lock()
+	drains := l.drains
+	l.mu.Unlock()
+	for _, d := range drains {
+		if klog.V(1) {
+			klog.Infof("Draining %s", d.name)
+		}
+		if drainErr := d.drain(ctx); drainErr != nil {
+			klog.Errorf("Failed to drain %s: %s", d.name, drainErr)
+			if err == nil {
+				err = drainErr
+			}
+		}
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := DefaultConfig
+	cfg.ShutdownDelay = 100 * time.Millisecond
+	cfg.ShutdownGracePeriod = 5 * time.Second
+	lc := CreateLifecycle(cfg)
+	var drained []string
+	lc.OnShutdown("first", func(context.Context) error {
+		drained = append(drained, "first")
+		return nil
+	})
+	lc.OnShutdown("second", func(context.Context) error {
+		drained = append(drained, "second")
+		return nil
+	})
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", CreateReadyzHandler(shutdownHealthCheck(lc)))
+	mux.HandleFunc("/api/v2/spans", func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	inFlight := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(server.URL+"/api/v2/spans", contentTypeJSON, nil)
+		if err != nil {
+			inFlight <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	<-started
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- lc.Shutdown(server.Config) }()
+
+	// Readiness fails while the server is still accepting requests
+	g.Eventually(func() int {
+		resp, err := http.Get(server.URL + "/healthz")
+		g.Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		return resp.StatusCode
+	}).Should(Equal(http.StatusServiceUnavailable))
+
+	// The server waits for the active request before draining
+	g.Consistently(shutdownErr, 200*time.Millisecond).ShouldNot(Receive())
+	g.Expect(drained).To(BeEmpty())
+	close(release)
+
+	g.Eventually(inFlight).Should(Receive(Equal(http.StatusAccepted)))
+	g.Eventually(shutdownErr).Should(Receive(BeNil()))
+	g.Expect(drained).To(Equal([]string{"first", "second"}))
+	_, err := http.Get(server.URL + "/healthz")
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestShutdownRunsAllDrains(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := DefaultConfig
+	cfg.ShutdownDelay = 0
+	lc := CreateLifecycle(cfg)
+	drainErr := errors.New("failed")
+	secondRan := false
+	lc.OnShutdown("first", func(context.Context) error { return drainErr })
+	lc.OnShutdown("second", func(context.Context) error {
+		secondRan = true
+		return nil
+	})
+
+	g.Expect(lc.Shutdown(&http.Server{})).To(MatchError(drainErr))
+	g.Expect(secondRan).To(BeTrue())
+}
+
+func TestQueueDrainsOnShutdown(t *testing.T) {
+	g := NewWithT(t)
+
+	zipkin, received := fakeZipkin(http.StatusAccepted)
+	defer zipkin.Close()
+	cfg := fakeZipkinConfig(g, zipkin)
+	cfg.AsyncForwarding = true
+	// Longer than the test, so only the shutdown sends the spans
+	cfg.BatchInterval = time.Hour
+	queue := CreateSpanQueue(zipkin.Client(), cfg)
+	stop := make(chan struct{})
+	go queue.Run(stop)
+
+	g.Expect(queue.Enqueue("/api/v2/spans", contentTypeJSON, []byte(`[{"id":"1"}]`))).To(Succeed())
+	close(stop)
+
+	g.Expect(queue.Wait(context.Background())).To(Succeed())
+	g.Expect(received).To(Receive(MatchJSON(`[{"id":"1"}]`)))
+}
+
+func TestQueueDrainGivesUpAfterGracePeriod(t *testing.T) {
+	g := NewWithT(t)
+
+	queue := CreateSpanQueue(nil, asyncConfig())
+	queue.initialBackoff = time.Hour
+	queue.send = func(queuedSpans) error {
+		return errors.New("connection refused")
+	}
+	stop := make(chan struct{})
+	go queue.Run(stop)
+
+	g.Expect(queue.Enqueue("/api/v2/spans", contentTypeJSON, []byte(`[]`))).To(Succeed())
+	close(stop)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	g.Expect(queue.Wait(ctx)).To(MatchError(ContainSubstring("Gave up sending 2 bytes")))
+	g.Eventually(queue.done).Should(BeClosed())
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// Files in the spool directory. Segments are named after their sequence
+// number, so that sorting them by name sorts them by age.
+const (
+	spoolSegmentSuffix  = ".seg"
+	spoolCheckpointFile = "checkpoint"
+)
+
+// spoolRecordHeaderSize is the size of the header of each record, which has
+// the length and the CRC-32 of the record's payload.
+const spoolRecordHeaderSize = 8
+
+// spoolCapsInterval is how often the size and age caps are enforced while
+// there's nothing to replay.
+const spoolCapsInterval = time.Minute
+
+var errSpoolCorrupted = errors.New("Corrupted spool record")
+
+type spoolSegment struct {
+	seq     uint64
+	size    int64
+	modTime time.Time
+}
+
+// spoolRecord is a batch of spans read from the spool with its position.
+type spoolRecord struct {
+	spans queuedSpans
+	seq   uint64
+	end   int64
+}
+
+// spanSpool is a write-ahead log of span batches that couldn't be sent to
+// Zipkin. Batches are appended to segment files in the spool directory and
+// are replayed in order once Zipkin recovers. The position of the replay is
+// saved in a checkpoint file, so that spooled batches survive restarts.
+//
+// The oldest segments are dropped when the spool is larger than
+// SpoolMaxBytes, and segments are dropped once they are older than
+// SpoolMaxAge.
+type spanSpool struct {
+	dir          string
+	maxBytes     int64
+	maxAge       time.Duration
+	segmentBytes int64
+	send         func(batch queuedSpans) error
+	// initialBackoff is a field so that tests don't have to wait for retries
+	initialBackoff time.Duration
+
+	mu       sync.Mutex
+	segments []spoolSegment
+	// writer is the segment that batches are appended to, which is always
+	// the last one. Segments from before a restart are never appended to.
+	writer *os.File
+	// readSeq and readOffset are the position of the next record to replay
+	readSeq    uint64
+	readOffset int64
+	// lastSeq is the highest sequence number that was used, including by
+	// segments that were already removed
+	lastSeq uint64
+	notify  chan struct{}
+}
+
+// OpenSpanSpool opens the spool in cfg.SpoolDir, creating the directory if
+// needed. Spooled batches are replayed with send.
+func OpenSpanSpool(cfg Config, send func(batch queuedSpans) error) (*spanSpool, error) {
+	if err := os.MkdirAll(cfg.SpoolDir, 0700); err != nil {
+		return nil, fmt.Errorf("Failed to create spool directory: %w", err)
+	}
+	s := &spanSpool{
+		dir:            cfg.SpoolDir,
+		maxBytes:       cfg.SpoolMaxBytes,
+		maxAge:         cfg.SpoolMaxAge,
+		segmentBytes:   cfg.SpoolSegmentBytes,
+		send:           send,
+		initialBackoff: queueInitialBackoff,
+		notify:         make(chan struct{}, 1),
+	}
+	files, err := ioutil.ReadDir(cfg.SpoolDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read spool directory: %w", err)
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, spoolSegmentSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolSegmentSuffix), 10, 64)
+		if err != nil {
+			klog.Warningf("Ignoring unexpected file %s in the spool directory", name)
+			continue
+		}
+		s.segments = append(s.segments, spoolSegment{seq: seq, size: file.Size(), modTime: file.ModTime()})
+		if seq > s.lastSeq {
+			s.lastSeq = seq
+		}
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].seq < s.segments[j].seq })
+	if err := s.readCheckpoint(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.enforceCaps(time.Now())
+	s.mu.Unlock()
+	if klog.V(1) {
+		klog.Infof("Opened spool with %d segments", len(s.segments))
+	}
+	return s, nil
+}
+
+func (s *spanSpool) segmentPath(seq uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, spoolSegmentSuffix))
+}
+
+func (s *spanSpool) readCheckpoint() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, spoolCheckpointFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to read spool checkpoint: %w", err)
+	}
+	if _, err := fmt.Sscanf(string(data), "%d %d", &s.readSeq, &s.readOffset); err != nil {
+		// Replaying from the start only causes duplicate spans
+		klog.Errorf("Ignoring invalid spool checkpoint: %s", err)
+		s.readSeq, s.readOffset = 0, 0
+	}
+	return nil
+}
+
+// writeCheckpoint saves the replay position. The file is replaced atomically
+// so that a crash can't leave a partially written checkpoint.
+func (s *spanSpool) writeCheckpoint() error {
+	path := filepath.Join(s.dir, spoolCheckpointFile)
+	data := fmt.Sprintf("%d %d\n", s.readSeq, s.readOffset)
+	if err := ioutil.WriteFile(path+".tmp", []byte(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Append adds a batch to the end of the spool.
+func (s *spanSpool) Append(batch queuedSpans) error {
+	payload := make([]byte, 0, len(batch.body)+len(batch.path)+len(batch.contentType)+2*binary.MaxVarintLen64)
+	payload = appendProtoVarint(payload, uint64(len(batch.path)))
+	payload = append(payload, batch.path...)
+	payload = appendProtoVarint(payload, uint64(len(batch.contentType)))
+	payload = append(payload, batch.contentType...)
+	payload = append(payload, batch.body...)
+	record := make([]byte, spoolRecordHeaderSize, spoolRecordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writer == nil || s.segments[len(s.segments)-1].size >= s.segmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	// Write and sync the record before it's accounted for, so that the
+	// replay never reads a partially written record.
+	if _, err := s.writer.Write(record); err != nil {
+		return fmt.Errorf("Failed to write to spool: %w", err)
+	}
+	if err := s.writer.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync spool: %w", err)
+	}
+	segment := &s.segments[len(s.segments)-1]
+	segment.size += int64(len(record))
+	segment.modTime = time.Now()
+	s.enforceCaps(segment.modTime)
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate closes the current segment and starts a new one.
+func (s *spanSpool) rotate() error {
+	if s.writer != nil {
+		if err := s.writer.Close(); err != nil {
+			klog.Errorf("Failed to close spool segment: %s", err)
+		}
+		s.writer = nil
+	}
+	// Sequence numbers are never reused. Once replayed segments are removed,
+	// a reused number could be at or before the checkpoint and be skipped.
+	seq := s.lastSeq
+	if s.readSeq > seq {
+		seq = s.readSeq
+	}
+	seq++
+	writer, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create spool segment: %w", err)
+	}
+	s.writer = writer
+	s.lastSeq = seq
+	s.segments = append(s.segments, spoolSegment{seq: seq, modTime: time.Now()})
+	return nil
+}
+
+// enforceCaps drops the oldest segments while the spool is too large and
+// segments that are too old. It has to be called with the lock held.
+func (s *spanSpool) enforceCaps(now time.Time) {
+	var size int64
+	for _, segment := range s.segments {
+		size += segment.size
+	}
+	for len(s.segments) > 0 {
+		oldest := s.segments[0]
+		tooLarge := size > s.maxBytes && len(s.segments) > 1
+		tooOld := s.maxAge > 0 && now.Sub(oldest.modTime) > s.maxAge
+		if !tooLarge && !tooOld {
+			return
+		}
+		if oldest.seq >= s.readSeq && oldest.size > 0 {
+			klog.Warningf("Dropping spool segment %d with %d bytes of spans, the spool is too large or too old", oldest.seq, oldest.size)
+		}
+		size -= oldest.size
+		s.removeOldestSegment()
+	}
+}
+
+// removeOldestSegment deletes the oldest segment. It has to be called with
+// the lock held.
+func (s *spanSpool) removeOldestSegment() {
+	oldest := s.segments[0]
+	if len(s.segments) == 1 && s.writer != nil {
+		if err := s.writer.Close(); err != nil {
+			klog.Errorf("Failed to close spool segment: %s", err)
+		}
+		s.writer = nil
+	}
+	if err := os.Remove(s.segmentPath(oldest.seq)); err != nil && !os.IsNotExist(err) {
+		klog.Errorf("Failed to remove spool segment %d: %s", oldest.seq, err)
+	}
+	s.segments = s.segments[1:]
+	if s.readSeq <= oldest.seq {
+		s.readSeq = oldest.seq + 1
+		s.readOffset = 0
+	}
+}
+
+// Empty returns whether all spooled batches have been replayed.
+func (s *spanSpool) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, segment := range s.segments {
+		if segment.seq > s.readSeq || (segment.seq == s.readSeq && s.readOffset < segment.size) {
+			return false
+		}
+	}
+	return true
+}
+
+// next reads the next record to replay. It returns nil when everything has
+// been replayed.
+func (s *spanSpool) next() (*spoolRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.segments) > 0 {
+		segment := s.segments[0]
+		if segment.seq < s.readSeq {
+			s.removeOldestSegment()
+			continue
+		}
+		if segment.seq > s.readSeq {
+			s.readSeq = segment.seq
+			s.readOffset = 0
+		}
+		if s.readOffset >= segment.size {
+			if len(s.segments) == 1 && s.writer != nil {
+				// Everything that was written has been replayed
+				return nil, nil
+			}
+			s.removeOldestSegment()
+			continue
+		}
+		record, err := s.readRecord(segment)
+		if err != nil {
+			// The rest of the segment can't be read, e.g. because a crash
+			// left a partially written record.
+			klog.Errorf("Skipping the rest of spool segment %d: %s", segment.seq, err)
+			s.readOffset = segment.size
+			continue
+		}
+		return record, nil
+	}
+	return nil, nil
+}
+
+func (s *spanSpool) readRecord(segment spoolSegment) (*spoolRecord, error) {
+	f, err := os.Open(s.segmentPath(segment.seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var header [spoolRecordHeaderSize]byte
+	if _, err := f.ReadAt(header[:], s.readOffset); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	end := s.readOffset + spoolRecordHeaderSize + length
+	if end > segment.size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, s.readOffset+spoolRecordHeaderSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errSpoolCorrupted
+	}
+	path, n := readSpoolString(payload)
+	if n < 0 {
+		return nil, errSpoolCorrupted
+	}
+	payload = payload[n:]
+	contentType, n := readSpoolString(payload)
+	if n < 0 {
+		return nil, errSpoolCorrupted
+	}
+	return &spoolRecord{
+		spans: queuedSpans{path: path, contentType: contentType, body: payload[n:]},
+		seq:   segment.seq,
+		end:   end,
+	}, nil
+}
+
+// readSpoolString reads a length prefixed string and returns it with the
+// number of bytes read, which is negative when the data is invalid.
+func readSpoolString(data []byte) (string, int) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < length {
+		return "", -1
+	}
+	return string(data[n : n+int(length)]), n + int(length)
+}
+
+// commit marks the record as replayed.
+func (s *spanSpool) commit(record *spoolRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if record.seq != s.readSeq {
+		// The segment was dropped while the record was being replayed
+		return
+	}
+	s.readOffset = record.end
+	if err := s.writeCheckpoint(); err != nil {
+		klog.Errorf("Failed to write spool checkpoint: %s", err)
+	}
+}
+
+// Run replays spooled batches until stop is closed. Batches that fail with a
+// retryable error are retried with an exponential backoff until they succeed
+// or are dropped because of the caps.
+func (s *spanSpool) Run(stop <-chan struct{}) {
+	backoff := s.initialBackoff
+	for {
+		record, err := s.next()
+		if err != nil {
+			klog.Errorf("Failed to read from spool: %s", err)
+		}
+		if record == nil {
+			select {
+			case <-s.notify:
+			case <-time.After(spoolCapsInterval):
+				s.mu.Lock()
+				s.enforceCaps(time.Now())
+				s.mu.Unlock()
+			case <-stop:
+				return
+			}
+			continue
+		}
+		err = s.send(record.spans)
+		if err != nil && isRetryableError(err) {
+			klog.Warningf("Failed to replay spooled spans, retrying in %s: %s", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-stop:
+				return
+			}
+			backoff *= 2
+			if backoff > queueMaxBackoff {
+				backoff = queueMaxBackoff
+			}
+			continue
+		}
+		if err != nil {
+			klog.Errorf("Dropping spooled spans: %s", err)
+		}
+		backoff = s.initialBackoff
+		s.commit(record)
+	}
+}
+
+// Close closes the segment that batches are appended to.
+func (s *spanSpool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+)
+
+func spoolConfig(g *WithT) Config {
+	dir, err := ioutil.TempDir("", "zipkates-spool")
+	g.Expect(err).NotTo(HaveOccurred())
+	cfg := asyncConfig()
+	cfg.SpoolDir = dir
+	return cfg
+}
+
+// recordingSender records the bodies of the sent batches and fails while
+// failures is positive.
+type recordingSender struct {
+	mu       sync.Mutex
+	bodies   []string
+	failures int
+}
+
+func (r *recordingSender) send(batch queuedSpans) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failures > 0 {
+		r.failures--
+		return errors.New("connection refused")
+	}
+	r.bodies = append(r.bodies, batch.path+" "+batch.contentType+" "+string(batch.body))
+	return nil
+}
+
+func (r *recordingSender) sent() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.bodies...)
+}
+
+func spooledBatch(i int) queuedSpans {
+	return queuedSpans{path: "/api/v2/spans", contentType: contentTypeJSON, body: []byte(fmt.Sprintf(`[{"id":"%d"}]`, i))}
+}
+
+func replaySpool(g *WithT, cfg Config, sender *recordingSender, expected int) {
+	spool, err := OpenSpanSpool(cfg, sender.send)
+	g.Expect(err).NotTo(HaveOccurred())
+	spool.initialBackoff = time.Millisecond
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		spool.Run(stop)
+		close(done)
+	}()
+	g.Eventually(func() int { return len(sender.sent()) }).Should(Equal(expected))
+	g.Eventually(spool.Empty).Should(BeTrue())
+	close(stop)
+	<-done
+	g.Expect(spool.Close()).To(Succeed())
+}
+
+func TestSpoolReplaysInOrderAfterRestart(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := spoolConfig(g)
+	defer os.RemoveAll(cfg.SpoolDir)
+	cfg.SpoolSegmentBytes = 50
+	spool, err := OpenSpanSpool(cfg, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	for i := 0; i < 5; i++ {
+		g.Expect(spool.Append(spooledBatch(i))).To(Succeed())
+	}
+	g.Expect(spool.Empty()).To(BeFalse())
+	g.Expect(spool.Close()).To(Succeed())
+
+	sender := &recordingSender{failures: 2}
+	replaySpool(g, cfg, sender, 5)
+	g.Expect(sender.sent()).To(Equal([]string{
+		`/api/v2/spans application/json [{"id":"0"}]`,
+		`/api/v2/spans application/json [{"id":"1"}]`,
+		`/api/v2/spans application/json [{"id":"2"}]`,
+		`/api/v2/spans application/json [{"id":"3"}]`,
+		`/api/v2/spans application/json [{"id":"4"}]`,
+	}))
+
+	// Replayed batches are not replayed again after another restart
+	spool, err = OpenSpanSpool(cfg, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(spool.Empty()).To(BeTrue())
+}
+
+func TestSpoolDoesNotReuseReplayedSequenceNumbers(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := spoolConfig(g)
+	defer os.RemoveAll(cfg.SpoolDir)
+	spool, err := OpenSpanSpool(cfg, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(spool.Append(spooledBatch(0))).To(Succeed())
+	g.Expect(spool.Close()).To(Succeed())
+	sender := &recordingSender{}
+	// Removes the replayed segment, so that only the checkpoint is left
+	replaySpool(g, cfg, sender, 1)
+
+	spool, err = OpenSpanSpool(cfg, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(spool.Append(spooledBatch(1))).To(Succeed())
+	g.Expect(spool.Empty()).To(BeFalse())
+	g.Expect(spool.Close()).To(Succeed())
+
+	replaySpool(g, cfg, sender, 2)
+	g.Expect(sender.sent()).To(Equal([]string{
+		`/api/v2/spans application/json [{"id":"0"}]`,
+		`/api/v2/spans application/json [{"id":"1"}]`,
+	}))
+}
+
+func TestSpoolSkipsPartiallyWrittenRecords(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := spoolConfig(g)
+	defer os.RemoveAll(cfg.SpoolDir)
+	spool, err := OpenSpanSpool(cfg, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(spool.Append(spooledBatch(0))).To(Succeed())
+	g.Expect(spool.Append(spooledBatch(1))).To(Succeed())
+	g.Expect(spool.Close()).To(Succeed())
+	segment := spool.segmentPath(1)
+	info, err := os.Stat(segment)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(os.Truncate(segment, info.Size()-1)).To(Succeed())
+
+	sender := &recordingSender{}
+	replaySpool(g, cfg, sender, 1)
+	g.Expect(sender.sent()).To(Equal([]string{`/api/v2/spans application/json [{"id":"0"}]`}))
+}
+
+func TestSpoolMaxBytes(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := spoolConfig(g)
+	defer os.RemoveAll(cfg.SpoolDir)
+	cfg.SpoolSegmentBytes = 1
+	cfg.SpoolMaxBytes = 160
+	spool, err := OpenSpanSpool(cfg, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	for i := 0; i < 5; i++ {
+		g.Expect(spool.Append(spooledBatch(i))).To(Succeed())
+	}
+	g.Expect(spool.Close()).To(Succeed())
+
+	segments, err := filepath.Glob(filepath.Join(cfg.SpoolDir, "*"+spoolSegmentSuffix))
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(segments).To(HaveLen(3))
+	sender := &recordingSender{}
+	replaySpool(g, cfg, sender, 3)
+	g.Expect(sender.sent()[0]).To(Equal(`/api/v2/spans application/json [{"id":"2"}]`))
+}
+
+func TestSpoolMaxAge(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := spoolConfig(g)
+	defer os.RemoveAll(cfg.SpoolDir)
+	cfg.SpoolSegmentBytes = 1
+	spool, err := OpenSpanSpool(cfg, nil)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(spool.Append(spooledBatch(0))).To(Succeed())
+	g.Expect(spool.Append(spooledBatch(1))).To(Succeed())
+	g.Expect(spool.Close()).To(Succeed())
+	old := time.Now().Add(-2 * cfg.SpoolMaxAge)
+	g.Expect(os.Chtimes(spool.segmentPath(1), old, old)).To(Succeed())
+
+	sender := &recordingSender{}
+	replaySpool(g, cfg, sender, 1)
+	g.Expect(sender.sent()).To(Equal([]string{`/api/v2/spans application/json [{"id":"1"}]`}))
+}
+
+func TestQueueSpoolsFailedBatches(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := spoolConfig(g)
+	defer os.RemoveAll(cfg.SpoolDir)
+	queue := CreateSpanQueue(nil, cfg)
+	sender := &recordingSender{failures: 1}
+	queue.send = sender.send
+	spool, err := OpenSpanSpool(cfg, sender.send)
+	g.Expect(err).NotTo(HaveOccurred())
+	queue.spool = spool
+
+	g.Expect(queue.Enqueue("/api/v2/spans", contentTypeJSON, []byte(`[{"id":"0"}]`))).To(Succeed())
+	queue.flush()
+	g.Expect(spool.Empty()).To(BeFalse())
+	// Later batches are spooled as well to keep them in order
+	g.Expect(queue.Enqueue("/api/v2/spans", contentTypeJSON, []byte(`[{"id":"1"}]`))).To(Succeed())
+	queue.flush()
+	g.Expect(sender.sent()).To(BeEmpty())
+	g.Expect(spool.Close()).To(Succeed())
+
+	replaySpool(g, cfg, sender, 2)
+	g.Expect(sender.sent()).To(Equal([]string{
+		`/api/v2/spans application/json [{"id":"0"}]`,
+		`/api/v2/spans application/json [{"id":"1"}]`,
+	}))
+}
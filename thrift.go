@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"k8s.io/klog"
+)
+
+// Thrift type IDs as used by TBinaryProtocol.
+const (
+	thriftStop   = 0
+	thriftBool   = 2
+	thriftByte   = 3
+	thriftDouble = 4
+	thriftI16    = 6
+	thriftI32    = 8
+	thriftI64    = 10
+	thriftString = 11
+	thriftStruct = 12
+	thriftMap    = 13
+	thriftSet    = 14
+	thriftList   = 15
+)
+
+// Field IDs from the Zipkin v1 Thrift definition in
+// https://github.com/openzipkin/zipkin-api/blob/master/thrift/zipkinCore.thrift
+const (
+	zipkinV1SpanAnnotations       = 6
+	zipkinV1SpanBinaryAnnotations = 8
+	zipkinV1AnnotationHost        = 3
+	zipkinV1BinaryAnnotationKey   = 1
+	zipkinV1BinaryAnnotationValue = 2
+	zipkinV1BinaryAnnotationType  = 3
+	zipkinV1BinaryAnnotationHost  = 4
+	zipkinV1AnnotationTypeString  = 6
+)
+
+// thriftMaxDepth limits how deeply nested structs and containers can be, so
+// that malicious requests can't exhaust the stack.
+const thriftMaxDepth = 64
+
+var errThriftTruncated = errors.New("Truncated thrift message")
+
+// thriftField is a single field of a TBinaryProtocol encoded struct. raw holds
+// the whole field including its header, while value only holds the value. The
+// value of a struct field includes its stop byte.
+type thriftField struct {
+	id    int16
+	typ   byte
+	value []byte
+	raw   []byte
+}
+
+// thriftValueLength returns the length of the encoded value of the given type
+// at the start of b.
+func thriftValueLength(b []byte, typ byte, depth int) (int, error) {
+	if depth > thriftMaxDepth {
+		return 0, fmt.Errorf("Thrift message is nested more than %d levels deep", thriftMaxDepth)
+	}
+	var length int
+	switch typ {
+	case thriftBool, thriftByte:
+		length = 1
+	case thriftI16:
+		length = 2
+	case thriftI32:
+		length = 4
+	case thriftDouble, thriftI64:
+		length = 8
+	case thriftString:
+		if len(b) < 4 {
+			return 0, errThriftTruncated
+		}
+		length = 4 + int(binary.BigEndian.Uint32(b))
+	case thriftStruct:
+		return forEachThriftFieldDepth(b, depth+1, func(thriftField) error { return nil })
+	case thriftMap:
+		if len(b) < 6 {
+			return 0, errThriftTruncated
+		}
+		keyType, valueType := b[0], b[1]
+		size := int(int32(binary.BigEndian.Uint32(b[2:])))
+		length = 6
+		for i := 0; i < size; i++ {
+			for _, elemType := range []byte{keyType, valueType} {
+				n, err := thriftValueLength(b[length:], elemType, depth+1)
+				if err != nil {
+					return 0, err
+				}
+				length += n
+			}
+		}
+	case thriftSet, thriftList:
+		return forEachThriftListElemDepth(b, depth+1, func(byte, []byte) error { return nil })
+	default:
+		return 0, fmt.Errorf("Unsupported thrift type %d", typ)
+	}
+	if length < 0 || length > len(b) {
+		return 0, errThriftTruncated
+	}
+	return length, nil
+}
+
+// forEachThriftField calls fn for every field of the struct at the start of b
+// and returns the length of the struct including its stop byte.
+func forEachThriftField(b []byte, fn func(field thriftField) error) (int, error) {
+	return forEachThriftFieldDepth(b, 0, fn)
+}
+
+func forEachThriftFieldDepth(b []byte, depth int, fn func(field thriftField) error) (int, error) {
+	pos := 0
+	for {
+		if pos >= len(b) {
+			return 0, errThriftTruncated
+		}
+		typ := b[pos]
+		if typ == thriftStop {
+			return pos + 1, nil
+		}
+		if pos+3 > len(b) {
+			return 0, errThriftTruncated
+		}
+		id := int16(binary.BigEndian.Uint16(b[pos+1:]))
+		n, err := thriftValueLength(b[pos+3:], typ, depth)
+		if err != nil {
+			return 0, err
+		}
+		field := thriftField{
+			id:    id,
+			typ:   typ,
+			value: b[pos+3 : pos+3+n],
+			raw:   b[pos : pos+3+n],
+		}
+		if err := fn(field); err != nil {
+			return 0, err
+		}
+		pos += 3 + n
+	}
+}
+
+// forEachThriftListElem calls fn for every element of the list at the start
+// of b and returns the length of the whole list including its header.
+func forEachThriftListElem(b []byte, fn func(elemType byte, elem []byte) error) (int, error) {
+	return forEachThriftListElemDepth(b, 0, fn)
+}
+
+func forEachThriftListElemDepth(b []byte, depth int, fn func(elemType byte, elem []byte) error) (int, error) {
+	if len(b) < 5 {
+		return 0, errThriftTruncated
+	}
+	elemType := b[0]
+	size := int(int32(binary.BigEndian.Uint32(b[1:])))
+	pos := 5
+	for i := 0; i < size; i++ {
+		n, err := thriftValueLength(b[pos:], elemType, depth)
+		if err != nil {
+			return 0, err
+		}
+		if err := fn(elemType, b[pos:pos+n]); err != nil {
+			return 0, err
+		}
+		pos += n
+	}
+	return pos, nil
+}
+
+func appendThriftFieldHeader(buf []byte, typ byte, id int16) []byte {
+	buf = append(buf, typ)
+	return append(buf, byte(uint16(id)>>8), byte(id))
+}
+
+func appendThriftListHeader(buf []byte, elemType byte, size int) []byte {
+	buf = append(buf, elemType)
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], uint32(size))
+	return append(buf, scratch[:]...)
+}
+
+func appendThriftString(buf []byte, id int16, value string) []byte {
+	buf = appendThriftFieldHeader(buf, thriftString, id)
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], uint32(len(value)))
+	buf = append(buf, scratch[:]...)
+	return append(buf, value...)
+}
+
+func appendThriftI32(buf []byte, id int16, value int32) []byte {
+	buf = appendThriftFieldHeader(buf, thriftI32, id)
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], uint32(value))
+	return append(buf, scratch[:]...)
+}
+
+// thriftStringValue returns the contents of an encoded string or binary value.
+func thriftStringValue(value []byte) string {
+	return string(value[4:])
+}
+
+// addTagsV1Thrift adds the tag values to a TBinaryProtocol encoded list of
+// Zipkin v1 spans as string binary annotations. Like with proto3, the spans
+// are not fully decoded and all other fields are copied over byte for byte.
+func addTagsV1Thrift(body []byte, tagValues map[string]string) ([]byte, bool, error) {
+	if len(body) < 1 || body[0] != thriftStruct {
+		return nil, false, fmt.Errorf("Expected a thrift list of spans")
+	}
+	// The list header is the element type and the 4 byte size
+	if len(body) < 5 {
+		return nil, false, fmt.Errorf("Failed to parse thrift spans: %w", errThriftTruncated)
+	}
+	newBody := make([]byte, 0, len(body))
+	newBody = append(newBody, body[:5]...)
+	modified := false
+	n, err := forEachThriftListElem(body, func(_ byte, span []byte) error {
+		newSpan, spanModified, err := addThriftBinaryAnnotations(span, tagValues)
+		if err != nil {
+			return err
+		}
+		if spanModified {
+			modified = true
+		}
+		newBody = append(newBody, newSpan...)
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to parse thrift spans: %w", err)
+	}
+	if !modified {
+		return body, false, nil
+	}
+	newBody = append(newBody, body[n:]...)
+	return newBody, true, nil
+}
+
+func addThriftBinaryAnnotations(span []byte, tagValues map[string]string) ([]byte, bool, error) {
+	var binaryAnnotations [][]byte
+	existing := map[string]bool{}
+	var endpoint []byte
+	_, err := forEachThriftField(span, func(field thriftField) error {
+		if field.typ != thriftList {
+			return nil
+		}
+		switch field.id {
+		case zipkinV1SpanAnnotations:
+			_, err := forEachThriftListElem(field.value, func(_ byte, annotation []byte) error {
+				_, err := forEachThriftField(annotation, func(annotationField thriftField) error {
+					if annotationField.id == zipkinV1AnnotationHost && annotationField.typ == thriftStruct && endpoint == nil {
+						endpoint = annotationField.value
+					}
+					return nil
+				})
+				return err
+			})
+			return err
+		case zipkinV1SpanBinaryAnnotations:
+			_, err := forEachThriftListElem(field.value, func(elemType byte, annotation []byte) error {
+				if elemType != thriftStruct {
+					return fmt.Errorf("Expected binary annotations to be structs, got type %d", elemType)
+				}
+				binaryAnnotations = append(binaryAnnotations, annotation)
+				var key string
+				var value, host []byte
+				_, err := forEachThriftField(annotation, func(annotationField thriftField) error {
+					switch {
+					case annotationField.id == zipkinV1BinaryAnnotationKey && annotationField.typ == thriftString:
+						key = thriftStringValue(annotationField.value)
+					case annotationField.id == zipkinV1BinaryAnnotationValue && annotationField.typ == thriftString:
+						value = annotationField.value[4:]
+					case annotationField.id == zipkinV1BinaryAnnotationHost && annotationField.typ == thriftStruct:
+						host = annotationField.value
+					}
+					return nil
+				})
+				if len(value) > 0 {
+					existing[key] = true
+				}
+				if endpoint == nil && host != nil && !v1AddressAnnotationKeys[key] {
+					endpoint = host
+				}
+				return err
+			})
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	added := 0
+	for tagName, value := range tagValues {
+		if existing[tagName] {
+			if klog.V(1) {
+				klog.Infof("Binary annotation %s is already set for the span, skipping", tagName)
+			}
+			continue
+		}
+		var annotation []byte
+		annotation = appendThriftString(annotation, zipkinV1BinaryAnnotationKey, tagName)
+		annotation = appendThriftString(annotation, zipkinV1BinaryAnnotationValue, value)
+		annotation = appendThriftI32(annotation, zipkinV1BinaryAnnotationType, zipkinV1AnnotationTypeString)
+		if endpoint != nil {
+			annotation = appendThriftFieldHeader(annotation, thriftStruct, zipkinV1BinaryAnnotationHost)
+			annotation = append(annotation, endpoint...)
+		}
+		annotation = append(annotation, thriftStop)
+		binaryAnnotations = append(binaryAnnotations, annotation)
+		added++
+	}
+	if added == 0 {
+		return span, false, nil
+	}
+
+	var list []byte
+	list = appendThriftFieldHeader(list, thriftList, zipkinV1SpanBinaryAnnotations)
+	list = appendThriftListHeader(list, thriftStruct, len(binaryAnnotations))
+	for _, annotation := range binaryAnnotations {
+		list = append(list, annotation...)
+	}
+
+	newSpan := make([]byte, 0, len(span)+len(list))
+	replaced := false
+	_, err = forEachThriftField(span, func(field thriftField) error {
+		if field.id == zipkinV1SpanBinaryAnnotations && field.typ == thriftList {
+			newSpan = append(newSpan, list...)
+			replaced = true
+			return nil
+		}
+		newSpan = append(newSpan, field.raw...)
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if !replaced {
+		newSpan = append(newSpan, list...)
+	}
+	newSpan = append(newSpan, thriftStop)
+	return newSpan, true, nil
+}
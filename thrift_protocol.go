@@ -0,0 +1,500 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// thriftProtocolReader decodes values encoded with either TBinaryProtocol or
+// TCompactProtocol. Types are always reported as TBinaryProtocol type IDs.
+// Unlike the functions in thrift.go, it's meant for fully decoding messages.
+type thriftProtocolReader interface {
+	readStructBegin() error
+	readStructEnd()
+	// readFieldBegin returns thriftStop as the type after the last field.
+	readFieldBegin() (typ byte, id int16, err error)
+	readListBegin() (elemType byte, size int, err error)
+	readMapBegin() (keyType, valueType byte, size int, err error)
+	readBool() (bool, error)
+	readByte() (byte, error)
+	readI16() (int16, error)
+	readI32() (int32, error)
+	readI64() (int64, error)
+	readDouble() (float64, error)
+	readBinary() ([]byte, error)
+	skip(typ byte) error
+}
+
+// readThriftStruct calls fn for every field of the struct. fn has to read the
+// value of the field, or skip it.
+func readThriftStruct(r thriftProtocolReader, fn func(typ byte, id int16) error) error {
+	if err := r.readStructBegin(); err != nil {
+		return err
+	}
+	for {
+		typ, id, err := r.readFieldBegin()
+		if err != nil {
+			return err
+		}
+		if typ == thriftStop {
+			break
+		}
+		if err := fn(typ, id); err != nil {
+			return err
+		}
+	}
+	r.readStructEnd()
+	return nil
+}
+
+// readThriftList calls fn for every element of a list with the given element
+// type. fn has to read the value of the element.
+func readThriftList(r thriftProtocolReader, elemType byte, fn func() error) error {
+	actualType, size, err := r.readListBegin()
+	if err != nil {
+		return err
+	}
+	if actualType != elemType {
+		for i := 0; i < size; i++ {
+			if err := r.skip(actualType); err != nil {
+				return err
+			}
+		}
+		return fmt.Errorf("Expected a list of thrift type %d, got %d", elemType, actualType)
+	}
+	for i := 0; i < size; i++ {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readThriftString(r thriftProtocolReader) (string, error) {
+	value, err := r.readBinary()
+	return string(value), err
+}
+
+// skipThriftValue skips a value of any type using the reader's own methods.
+func skipThriftValue(r thriftProtocolReader, typ byte, depth int) error {
+	if depth > thriftMaxDepth {
+		return fmt.Errorf("Thrift message is nested more than %d levels deep", thriftMaxDepth)
+	}
+	var err error
+	switch typ {
+	case thriftBool:
+		_, err = r.readBool()
+	case thriftByte:
+		_, err = r.readByte()
+	case thriftI16:
+		_, err = r.readI16()
+	case thriftI32:
+		_, err = r.readI32()
+	case thriftI64:
+		_, err = r.readI64()
+	case thriftDouble:
+		_, err = r.readDouble()
+	case thriftString:
+		_, err = r.readBinary()
+	case thriftStruct:
+		err = readThriftStruct(r, func(fieldType byte, _ int16) error {
+			return skipThriftValue(r, fieldType, depth+1)
+		})
+	case thriftSet, thriftList:
+		var elemType byte
+		var size int
+		elemType, size, err = r.readListBegin()
+		for i := 0; err == nil && i < size; i++ {
+			err = skipThriftValue(r, elemType, depth+1)
+		}
+	case thriftMap:
+		var keyType, valueType byte
+		var size int
+		keyType, valueType, size, err = r.readMapBegin()
+		for i := 0; err == nil && i < size; i++ {
+			if err = skipThriftValue(r, keyType, depth+1); err == nil {
+				err = skipThriftValue(r, valueType, depth+1)
+			}
+		}
+	default:
+		err = fmt.Errorf("Unsupported thrift type %d", typ)
+	}
+	return err
+}
+
+// thriftBinaryReader reads TBinaryProtocol encoded values.
+type thriftBinaryReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *thriftBinaryReader) read(n int) ([]byte, error) {
+	if n < 0 || n > len(r.buf)-r.pos {
+		return nil, errThriftTruncated
+	}
+	value := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return value, nil
+}
+
+func (r *thriftBinaryReader) readStructBegin() error { return nil }
+
+func (r *thriftBinaryReader) readStructEnd() {}
+
+func (r *thriftBinaryReader) readFieldBegin() (byte, int16, error) {
+	typ, err := r.read(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if typ[0] == thriftStop {
+		return thriftStop, 0, nil
+	}
+	id, err := r.read(2)
+	if err != nil {
+		return 0, 0, err
+	}
+	return typ[0], int16(binary.BigEndian.Uint16(id)), nil
+}
+
+func (r *thriftBinaryReader) readListBegin() (byte, int, error) {
+	header, err := r.read(5)
+	if err != nil {
+		return 0, 0, err
+	}
+	size := int(int32(binary.BigEndian.Uint32(header[1:])))
+	// Every element takes at least one byte, so this catches bogus sizes
+	// before anything is allocated for them.
+	if size < 0 || size > len(r.buf)-r.pos {
+		return 0, 0, errThriftTruncated
+	}
+	return header[0], size, nil
+}
+
+func (r *thriftBinaryReader) readMapBegin() (byte, byte, int, error) {
+	header, err := r.read(6)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	size := int(int32(binary.BigEndian.Uint32(header[2:])))
+	if size < 0 || size > len(r.buf)-r.pos {
+		return 0, 0, 0, errThriftTruncated
+	}
+	return header[0], header[1], size, nil
+}
+
+func (r *thriftBinaryReader) readByte() (byte, error) {
+	value, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return value[0], nil
+}
+
+func (r *thriftBinaryReader) readI16() (int16, error) {
+	value, err := r.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return int16(binary.BigEndian.Uint16(value)), nil
+}
+
+func (r *thriftBinaryReader) readBool() (bool, error) {
+	value, err := r.read(1)
+	if err != nil {
+		return false, err
+	}
+	return value[0] != 0, nil
+}
+
+func (r *thriftBinaryReader) readI32() (int32, error) {
+	value, err := r.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(value)), nil
+}
+
+func (r *thriftBinaryReader) readI64() (int64, error) {
+	value, err := r.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+func (r *thriftBinaryReader) readDouble() (float64, error) {
+	value, err := r.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(value)), nil
+}
+
+func (r *thriftBinaryReader) readBinary() ([]byte, error) {
+	length, err := r.readI32()
+	if err != nil {
+		return nil, err
+	}
+	return r.read(int(length))
+}
+
+func (r *thriftBinaryReader) skip(typ byte) error {
+	n, err := thriftValueLength(r.buf[r.pos:], typ, 0)
+	if err != nil {
+		return err
+	}
+	r.pos += n
+	return nil
+}
+
+// TCompactProtocol type IDs, which differ from the TBinaryProtocol ones.
+const (
+	thriftCompactBoolTrue  = 1
+	thriftCompactBoolFalse = 2
+	thriftCompactByte      = 3
+	thriftCompactI16       = 4
+	thriftCompactI32       = 5
+	thriftCompactI64       = 6
+	thriftCompactDouble    = 7
+	thriftCompactBinary    = 8
+	thriftCompactList      = 9
+	thriftCompactSet       = 10
+	thriftCompactMap       = 11
+	thriftCompactStruct    = 12
+)
+
+var thriftCompactTypes = map[byte]byte{
+	thriftCompactBoolTrue:  thriftBool,
+	thriftCompactBoolFalse: thriftBool,
+	thriftCompactByte:      thriftByte,
+	thriftCompactI16:       thriftI16,
+	thriftCompactI32:       thriftI32,
+	thriftCompactI64:       thriftI64,
+	thriftCompactDouble:    thriftDouble,
+	thriftCompactBinary:    thriftString,
+	thriftCompactList:      thriftList,
+	thriftCompactSet:       thriftSet,
+	thriftCompactMap:       thriftMap,
+	thriftCompactStruct:    thriftStruct,
+}
+
+const (
+	thriftCompactProtocolID = 0x82
+	thriftCompactVersion    = 1
+)
+
+// Thrift message types
+const (
+	thriftMessageCall   = 1
+	thriftMessageOneway = 4
+)
+
+// thriftCompactReader reads TCompactProtocol encoded values. The compact
+// protocol encodes field IDs as deltas from the previous field, so the last
+// field ID of every struct that's being read is kept on a stack.
+type thriftCompactReader struct {
+	buf          []byte
+	pos          int
+	lastFieldIDs []int16
+	lastFieldID  int16
+	// boolValue holds the value of a bool field, which the compact protocol
+	// stores in the field header.
+	boolValue *bool
+}
+
+func (r *thriftCompactReader) read(n int) ([]byte, error) {
+	if n < 0 || n > len(r.buf)-r.pos {
+		return nil, errThriftTruncated
+	}
+	value := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return value, nil
+}
+
+func (r *thriftCompactReader) readByte() (byte, error) {
+	value, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return value[0], nil
+}
+
+func (r *thriftCompactReader) readVarint() (uint64, error) {
+	value, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, errThriftTruncated
+	}
+	r.pos += n
+	return value, nil
+}
+
+func (r *thriftCompactReader) readZigzag() (int64, error) {
+	value, err := r.readVarint()
+	if err != nil {
+		return 0, err
+	}
+	return int64(value>>1) ^ -int64(value&1), nil
+}
+
+// readMessageBegin reads the header of a message and returns the name of the
+// method that's called.
+func (r *thriftCompactReader) readMessageBegin() (string, byte, error) {
+	protocolID, err := r.readByte()
+	if err != nil {
+		return "", 0, err
+	}
+	if protocolID != thriftCompactProtocolID {
+		return "", 0, fmt.Errorf("Expected compact thrift protocol ID, got %#x", protocolID)
+	}
+	versionAndType, err := r.readByte()
+	if err != nil {
+		return "", 0, err
+	}
+	if version := versionAndType & 0x1f; version != thriftCompactVersion {
+		return "", 0, fmt.Errorf("Unsupported compact thrift version %d", version)
+	}
+	if _, err := r.readVarint(); err != nil {
+		return "", 0, err
+	}
+	name, err := readThriftString(r)
+	return name, versionAndType >> 5, err
+}
+
+func (r *thriftCompactReader) readStructBegin() error {
+	if len(r.lastFieldIDs) > thriftMaxDepth {
+		return fmt.Errorf("Thrift message is nested more than %d levels deep", thriftMaxDepth)
+	}
+	r.lastFieldIDs = append(r.lastFieldIDs, r.lastFieldID)
+	r.lastFieldID = 0
+	return nil
+}
+
+func (r *thriftCompactReader) readStructEnd() {
+	r.lastFieldID = r.lastFieldIDs[len(r.lastFieldIDs)-1]
+	r.lastFieldIDs = r.lastFieldIDs[:len(r.lastFieldIDs)-1]
+}
+
+func (r *thriftCompactReader) readFieldBegin() (byte, int16, error) {
+	header, err := r.readByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	if header == thriftStop {
+		return thriftStop, 0, nil
+	}
+	compactType := header & 0x0f
+	typ, ok := thriftCompactTypes[compactType]
+	if !ok {
+		return 0, 0, fmt.Errorf("Unsupported compact thrift type %d", compactType)
+	}
+	id := r.lastFieldID + int16(header>>4)
+	if delta := header >> 4; delta == 0 {
+		longID, err := r.readZigzag()
+		if err != nil {
+			return 0, 0, err
+		}
+		id = int16(longID)
+	}
+	r.lastFieldID = id
+	if typ == thriftBool {
+		value := compactType == thriftCompactBoolTrue
+		r.boolValue = &value
+	}
+	return typ, id, nil
+}
+
+func (r *thriftCompactReader) readListBegin() (byte, int, error) {
+	header, err := r.readByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	typ, ok := thriftCompactTypes[header&0x0f]
+	if !ok {
+		return 0, 0, fmt.Errorf("Unsupported compact thrift type %d", header&0x0f)
+	}
+	size := int(header >> 4)
+	if size == 15 {
+		longSize, err := r.readVarint()
+		if err != nil {
+			return 0, 0, err
+		}
+		if longSize > uint64(len(r.buf)) {
+			return 0, 0, errThriftTruncated
+		}
+		size = int(longSize)
+	}
+	// Every element takes at least one byte, so this catches bogus sizes
+	// before anything is allocated for them.
+	if size > len(r.buf)-r.pos {
+		return 0, 0, errThriftTruncated
+	}
+	return typ, size, nil
+}
+
+func (r *thriftCompactReader) readBool() (bool, error) {
+	if r.boolValue != nil {
+		value := *r.boolValue
+		r.boolValue = nil
+		return value, nil
+	}
+	value, err := r.readByte()
+	return value == thriftCompactBoolTrue, err
+}
+
+func (r *thriftCompactReader) readI32() (int32, error) {
+	value, err := r.readZigzag()
+	return int32(value), err
+}
+
+func (r *thriftCompactReader) readI64() (int64, error) {
+	return r.readZigzag()
+}
+
+func (r *thriftCompactReader) readDouble() (float64, error) {
+	value, err := r.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(value)), nil
+}
+
+func (r *thriftCompactReader) readBinary() ([]byte, error) {
+	length, err := r.readVarint()
+	if err != nil {
+		return nil, err
+	}
+	if length > uint64(len(r.buf)) {
+		return nil, errThriftTruncated
+	}
+	return r.read(int(length))
+}
+
+func (r *thriftCompactReader) readMapBegin() (byte, byte, int, error) {
+	size, err := r.readVarint()
+	if err != nil || size == 0 {
+		return 0, 0, 0, err
+	}
+	if size > uint64(len(r.buf)-r.pos) {
+		return 0, 0, 0, errThriftTruncated
+	}
+	types, err := r.readByte()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	keyType, keyOk := thriftCompactTypes[types>>4]
+	valueType, valueOk := thriftCompactTypes[types&0x0f]
+	if !keyOk || !valueOk {
+		return 0, 0, 0, fmt.Errorf("Unsupported compact thrift map types %#x", types)
+	}
+	return keyType, valueType, int(size), nil
+}
+
+func (r *thriftCompactReader) readI16() (int16, error) {
+	value, err := r.readZigzag()
+	return int16(value), err
+}
+
+func (r *thriftCompactReader) skip(typ byte) error {
+	return skipThriftValue(r, typ, 0)
+}
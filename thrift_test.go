@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestThriftBinaryAnnotationAddition(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	req := thriftRequest(thriftListOfSpans(thriftSpan(map[string]string{"http.path": "/api"})))
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	spans := thriftSpans(g, body)
+	g.Expect(spans).To(HaveLen(1))
+	g.Expect(spans[0]).To(Equal(map[string]string{"http.path": "/api", "owner": owner}))
+	// The endpoint of the sr annotation is copied over to the new annotation
+	g.Expect(bytes.Count(body, []byte("backend"))).To(Equal(2))
+	g.Expect(req.ContentLength).To(Equal(int64(len(body))))
+}
+
+func TestThriftMissingBinaryAnnotations(t *testing.T) {
+	g := NewWithT(t)
+	owner := "from_label"
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": owner}))).To(Succeed())
+
+	req := thriftRequest(thriftListOfSpans(thriftSpan(nil), thriftSpan(map[string]string{"owner": "from_span"})))
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	spans := thriftSpans(g, body)
+	g.Expect(spans).To(Equal([]map[string]string{
+		{"owner": owner},
+		{"owner": "from_span"},
+	}))
+}
+
+func TestThriftKeepOriginalBinaryAnnotation(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	originalBody := thriftListOfSpans(thriftSpan(map[string]string{"owner": "from_span"}))
+	req := thriftRequest(originalBody)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(body).To(Equal(originalBody))
+}
+
+func TestThriftTruncatedBody(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	listOfSpans := thriftListOfSpans(thriftSpan(nil))
+	originalBody := listOfSpans[:len(listOfSpans)-1]
+	req := thriftRequest(originalBody)
+	CreateDirector(CreateKubernetesProvider(indexer), DefaultConfig)(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(body).To(Equal(originalBody))
+}
+
+func TestThriftTruncatedListHeader(t *testing.T) {
+	g := NewWithT(t)
+
+	for size := 1; size < 5; size++ {
+		body := thriftListOfSpans(thriftSpan(nil))[:size]
+
+		_, _, err := addTagsV1Thrift(body, map[string]string{"owner": "from_label"})
+
+		g.Expect(err).To(MatchError(ContainSubstring("Truncated thrift message")))
+	}
+}
+
+func thriftRequest(body []byte) *http.Request {
+	req := httptest.NewRequest("POST", "/api/v1/spans", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/x-thrift")
+	return req
+}
+
+func appendThriftI64(buf []byte, id int16, value int64) []byte {
+	buf = appendThriftFieldHeader(buf, thriftI64, id)
+	var scratch [8]byte
+	binary.BigEndian.PutUint64(scratch[:], uint64(value))
+	return append(buf, scratch[:]...)
+}
+
+func thriftSpan(binaryAnnotations map[string]string) []byte {
+	var endpoint []byte
+	endpoint = appendThriftI32(endpoint, 1, 0x0a000001)
+	endpoint = appendThriftString(endpoint, 3, "backend")
+	endpoint = append(endpoint, thriftStop)
+
+	var span []byte
+	span = appendThriftI64(span, 1, 0x5af7183fb1d4cf5f)
+	span = appendThriftString(span, 3, "get /api")
+	span = appendThriftI64(span, 4, 0x352bff9a74ca9ad2)
+	span = appendThriftFieldHeader(span, thriftList, zipkinV1SpanAnnotations)
+	span = appendThriftListHeader(span, thriftStruct, 1)
+	span = appendThriftI64(span, 1, 1556604172355737)
+	span = appendThriftString(span, 2, "sr")
+	span = appendThriftFieldHeader(span, thriftStruct, zipkinV1AnnotationHost)
+	span = append(span, endpoint...)
+	span = append(span, thriftStop)
+	if binaryAnnotations != nil {
+		span = appendThriftFieldHeader(span, thriftList, zipkinV1SpanBinaryAnnotations)
+		span = appendThriftListHeader(span, thriftStruct, len(binaryAnnotations))
+		for key, value := range binaryAnnotations {
+			span = appendThriftString(span, zipkinV1BinaryAnnotationKey, key)
+			span = appendThriftString(span, zipkinV1BinaryAnnotationValue, value)
+			span = appendThriftI32(span, zipkinV1BinaryAnnotationType, zipkinV1AnnotationTypeString)
+			span = append(span, thriftStop)
+		}
+	}
+	span = appendThriftI64(span, 10, 1556604172355737)
+	return append(span, thriftStop)
+}
+
+func thriftListOfSpans(spans ...[]byte) []byte {
+	list := appendThriftListHeader(nil, thriftStruct, len(spans))
+	for _, span := range spans {
+		list = append(list, span...)
+	}
+	return list
+}
+
+// thriftSpans decodes the binary annotations of each span in the list.
+func thriftSpans(g *WithT, body []byte) []map[string]string {
+	var spans []map[string]string
+	n, err := forEachThriftListElem(body, func(_ byte, span []byte) error {
+		annotations := map[string]string{}
+		_, err := forEachThriftField(span, func(field thriftField) error {
+			if field.id != zipkinV1SpanBinaryAnnotations {
+				return nil
+			}
+			_, err := forEachThriftListElem(field.value, func(_ byte, annotation []byte) error {
+				var key, value string
+				_, err := forEachThriftField(annotation, func(annotationField thriftField) error {
+					switch annotationField.id {
+					case zipkinV1BinaryAnnotationKey:
+						key = thriftStringValue(annotationField.value)
+					case zipkinV1BinaryAnnotationValue:
+						value = thriftStringValue(annotationField.value)
+					}
+					return nil
+				})
+				annotations[key] = value
+				return err
+			})
+			return err
+		})
+		spans = append(spans, annotations)
+		return err
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(n).To(Equal(len(body)))
+	return spans
+}
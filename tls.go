@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// Values of TLS_CLIENT_AUTH.
+const (
+	tlsClientAuthRequire       = "require"
+	tlsClientAuthVerifyIfGiven = "verify-if-given"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for
+// changes at most.
+const tlsReloadInterval = 10 * time.Second
+
+// tlsReloader serves the certificate and client CAs from files and reloads
+// them when the files change, e.g. when cert-manager rotates them. If
+// reloading fails, the previously loaded files keep being used.
+type tlsReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	clientAuth   tls.ClientAuthType
+	// now is a field so that tests can skip the reload interval
+	now func() time.Time
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	lastCheck time.Time
+}
+
+// CreateTLSReloader loads the certificate files from the configuration.
+func CreateTLSReloader(cfg Config) (*tlsReloader, error) {
+	r := &tlsReloader{
+		certFile:     cfg.TLSCertFile,
+		keyFile:      cfg.TLSKeyFile,
+		clientCAFile: cfg.TLSClientCAFile,
+		clientAuth:   tls.NoClientCert,
+		now:          time.Now,
+	}
+	if cfg.TLSClientCAFile != "" {
+		r.clientAuth = tls.RequireAndVerifyClientCert
+		if cfg.TLSClientAuth == tlsClientAuthVerifyIfGiven {
+			r.clientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	r.lastCheck = r.now()
+	return r, nil
+}
+
+// TLSConfig returns the server configuration, which picks up the reloaded
+// files for new connections.
+func (r *tlsReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.current(), nil
+		},
+		// Only used by http.Server to check that a certificate is configured,
+		// as GetConfigForClient takes precedence
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &r.current().Certificates[0], nil
+		},
+	}
+}
+
+func (r *tlsReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+func (r *tlsReloader) fileModTimes() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// current returns the current configuration after reloading the files if
+// they changed since they were loaded.
+func (r *tlsReloader) current() *tls.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if now.Sub(r.lastCheck) < tlsReloadInterval {
+		return r.config
+	}
+	r.lastCheck = now
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		klog.Errorf("Failed to check TLS files for changes: %s", err)
+		return r.config
+	}
+	changed := false
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			changed = true
+		}
+	}
+	if changed {
+		if err := r.load(modTimes); err != nil {
+			klog.Errorf("Failed to reload TLS files, using the previous ones: %s", err)
+		} else {
+			klog.Info("Reloaded TLS files")
+		}
+	}
+	return r.config
+}
+
+// load loads the files. It has to be called with the lock held, or before
+// the reloader is used.
+func (r *tlsReloader) load(modTimes []time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("Failed to load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   r.clientAuth,
+		// http.Server only sets these on its own configuration, not on the
+		// one returned by GetConfigForClient
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if r.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("Failed to read TLS client CA file: %w", err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in TLS client CA file %s", r.clientCAFile)
+		}
+	}
+	r.config = config
+	r.modTimes = modTimes
+	return nil
+}
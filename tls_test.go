@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func (c testCert) keyPEM(g *WithT) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	g.Expect(err).NotTo(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c testCert) tlsCertificate(g *WithT) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.pem, c.keyPEM(g))
+	g.Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+// createTestCert creates a certificate signed by the parent, or a self-signed
+// CA certificate when parent is nil.
+func createTestCert(g *WithT, serial int64, parent *testCert, uris ...string) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "zipkates-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, uri := range uris {
+		parsed, err := url.Parse(uri)
+		g.Expect(err).NotTo(HaveOccurred())
+		template.URIs = append(template.URIs, parsed)
+	}
+	parentCert, parentKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	g.Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	g.Expect(err).NotTo(HaveOccurred())
+	return testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// writeTLSFiles writes the server certificate and the client CA to the
+// directory and returns the configuration that uses them.
+func writeTLSFiles(g *WithT, dir string, server testCert, clientCA *testCert) Config {
+	cfg := DefaultConfig
+	cfg.TLSCertFile = filepath.Join(dir, "tls.crt")
+	cfg.TLSKeyFile = filepath.Join(dir, "tls.key")
+	g.Expect(ioutil.WriteFile(cfg.TLSCertFile, server.pem, 0600)).To(Succeed())
+	g.Expect(ioutil.WriteFile(cfg.TLSKeyFile, server.keyPEM(g), 0600)).To(Succeed())
+	if clientCA != nil {
+		cfg.TLSClientCAFile = filepath.Join(dir, "ca.crt")
+		g.Expect(ioutil.WriteFile(cfg.TLSClientCAFile, clientCA.pem, 0600)).To(Succeed())
+	}
+	return cfg
+}
+
+func startTLSServer(g *WithT, reloader *tlsReloader, handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = reloader.TLSConfig()
+	server.StartTLS()
+	return server
+}
+
+func tlsClient(ca testCert, clientCert *testCert, g *WithT) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots}
+	if clientCert != nil {
+		config.Certificates = []tls.Certificate{clientCert.tlsCertificate(g)}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+}
+
+func TestParseIdentityURI(t *testing.T) {
+	cases := map[string]*podIdentity{
+		"spiffe://cluster.local/ns/default/sa/backend":  {namespace: "default", serviceAccount: "backend"},
+		"spiffe://cluster.local/ns/prod/pod/backend-7f": {namespace: "prod", pod: "backend-7f"},
+		"spiffe://Cluster.Local/ns/default/sa/backend":  {namespace: "default", serviceAccount: "backend"},
+		"spiffe://cluster.local/ns/default":             nil,
+		"spiffe://cluster.local/ns//sa/backend":         nil,
+		"spiffe://cluster.local/ns/default/svc/api":     nil,
+		"spiffe://example.com/ns/default/sa/backend":    nil,
+		"urn://cluster.local/ns/prod/pod/backend-7f":    nil,
+		"https://cluster.local/ns/default/sa/backend":   nil,
+	}
+	for uri, expected := range cases {
+		t.Run(uri, func(t *testing.T) {
+			g := NewWithT(t)
+
+			parsed, err := url.Parse(uri)
+			g.Expect(err).NotTo(HaveOccurred())
+			identity, ok := parseIdentityURI(parsed, "cluster.local")
+
+			if expected == nil {
+				g.Expect(ok).To(BeFalse())
+			} else {
+				g.Expect(ok).To(BeTrue())
+				g.Expect(identity).To(Equal(*expected))
+			}
+		})
+	}
+}
+
+func serviceAccountPod(name, serviceAccount string, labels map[string]string) *v1.Pod {
+	p := pod(name, "", labels)
+	p.Namespace = "default"
+	p.Spec.ServiceAccountName = serviceAccount
+	return p
+}
+
+func TestIdentityTagValues(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(serviceAccountPod("backend-1", "backend", map[string]string{"owner": "team", "app": "backend", "version": "1"}))).To(Succeed())
+	g.Expect(indexer.Add(serviceAccountPod("backend-2", "backend", map[string]string{"owner": "team", "app": "backend", "version": "2"}))).To(Succeed())
+	g.Expect(indexer.Add(serviceAccountPod("frontend", "", map[string]string{"owner": "other"}))).To(Succeed())
+	cfg := DefaultConfig
+	cfg.LabelTagMapping = map[string]string{"owner": "owner", "app": "app", "version": "version"}
+
+	tagValues, err := getIdentityTagValues(CreateKubernetesProvider(indexer), podIdentity{namespace: "default", serviceAccount: "backend"}, cfg)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(tagValues).To(Equal(map[string]string{"owner": "team", "app": "backend"}))
+
+	tagValues, err = getIdentityTagValues(CreateKubernetesProvider(indexer), podIdentity{namespace: "default", serviceAccount: "default"}, cfg)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(tagValues).To(Equal(map[string]string{"owner": "other"}))
+
+	tagValues, err = getIdentityTagValues(CreateKubernetesProvider(indexer), podIdentity{namespace: "default", pod: "backend-2"}, cfg)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(tagValues).To(Equal(map[string]string{"owner": "team", "app": "backend", "version": "2"}))
+
+	_, err = getIdentityTagValues(CreateKubernetesProvider(indexer), podIdentity{namespace: "prod", serviceAccount: "backend"}, cfg)
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestMutualTLSIdentity(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "zipkates-tls")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	ca := createTestCert(g, 1, nil)
+	serverCert := createTestCert(g, 2, &ca)
+	cfg := writeTLSFiles(g, dir, serverCert, &ca)
+	reloader, err := CreateTLSReloader(cfg)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(serviceAccountPod("backend", "backend", map[string]string{"owner": "from_certificate"}))).To(Succeed())
+	g.Expect(indexer.Add(pod("local", "127.0.0.1", map[string]string{"owner": "from_ip"}))).To(Succeed())
+	server := startTLSServer(g, reloader, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(w).Encode(getRequestTagValues(CreateKubernetesProvider(indexer), req, cfg))
+	}))
+	defer server.Close()
+
+	t.Run("Identity from the client certificate", func(t *testing.T) {
+		g := NewWithT(t)
+
+		clientCert := createTestCert(g, 3, &ca, "spiffe://cluster.local/ns/default/sa/backend")
+		resp, err := tlsClient(ca, &clientCert, g).Get(server.URL)
+		g.Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(body)).To(MatchJSON(`{"owner": "from_certificate"}`))
+	})
+
+	t.Run("Falls back to the IP", func(t *testing.T) {
+		g := NewWithT(t)
+
+		clientCert := createTestCert(g, 4, &ca, "spiffe://cluster.local/ns/default/sa/unknown")
+		resp, err := tlsClient(ca, &clientCert, g).Get(server.URL)
+		g.Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(body)).To(MatchJSON(`{"owner": "from_ip"}`))
+	})
+
+	t.Run("Identity from another trust domain", func(t *testing.T) {
+		g := NewWithT(t)
+
+		clientCert := createTestCert(g, 7, &ca, "spiffe://example.com/ns/default/sa/backend")
+		resp, err := tlsClient(ca, &clientCert, g).Get(server.URL)
+		g.Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(string(body)).To(MatchJSON(`{"owner": "from_ip"}`))
+	})
+
+	t.Run("Client certificate is required", func(t *testing.T) {
+		g := NewWithT(t)
+
+		_, err := tlsClient(ca, nil, g).Get(server.URL)
+		g.Expect(err).To(HaveOccurred())
+	})
+
+	t.Run("Client certificate from another CA", func(t *testing.T) {
+		g := NewWithT(t)
+
+		otherCA := createTestCert(g, 5, nil)
+		clientCert := createTestCert(g, 6, &otherCA, "spiffe://cluster.local/ns/default/sa/backend")
+		_, err := tlsClient(ca, &clientCert, g).Get(server.URL)
+		g.Expect(err).To(HaveOccurred())
+	})
+}
+
+func TestTLSNegotiatesHTTP2(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "zipkates-tls")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	ca := createTestCert(g, 1, nil)
+	reloader, err := CreateTLSReloader(writeTLSFiles(g, dir, createTestCert(g, 2, &ca), nil))
+	g.Expect(err).NotTo(HaveOccurred())
+	server := startTLSServer(g, reloader, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	client := tlsClient(ca, nil, g)
+	client.Transport.(*http.Transport).ForceAttemptHTTP2 = true
+	resp, err := client.Get(server.URL)
+	g.Expect(err).NotTo(HaveOccurred())
+	defer resp.Body.Close()
+	g.Expect(resp.ProtoMajor).To(Equal(2))
+}
+
+func TestTLSReload(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "zipkates-tls")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	ca := createTestCert(g, 1, nil)
+	cfg := writeTLSFiles(g, dir, createTestCert(g, 2, &ca), nil)
+	reloader, err := CreateTLSReloader(cfg)
+	g.Expect(err).NotTo(HaveOccurred())
+	now := time.Now()
+	reloader.now = func() time.Time { return now }
+	server := startTLSServer(g, reloader, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+	servedSerial := func() int64 {
+		// A new client for every request to get a new connection
+		resp, err := tlsClient(ca, nil, g).Get(server.URL)
+		g.Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	g.Expect(servedSerial()).To(Equal(int64(2)))
+
+	// Rotate the certificate like cert-manager does
+	writeTLSFiles(g, dir, createTestCert(g, 3, &ca), nil)
+	later := time.Now().Add(time.Minute)
+	g.Expect(os.Chtimes(cfg.TLSCertFile, later, later)).To(Succeed())
+	g.Expect(servedSerial()).To(Equal(int64(2)))
+	now = now.Add(tlsReloadInterval)
+	g.Expect(servedSerial()).To(Equal(int64(3)))
+
+	// Broken files are not used
+	g.Expect(ioutil.WriteFile(cfg.TLSKeyFile, []byte("broken"), 0600)).To(Succeed())
+	g.Expect(os.Chtimes(cfg.TLSKeyFile, later, later)).To(Succeed())
+	now = now.Add(tlsReloadInterval)
+	g.Expect(servedSerial()).To(Equal(int64(3)))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// unixSocketHost is the host of requests that are sent over a unix socket.
+// It's only used for the Host header and to pool connections, as the
+// transport always dials the socket.
+const unixSocketHost = "localhost"
+
+// parseZipkinURL parses the URL of the Zipkin instance that spans are
+// forwarded to. http and https URLs can have a path, which is then used as a
+// prefix for all forwarded requests. unix URLs are paths to a unix socket that
+// Zipkin listens on.
+func parseZipkinURL(rawURL string) (*url.URL, error) {
+	zipkinURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch zipkinURL.Scheme {
+	case "http", "https":
+		if zipkinURL.Host == "" {
+			return nil, fmt.Errorf("%s doesn't have a host", rawURL)
+		}
+		zipkinURL.Path = strings.TrimRight(zipkinURL.Path, "/")
+		zipkinURL.RawPath = ""
+	case "unix":
+		if zipkinURL.Host != "" || zipkinURL.Path == "" {
+			return nil, fmt.Errorf("Expected unix:///path/to/socket, got %s", rawURL)
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported scheme %s, expected http, https or unix", zipkinURL.Scheme)
+	}
+	if zipkinURL.RawQuery != "" || zipkinURL.Fragment != "" {
+		return nil, fmt.Errorf("%s can't have a query or a fragment", rawURL)
+	}
+	return zipkinURL, nil
+}
+
+// zipkinPortURL returns the URL of a Zipkin instance listening on localhost,
+// which is how Zipkin was configured with ZIPKIN_PORT.
+func zipkinPortURL(port int) *url.URL {
+	return &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", port)}
+}
+
+// zipkinTarget returns the Zipkin URL that a request with the given path is
+// forwarded to.
+func zipkinTarget(cfg Config, path string) *url.URL {
+	return upstreamTarget(cfg.ZipkinURL, path)
+}
+
+// upstreamTarget returns the URL on the upstream that a request with the
+// given path is sent to.
+func upstreamTarget(upstreamURL *url.URL, path string) *url.URL {
+	if upstreamURL.Scheme == "unix" {
+		return &url.URL{Scheme: "http", Host: unixSocketHost, Path: path}
+	}
+	return &url.URL{
+		Scheme: upstreamURL.Scheme,
+		Host:   upstreamURL.Host,
+		Path:   upstreamURL.Path + path,
+	}
+}
+
+// upstreamPath is the reverse of upstreamTarget and returns the path that the
+// client used for a path on the upstream.
+func upstreamPath(upstreamURL *url.URL, targetPath string) string {
+	if upstreamURL.Scheme == "unix" {
+		return targetPath
+	}
+	return strings.TrimPrefix(targetPath, upstreamURL.Path)
+}
+
+// CreateZipkinTransport returns the transport for requests to Zipkin. Requests
+// go through a circuit breaker, whose metrics are added to the registry, and
+// span uploads are mirrored to the configured mirrors as well.
+func CreateZipkinTransport(cfg Config, metrics *metricsRegistry) http.RoundTripper {
+	transport := createUpstreamTransport(cfg.ZipkinURL)
+	if cfg.CircuitBreakerFailures > 0 {
+		breaker := CreateCircuitBreaker(cfg, transport)
+		breaker.RegisterMetrics(metrics)
+		transport = breaker
+	}
+	if len(cfg.ZipkinMirrors) == 0 {
+		return transport
+	}
+	return createMirroringTransport(cfg.ZipkinURL, transport, cfg.ZipkinMirrors)
+}
+
+// zipkinCircuitBreaker returns the circuit breaker of a transport created by
+// CreateZipkinTransport, or nil when it doesn't have one.
+func zipkinCircuitBreaker(transport http.RoundTripper) *circuitBreaker {
+	if mirroring, ok := transport.(*mirroringTransport); ok {
+		transport = mirroring.primary
+	}
+	breaker, _ := transport.(*circuitBreaker)
+	return breaker
+}
+
+// createUpstreamTransport returns the transport for requests to an upstream.
+// Requests to unix socket URLs are sent over the socket regardless of their
+// host.
+func createUpstreamTransport(upstreamURL *url.URL) http.RoundTripper {
+	if upstreamURL.Scheme != "unix" {
+		return http.DefaultTransport
+	}
+	socketPath := upstreamURL.Path
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socketPath)
+	}
+	return transport
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"github.com/tidwall/gjson"
+)
+
+func TestZipkinURLWithPathPrefix(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+
+	req := httptest.NewRequest(
+		"POST", "/api/v2/spans?debug=true",
+		strings.NewReader(fmt.Sprintf("[%s]", span(g, map[string]string{}))),
+	)
+	cfg := DefaultConfig
+	zipkinURL, err := parseZipkinURL("https://zipkin.example.com/zipkin/")
+	g.Expect(err).NotTo(HaveOccurred())
+	cfg.ZipkinURL = zipkinURL
+	CreateDirector(CreateKubernetesProvider(indexer), cfg)(req)
+
+	g.Expect(req.URL.String()).To(Equal("https://zipkin.example.com/zipkin/api/v2/spans?debug=true"))
+	g.Expect(req.Host).To(Equal("zipkin.example.com"))
+	body, err := ioutil.ReadAll(req.Body)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(gjson.GetBytes(body, "0.tags.owner").String()).To(Equal("from_label"))
+}
+
+func TestZipkinUnixSocket(t *testing.T) {
+	g := NewWithT(t)
+
+	dir, err := ioutil.TempDir("", "zipkates")
+	g.Expect(err).NotTo(HaveOccurred())
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "zipkin.sock")
+	listener, err := net.Listen("unix", socketPath)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	received := make(chan string, 1)
+	zipkin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- req.URL.Path + " " + gjson.GetBytes(body, "0.tags.owner").String()
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	zipkin.Listener = listener
+	zipkin.Start()
+	defer zipkin.Close()
+
+	indexer := CreateIndexer()
+	g.Expect(indexer.Add(pod("test-pod", testIp, map[string]string{"owner": "from_label"}))).To(Succeed())
+	cfg := DefaultConfig
+	cfg.ZipkinURL, err = parseZipkinURL("unix://" + socketPath)
+	g.Expect(err).NotTo(HaveOccurred())
+	proxy := &httputil.ReverseProxy{
+		Director:  CreateDirector(CreateKubernetesProvider(indexer), cfg),
+		Transport: CreateZipkinTransport(cfg, CreateMetricsRegistry()),
+	}
+
+	req := httptest.NewRequest(
+		"POST", "/api/v2/spans",
+		strings.NewReader(fmt.Sprintf("[%s]", span(g, map[string]string{}))),
+	)
+	recorder := httptest.NewRecorder()
+	proxy.ServeHTTP(recorder, req)
+
+	g.Expect(recorder.Code).To(Equal(http.StatusAccepted))
+	g.Expect(<-received).To(Equal("/api/v2/spans from_label"))
+}
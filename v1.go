@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/klog"
+)
+
+// addTagsV1JSON adds the tag values to Zipkin v1 JSON spans. The v1 API has
+// no tags, so they are added as string binary annotations instead. Binary
+// annotations that are already set on a span are kept as is.
+func addTagsV1JSON(body []byte, tagValues map[string]string) ([]byte, bool, error) {
+	var spans []map[string]interface{}
+	// Use json.Number to avoid losing precision of timestamps and durations
+	// when re-encoding the spans.
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&spans); err != nil {
+		return nil, false, fmt.Errorf("Failed to parse v1 spans: %w", err)
+	}
+	modified := false
+	for _, span := range spans {
+		if addBinaryAnnotations(span, tagValues) {
+			modified = true
+		}
+	}
+	if !modified {
+		return body, false, nil
+	}
+	newBody, err := json.Marshal(spans)
+	if err != nil {
+		return nil, false, fmt.Errorf("Failed to marshal v1 spans: %w", err)
+	}
+	return newBody, true, nil
+}
+
+func addBinaryAnnotations(span map[string]interface{}, tagValues map[string]string) bool {
+	var binaryAnnotations []interface{}
+	if obj, ok := span["binaryAnnotations"]; ok && obj != nil {
+		binaryAnnotations, ok = obj.([]interface{})
+		if !ok {
+			klog.Errorf("Couldn't parse the binary annotations: %+v", obj)
+			klog.Errorf("The binary annotations object type: %T", obj)
+			return false
+		}
+	}
+
+	existing := map[string]bool{}
+	for _, obj := range binaryAnnotations {
+		if annotation, ok := obj.(map[string]interface{}); ok {
+			if key, ok := annotation["key"].(string); ok && annotation["value"] != "" {
+				existing[key] = true
+			}
+		}
+	}
+
+	endpoint := v1SpanEndpoint(span)
+	modified := false
+	for tagName, value := range tagValues {
+		if existing[tagName] {
+			if klog.V(1) {
+				klog.Infof("Binary annotation %s is already set for the span, skipping: %+v", tagName, span)
+			}
+			continue
+		}
+		annotation := map[string]interface{}{"key": tagName, "value": value}
+		if endpoint != nil {
+			annotation["endpoint"] = endpoint
+		}
+		binaryAnnotations = append(binaryAnnotations, annotation)
+		modified = true
+	}
+	if modified {
+		span["binaryAnnotations"] = binaryAnnotations
+	}
+	return modified
+}
+
+var v1AddressAnnotationKeys = map[interface{}]bool{"ca": true, "sa": true, "ma": true}
+
+// v1SpanEndpoint returns the endpoint of the service that reported the span.
+// Unlike v2 spans, v1 spans don't have a local endpoint and instead every
+// annotation carries its own endpoint. Address annotations are skipped as they
+// describe the remote side of the span.
+func v1SpanEndpoint(span map[string]interface{}) interface{} {
+	for _, field := range []string{"annotations", "binaryAnnotations"} {
+		annotations, ok := span[field].([]interface{})
+		if !ok {
+			continue
+		}
+		for _, obj := range annotations {
+			annotation, ok := obj.(map[string]interface{})
+			if !ok || v1AddressAnnotationKeys[annotation["key"]] {
+				continue
+			}
+			if endpoint, ok := annotation["endpoint"]; ok && endpoint != nil {
+				return endpoint
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+)
+
+// watchedNamespaces returns the namespaces to watch pods in. Every namespace
+// gets its own watch, so that namespaced RBAC is enough. Without any
+// namespaces configured, all namespaces are watched with a single watch.
+func watchedNamespaces(cfg Config) []string {
+	if len(cfg.WatchNamespaces) == 0 {
+		return []string{allNamespaces}
+	}
+	excluded := map[string]bool{}
+	for _, namespace := range cfg.ExcludeNamespaces {
+		excluded[namespace] = true
+	}
+	var namespaces []string
+	for _, namespace := range cfg.WatchNamespaces {
+		if !excluded[namespace] {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	return namespaces
+}
+
+// podFieldSelector returns the field selector for the pods in the namespace.
+// When watching all namespaces, the excluded namespaces are filtered out by
+// the API server. Agents only watch the pods on their own node.
+func podFieldSelector(namespace string, cfg Config) string {
+	var selectors []fields.Selector
+	if cfg.PodFieldSelector != "" {
+		selectors = append(selectors, fields.ParseSelectorOrDie(cfg.PodFieldSelector))
+	}
+	if cfg.AgentMode {
+		selectors = append(selectors, fields.OneTermEqualSelector("spec.nodeName", cfg.NodeName))
+	}
+	if namespace == allNamespaces {
+		for _, excluded := range cfg.ExcludeNamespaces {
+			selectors = append(selectors, fields.OneTermNotEqualSelector("metadata.namespace", excluded))
+		}
+	}
+	return fields.AndSelectors(selectors...).String()
+}
+
+// CreatePodListWatch returns the ListWatch for the pods in the namespace that
+// match the configured label and field selectors.
+func CreatePodListWatch(client cache.Getter, namespace string, cfg Config) *cache.ListWatch {
+	fieldSelector := podFieldSelector(namespace, cfg)
+	return cache.NewFilteredListWatchFromClient(client, "pods", namespace, func(options *metav1.ListOptions) {
+		options.LabelSelector = cfg.PodLabelSelector
+		options.FieldSelector = fieldSelector
+	})
+}
+
+// podCacheStore is the store a reflector writes to. Pods are slimmed down to
+// what's needed to look up their tags before they are stored. Stores of
+// different namespaces share the indexer, so a list only replaces the pods of
+// the store's own namespace. It also records when the pods were first listed and
+// when the last watch event or resync happened, so that readiness can wait for
+// the cache to be complete and notice when the watch has stopped.
+type podCacheStore struct {
+	cache.Indexer
+	namespace       string
+	clusterName     string
+	labelTagMapping map[string]string
+	now             func() time.Time
+	// events is set when the pods are served to other instances
+	events *podEvents
+	// synced is 1 once the pods have been listed and lastEvent is the unix
+	// time in nanoseconds of the last list, watch event or resync.
+	synced    int32
+	lastEvent int64
+}
+
+func CreatePodCacheStore(indexer cache.Indexer, namespace string, cfg Config) *podCacheStore {
+	return &podCacheStore{
+		Indexer:         indexer,
+		namespace:       namespace,
+		clusterName:     cfg.ClusterName,
+		labelTagMapping: cfg.LabelTagMapping,
+		now:             time.Now,
+	}
+}
+
+// slimPod returns a copy of the pod with only the fields that are used to
+// index pods and to look up their tags, and with the name of its cluster. The
+// resource version is kept to tell which pods changed when they are listed
+// again.
+// Labels that are not mapped to tags are dropped. Anything else is left as
+// is.
+func slimPod(obj interface{}, clusterName string, labelTagMapping map[string]string) interface{} {
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return obj
+	}
+	slim := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            pod.Name,
+			Namespace:       pod.Namespace,
+			ResourceVersion: pod.ResourceVersion,
+		},
+		Spec:   v1.PodSpec{ServiceAccountName: pod.Spec.ServiceAccountName},
+		Status: v1.PodStatus{PodIP: pod.Status.PodIP},
+	}
+	setPodClusterName(slim, clusterName)
+	for labelName := range labelTagMapping {
+		if value, ok := pod.Labels[labelName]; ok {
+			if slim.Labels == nil {
+				slim.Labels = make(map[string]string, len(labelTagMapping))
+			}
+			// The key from the mapping is shared by all pods
+			slim.Labels[labelName] = value
+		}
+	}
+	return slim
+}
+
+func (s *podCacheStore) recordEvent() {
+	atomic.StoreInt64(&s.lastEvent, s.now().UnixNano())
+}
+
+// Synced returns whether the pods have been listed.
+func (s *podCacheStore) Synced() bool {
+	return atomic.LoadInt32(&s.synced) == 1
+}
+
+// LastEvent returns when the last list, watch event or resync happened.
+func (s *podCacheStore) LastEvent() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastEvent))
+}
+
+// Resync is called by the reflector every resync period for as long as it's
+// watching, even when no pods change, so that pods in quiet namespaces don't
+// look stale.
+func (s *podCacheStore) Resync() error {
+	s.recordEvent()
+	return s.Indexer.Resync()
+}
+
+func (s *podCacheStore) publish(eventType string, obj interface{}) {
+	if s.events != nil {
+		s.events.Publish(eventType, obj)
+	}
+}
+
+func (s *podCacheStore) Add(obj interface{}) error {
+	s.recordEvent()
+	slim := slimPod(obj, s.clusterName, s.labelTagMapping)
+	if err := s.Indexer.Add(slim); err != nil {
+		return err
+	}
+	s.publish(podEventAdded, slim)
+	return nil
+}
+
+func (s *podCacheStore) Update(obj interface{}) error {
+	s.recordEvent()
+	slim := slimPod(obj, s.clusterName, s.labelTagMapping)
+	if err := s.Indexer.Update(slim); err != nil {
+		return err
+	}
+	s.publish(podEventModified, slim)
+	return nil
+}
+
+func (s *podCacheStore) Delete(obj interface{}) error {
+	s.recordEvent()
+	slim := slimPod(obj, s.clusterName, s.labelTagMapping)
+	if err := s.Indexer.Delete(slim); err != nil {
+		return err
+	}
+	s.publish(podEventDeleted, slim)
+	return nil
+}
+
+// Replace is called by the reflector with the result of every list.
+func (s *podCacheStore) Replace(list []interface{}, resourceVersion string) error {
+	err := s.replace(list, resourceVersion)
+	if err == nil {
+		s.recordEvent()
+		atomic.StoreInt32(&s.synced, 1)
+	}
+	return err
+}
+
+// publishListed publishes the listed pods that are new or changed since they
+// were stored. Every pod is listed again after a watch fails, so publishing
+// all of them would send every pod to the watchers again.
+func (s *podCacheStore) publishListed(obj interface{}, previous interface{}, existed bool) {
+	if s.events == nil {
+		return
+	}
+	if existed {
+		pod, ok := obj.(*v1.Pod)
+		previousPod, previousOk := previous.(*v1.Pod)
+		if ok && previousOk && pod.ResourceVersion == previousPod.ResourceVersion {
+			return
+		}
+	}
+	s.publish(podEventModified, obj)
+}
+
+func (s *podCacheStore) replace(list []interface{}, resourceVersion string) error {
+	slimList := make([]interface{}, len(list))
+	for i, obj := range list {
+		slimList[i] = slimPod(obj, s.clusterName, s.labelTagMapping)
+	}
+	list = slimList
+	if s.namespace == allNamespaces {
+		existing := map[string]interface{}{}
+		if s.events != nil {
+			for _, obj := range s.Indexer.List() {
+				key, err := cache.MetaNamespaceKeyFunc(obj)
+				if err != nil {
+					return err
+				}
+				existing[key] = obj
+			}
+		}
+		if err := s.Indexer.Replace(list, resourceVersion); err != nil {
+			return err
+		}
+		if s.events == nil {
+			return nil
+		}
+		for _, obj := range list {
+			key, err := cache.MetaNamespaceKeyFunc(obj)
+			if err != nil {
+				return err
+			}
+			previous, existed := existing[key]
+			s.publishListed(obj, previous, existed)
+			delete(existing, key)
+		}
+		for _, obj := range existing {
+			s.publish(podEventDeleted, obj)
+		}
+		return nil
+	}
+
+	listed := make(map[string]bool, len(list))
+	for _, obj := range list {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return err
+		}
+		listed[key] = true
+		previous, existed, err := s.Indexer.GetByKey(key)
+		if err != nil {
+			return err
+		}
+		if err := s.Indexer.Update(obj); err != nil {
+			return err
+		}
+		s.publishListed(obj, previous, existed)
+	}
+	existing, err := s.Indexer.ByIndex(cache.NamespaceIndex, s.namespace)
+	if err != nil {
+		return err
+	}
+	for _, obj := range existing {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			return err
+		}
+		if !listed[key] {
+			if err := s.Indexer.Delete(obj); err != nil {
+				return err
+			}
+			s.publish(podEventDeleted, obj)
+		}
+	}
+	return nil
+}
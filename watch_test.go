@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+)
+
+func namespacedPod(namespace, name, ip string) *v1.Pod {
+	p := pod(name, ip, nil)
+	p.Namespace = namespace
+	return p
+}
+
+func TestWatchedNamespaces(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := DefaultConfig
+	g.Expect(watchedNamespaces(cfg)).To(Equal([]string{allNamespaces}))
+
+	cfg.ExcludeNamespaces = []string{"kube-system"}
+	g.Expect(watchedNamespaces(cfg)).To(Equal([]string{allNamespaces}))
+
+	cfg.WatchNamespaces = []string{"default", "kube-system", "prod"}
+	g.Expect(watchedNamespaces(cfg)).To(Equal([]string{"default", "prod"}))
+}
+
+func TestPodFieldSelector(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := DefaultConfig
+	g.Expect(podFieldSelector(allNamespaces, cfg)).To(Equal(""))
+
+	cfg.PodFieldSelector = "status.phase=Running"
+	g.Expect(podFieldSelector("default", cfg)).To(Equal("status.phase=Running"))
+
+	cfg.ExcludeNamespaces = []string{"kube-system", "monitoring"}
+	g.Expect(podFieldSelector(allNamespaces, cfg)).To(Equal(
+		"status.phase=Running,metadata.namespace!=kube-system,metadata.namespace!=monitoring"))
+	g.Expect(podFieldSelector("default", cfg)).To(Equal("status.phase=Running"))
+
+	cfg.AgentMode = true
+	cfg.NodeName = "node-1"
+	g.Expect(podFieldSelector("default", cfg)).To(Equal("status.phase=Running,spec.nodeName=node-1"))
+}
+
+func TestPodListWatch(t *testing.T) {
+	g := NewWithT(t)
+
+	requests := make(chan *url.URL, 1)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests <- req.URL
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"kind": "PodList", "apiVersion": "v1", "metadata": {"resourceVersion": "1"}, "items": []}`))
+	}))
+	defer apiServer.Close()
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: apiServer.URL})
+	g.Expect(err).NotTo(HaveOccurred())
+	cfg := DefaultConfig
+	cfg.PodLabelSelector = "app in (backend, frontend)"
+	cfg.PodFieldSelector = "status.phase=Running"
+
+	_, err = CreatePodListWatch(clientset.CoreV1().RESTClient(), "prod", cfg).List(metav1.ListOptions{})
+	g.Expect(err).NotTo(HaveOccurred())
+
+	var requested *url.URL
+	g.Expect(requests).To(Receive(&requested))
+	g.Expect(requested.Path).To(Equal("/api/v1/namespaces/prod/pods"))
+	g.Expect(requested.Query().Get("labelSelector")).To(Equal("app in (backend, frontend)"))
+	g.Expect(requested.Query().Get("fieldSelector")).To(Equal("status.phase=Running"))
+}
+
+func TestNamespacedPodCacheReplace(t *testing.T) {
+	g := NewWithT(t)
+
+	indexer := CreateIndexer()
+	defaultCache := CreatePodCacheStore(indexer, "default", DefaultConfig)
+	prodCache := CreatePodCacheStore(indexer, "prod", DefaultConfig)
+
+	g.Expect(defaultCache.Replace([]interface{}{
+		namespacedPod("default", "a", "10.0.0.1"),
+		namespacedPod("default", "b", "10.0.0.2"),
+	}, "1")).To(Succeed())
+	g.Expect(prodCache.Replace([]interface{}{
+		namespacedPod("prod", "a", "10.0.1.1"),
+	}, "1")).To(Succeed())
+	g.Expect(indexer.ListKeys()).To(ConsistOf("default/a", "default/b", "prod/a"))
+
+	// A relist only replaces the pods of its own namespace
+	g.Expect(defaultCache.Replace([]interface{}{
+		namespacedPod("default", "b", "10.0.0.3"),
+	}, "2")).To(Succeed())
+	g.Expect(indexer.ListKeys()).To(ConsistOf("default/b", "prod/a"))
+	g.Expect(indexer.ByIndex(ipIndex, "10.0.0.2")).To(BeEmpty())
+	g.Expect(indexer.ByIndex(ipIndex, "10.0.0.3")).To(HaveLen(1))
+
+	g.Expect(prodCache.Replace([]interface{}{}, "2")).To(Succeed())
+	g.Expect(indexer.ListKeys()).To(ConsistOf("default/b"))
+}
+
+func TestSlimPodCache(t *testing.T) {
+	g := NewWithT(t)
+
+	cfg := DefaultConfig
+	cfg.LabelTagMapping = map[string]string{"owner": "owner", "app": "app.name"}
+	indexer := CreateIndexer()
+	podCache := CreatePodCacheStore(indexer, allNamespaces, cfg)
+
+	g.Expect(podCache.Add(benchmarkPod(1))).To(Succeed())
+
+	obj, exists, err := indexer.GetByKey("default/backend-1")
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(exists).To(BeTrue())
+	g.Expect(obj).To(Equal(&v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "backend-1",
+			Namespace:       "default",
+			ResourceVersion: "1001",
+			Labels:          map[string]string{"owner": "team-1", "app": "backend"},
+		},
+		Spec:   v1.PodSpec{ServiceAccountName: "backend"},
+		Status: v1.PodStatus{PodIP: "10.0.0.1"},
+	}))
+	g.Expect(getIPTagValues(CreateKubernetesProvider(indexer), "10.0.0.1", cfg)).To(Equal(map[string]string{"owner": "team-1", "app.name": "backend"}))
+
+	updated := benchmarkPod(1)
+	updated.Status.PodIP = "10.0.0.2"
+	g.Expect(podCache.Update(updated)).To(Succeed())
+	g.Expect(indexer.ByIndex(ipIndex, "10.0.0.1")).To(BeEmpty())
+	g.Expect(indexer.ByIndex(ipIndex, "10.0.0.2")).To(HaveLen(1))
+
+	g.Expect(podCache.Delete(updated)).To(Succeed())
+	g.Expect(indexer.ListKeys()).To(BeEmpty())
+}
+
+// benchmarkPod returns a pod like the ones Deployments create, with the
+// usual metadata, containers and status.
+func benchmarkPod(i int) *v1.Pod {
+	name := fmt.Sprintf("backend-%d", i)
+	container := v1.Container{
+		Name:  "backend",
+		Image: "registry.example.com/backend:1.2.3",
+		Args:  []string{"--port=8080", "--log-level=info"},
+		Ports: []v1.ContainerPort{{Name: "http", ContainerPort: 8080, Protocol: v1.ProtocolTCP}},
+		Env: []v1.EnvVar{
+			{Name: "ZIPKIN_URL", Value: "http://zipkin.support:9411"},
+			{Name: "DATABASE_URL", ValueFrom: &v1.EnvVarSource{SecretKeyRef: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{Name: "backend"},
+				Key:                  "database-url",
+			}}},
+		},
+		Resources: v1.ResourceRequirements{
+			Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("100m"), v1.ResourceMemory: resource.MustParse("128Mi")},
+			Limits:   v1.ResourceList{v1.ResourceMemory: resource.MustParse("256Mi")},
+		},
+		VolumeMounts: []v1.VolumeMount{{Name: "backend-token", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount", ReadOnly: true}},
+	}
+	sidecar := container
+	sidecar.Name = "proxy"
+	sidecar.Image = "registry.example.com/proxy:4.5.6"
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            name,
+			Namespace:       "default",
+			UID:             types.UID(fmt.Sprintf("6b7c2f1e-0000-4000-8000-%012d", i)),
+			ResourceVersion: fmt.Sprint(1000 + i),
+			Labels: map[string]string{
+				"app":                          "backend",
+				"owner":                        fmt.Sprintf("team-%d", i%10),
+				"pod-template-hash":            "7f9c8d6b5",
+				"app.kubernetes.io/managed-by": "helm",
+				"app.kubernetes.io/version":    "1.2.3",
+			},
+			Annotations: map[string]string{
+				"kubectl.kubernetes.io/restartedAt": "2020-05-01T10:00:00Z",
+				"checksum/config":                   strings.Repeat("a", 64),
+			},
+			OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "backend-7f9c8d6b5", UID: "7f9c8d6b5"}},
+		},
+		Spec: v1.PodSpec{
+			Containers:         []v1.Container{container, sidecar},
+			ServiceAccountName: "backend",
+			NodeName:           fmt.Sprintf("node-%d", i%100),
+			Volumes: []v1.Volume{{Name: "backend-token", VolumeSource: v1.VolumeSource{
+				Secret: &v1.SecretVolumeSource{SecretName: "backend-token"},
+			}}},
+			Tolerations: []v1.Toleration{
+				{Key: "node.kubernetes.io/not-ready", Operator: v1.TolerationOpExists, Effect: v1.TaintEffectNoExecute},
+				{Key: "node.kubernetes.io/unreachable", Operator: v1.TolerationOpExists, Effect: v1.TaintEffectNoExecute},
+			},
+		},
+		Status: v1.PodStatus{
+			Phase:  v1.PodRunning,
+			PodIP:  fmt.Sprintf("10.%d.%d.%d", i/65536%256, i/256%256, i%256),
+			HostIP: fmt.Sprintf("192.168.0.%d", i%100),
+			Conditions: []v1.PodCondition{
+				{Type: v1.PodInitialized, Status: v1.ConditionTrue},
+				{Type: v1.PodReady, Status: v1.ConditionTrue},
+				{Type: v1.ContainersReady, Status: v1.ConditionTrue},
+				{Type: v1.PodScheduled, Status: v1.ConditionTrue},
+			},
+			ContainerStatuses: []v1.ContainerStatus{
+				{Name: "backend", Ready: true, Image: container.Image, ImageID: "docker-pullable://" + container.Image, ContainerID: "docker://" + strings.Repeat("b", 64)},
+				{Name: "proxy", Ready: true, Image: sidecar.Image, ImageID: "docker-pullable://" + sidecar.Image, ContainerID: "docker://" + strings.Repeat("c", 64)},
+			},
+		},
+	}
+}
+
+func heapAlloc() int64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapAlloc)
+}
+
+// BenchmarkPodCacheMemory reports the memory that the pod cache retains for
+// 10k pods, with full pods as they are received from the API server and with
+// slimmed down pods.
+func BenchmarkPodCacheMemory(b *testing.B) {
+	cases := []struct {
+		name  string
+		store func(indexer cache.Indexer) cache.Store
+	}{
+		{"Full pods", func(indexer cache.Indexer) cache.Store { return indexer }},
+		{"Slim pods", func(indexer cache.Indexer) cache.Store {
+			return CreatePodCacheStore(indexer, allNamespaces, DefaultConfig)
+		}},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			var retained int64
+			for n := 0; n < b.N; n++ {
+				before := heapAlloc()
+				indexer := CreateIndexer()
+				store := c.store(indexer)
+				for i := 0; i < 10000; i++ {
+					if err := store.Add(benchmarkPod(i)); err != nil {
+						b.Fatal(err)
+					}
+				}
+				retained += heapAlloc() - before
+				runtime.KeepAlive(indexer)
+			}
+			b.ReportMetric(float64(retained)/float64(b.N), "bytes/10k-pods")
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import "net"
+
+// zipkinSpan is a Zipkin v2 span as described in
+// https://zipkin.io/zipkin-api/zipkin2-api.yaml. It's used for spans that are
+// converted from other formats.
+type zipkinSpan struct {
+	TraceID        string             `json:"traceId"`
+	ParentID       string             `json:"parentId,omitempty"`
+	ID             string             `json:"id"`
+	Kind           string             `json:"kind,omitempty"`
+	Name           string             `json:"name,omitempty"`
+	Timestamp      uint64             `json:"timestamp,omitempty"`
+	Duration       uint64             `json:"duration,omitempty"`
+	Debug          bool               `json:"debug,omitempty"`
+	Shared         bool               `json:"shared,omitempty"`
+	LocalEndpoint  *zipkinEndpoint    `json:"localEndpoint,omitempty"`
+	RemoteEndpoint *zipkinEndpoint    `json:"remoteEndpoint,omitempty"`
+	Annotations    []zipkinAnnotation `json:"annotations,omitempty"`
+	Tags           map[string]string  `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+	Port        int    `json:"port,omitempty"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp uint64 `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+const (
+	zipkinKindClient   = "CLIENT"
+	zipkinKindServer   = "SERVER"
+	zipkinKindProducer = "PRODUCER"
+	zipkinKindConsumer = "CONSUMER"
+)
+
+// setIP sets either the IPv4 or IPv6 address of the endpoint.
+func (e *zipkinEndpoint) setIP(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	if ipv4 := ip.To4(); ipv4 != nil {
+		e.IPv4 = ipv4.String()
+	} else {
+		e.IPv6 = ip.String()
+	}
+}